@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"net/http"
+)
+
+// POST /admin/reload does the same as SIGHUP
+func (sc *ServerContext) postReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Infof("Reload requested by %s", r.RemoteAddr)
+	if err := sc.Reload(); err != nil {
+		logger.Errorf("Reload failed, keeping the previous configuration: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := io.WriteString(w, "reloaded\n"); err != nil {
+		logger.Errorf("Failed to write reload response: %s", err)
+	}
+}
+
+// GET /admin/calls lists the calls in progress with their RTCP statistics
+func (sc *ServerContext) getCalls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response, err := json.Marshal(sc.calls.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(response); err != nil {
+		logger.Errorf("Failed to write calls response: %s", err)
+	}
+}
+
+func (sc *ServerContext) setupAdminServer(listenAddress string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reload", sc.postReload)
+	mux.HandleFunc("/admin/calls", sc.getCalls)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.Infof("Admin endpoints listening on %s", listenAddress)
+	sc.adminServer = &http.Server{Addr: listenAddress, Handler: mux}
+	go func() {
+		if err := sc.adminServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+}
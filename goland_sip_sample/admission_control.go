@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// every call costs a peer connection and a 720p H.264 encoder, so the number of calls
+// we take has to be bounded or a burst of INVITEs eats all the CPU
+const (
+	defaultMaxConcurrentCalls          = 20
+	defaultMaxConcurrentCallsPerIP     = 5
+	defaultMaxInvitesPerSecond         = 10
+	defaultMaxInvitesPerSecondPerIP    = 2
+	defaultAdmissionRetryAfter         = time.Second * 10
+	admissionRateWindow                = time.Second
+	admissionRateWindowsPruneThreshold = 1024
+)
+
+type CallAdmissionLimits struct {
+	// zero disables the corresponding limit
+	maxConcurrentCalls       int
+	maxConcurrentCallsPerIP  int
+	maxInvitesPerSecond      int
+	maxInvitesPerSecondPerIP int
+	// suggested to the caller when a concurrency limit is hit
+	retryAfter time.Duration
+}
+
+func callAdmissionLimitsFromConfig(c AdmissionConfig) CallAdmissionLimits {
+	return CallAdmissionLimits{
+		maxConcurrentCalls:       c.MaxCalls,
+		maxConcurrentCallsPerIP:  c.MaxCallsPerIP,
+		maxInvitesPerSecond:      c.MaxInvitesPerSecond,
+		maxInvitesPerSecondPerIP: c.MaxInvitesPerSecondPerIP,
+		retryAfter:               c.RetryAfter,
+	}
+}
+
+// AdmissionRejection is returned by CallAdmission.Admit when a call may not be started.
+type AdmissionRejection struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (r *AdmissionRejection) Error() string {
+	return fmt.Sprintf("call rejected: %s, retry after %s", r.reason, r.retryAfter)
+}
+
+// RetryAfterSeconds is the value for the Retry-After header, never less than a second
+func (r *AdmissionRejection) RetryAfterSeconds() int {
+	seconds := int((r.retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// fixed window counter. cheap and good enough to cut bursts of INVITEs
+type rateWindow struct {
+	windowStart time.Time
+	count       int
+}
+
+// available tells whether one more fits in the window, without taking it
+func (w *rateWindow) available(now time.Time, limit int) (bool, time.Duration) {
+	if now.Sub(w.windowStart) >= admissionRateWindow {
+		w.windowStart = now
+		w.count = 0
+	}
+	if limit > 0 && w.count >= limit {
+		return false, w.windowStart.Add(admissionRateWindow).Sub(now)
+	}
+	return true, 0
+}
+
+type CallAdmission struct {
+	limits CallAdmissionLimits
+
+	mutex sync.Mutex
+	// set once the server is shutting down, nothing is admitted after that
+	draining        bool
+	activeCalls     int
+	activeCallsByIP map[string]int
+	invites         rateWindow
+	invitesByIP     map[string]*rateWindow
+}
+
+func NewCallAdmission(limits CallAdmissionLimits) *CallAdmission {
+	return &CallAdmission{
+		limits:          limits,
+		activeCallsByIP: make(map[string]int),
+		invitesByIP:     make(map[string]*rateWindow),
+	}
+}
+
+// sourceIP strips the port from addresses like the ones reported by sip.Request.Source() and http.Request.RemoteAddr
+func sourceIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// Admit accounts for a new call from remoteAddr. When the call is admitted the returned release function
+// must be called exactly once the call is over; calling it more than once is harmless.
+func (ca *CallAdmission) Admit(remoteAddr string) (func(), error) {
+	ip := sourceIP(remoteAddr)
+	now := time.Now()
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if ca.draining {
+		return nil, &AdmissionRejection{"server is shutting down", ca.limits.retryAfter}
+	}
+	if ca.limits.maxConcurrentCalls > 0 && ca.activeCalls >= ca.limits.maxConcurrentCalls {
+		return nil, &AdmissionRejection{"too many concurrent calls", ca.limits.retryAfter}
+	}
+	if ca.limits.maxConcurrentCallsPerIP > 0 && ca.activeCallsByIP[ip] >= ca.limits.maxConcurrentCallsPerIP {
+		return nil, &AdmissionRejection{"too many concurrent calls from " + ip, ca.limits.retryAfter}
+	}
+
+	ipInvites := ca.invitesByIP[ip]
+	if ipInvites == nil {
+		ca.pruneRateWindows(now)
+		ipInvites = &rateWindow{}
+		ca.invitesByIP[ip] = ipInvites
+	}
+	// every window is checked before any is charged, a rejected INVITE must not use up the budget of the others
+	if ok, retryAfter := ipInvites.available(now, ca.limits.maxInvitesPerSecondPerIP); !ok {
+		return nil, &AdmissionRejection{"too many INVITEs per second from " + ip, retryAfter}
+	}
+	if ok, retryAfter := ca.invites.available(now, ca.limits.maxInvitesPerSecond); !ok {
+		return nil, &AdmissionRejection{"too many INVITEs per second", retryAfter}
+	}
+	ipInvites.count++
+	ca.invites.count++
+
+	ca.activeCalls++
+	ca.activeCallsByIP[ip]++
+
+	var releaseOnce sync.Once
+	return func() {
+		releaseOnce.Do(func() { ca.release(ip) })
+	}, nil
+}
+
+func (ca *CallAdmission) release(ip string) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.activeCalls--
+	ca.activeCallsByIP[ip]--
+	if ca.activeCallsByIP[ip] <= 0 {
+		delete(ca.activeCallsByIP, ip)
+	}
+}
+
+// SetLimits applies to calls admitted from now on, calls in progress are not affected
+func (ca *CallAdmission) SetLimits(limits CallAdmissionLimits) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.limits = limits
+}
+
+// StopAdmitting rejects every call from now on, calls in progress are not affected
+func (ca *CallAdmission) StopAdmitting() {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.draining = true
+}
+
+func (ca *CallAdmission) ActiveCalls() int {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	return ca.activeCalls
+}
+
+// forget rate windows of sources that were quiet for a while. must be called under the mutex
+func (ca *CallAdmission) pruneRateWindows(now time.Time) {
+	if len(ca.invitesByIP) < admissionRateWindowsPruneThreshold {
+		return
+	}
+	for ip, window := range ca.invitesByIP {
+		if now.Sub(window.windowStart) >= admissionRateWindow {
+			delete(ca.invitesByIP, ip)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAdmitRejectedByGlobalRateDoesNotChargeIPWindow(t *testing.T) {
+	ca := NewCallAdmission(CallAdmissionLimits{maxInvitesPerSecond: 1, maxInvitesPerSecondPerIP: 1})
+
+	if _, err := ca.Admit("192.0.2.1:5060"); err != nil {
+		t.Fatalf("first INVITE rejected: %s", err)
+	}
+	_, err := ca.Admit("192.0.2.2:5060")
+	var rejection *AdmissionRejection
+	if !errors.As(err, &rejection) {
+		t.Fatalf("second INVITE not rejected by the global rate, got %v", err)
+	}
+	if count := ca.invitesByIP["192.0.2.2"].count; count != 0 {
+		t.Errorf("rejected INVITE charged its per IP window with %d", count)
+	}
+	if ca.invites.count != 1 {
+		t.Errorf("global window has %d INVITEs, expected 1", ca.invites.count)
+	}
+}
+
+func TestAdmitRejectedByIPRateDoesNotChargeGlobalWindow(t *testing.T) {
+	ca := NewCallAdmission(CallAdmissionLimits{maxInvitesPerSecond: 2, maxInvitesPerSecondPerIP: 1})
+
+	if _, err := ca.Admit("192.0.2.1:5060"); err != nil {
+		t.Fatalf("first INVITE rejected: %s", err)
+	}
+	if _, err := ca.Admit("192.0.2.1:5061"); err == nil {
+		t.Fatal("second INVITE from the same IP admitted")
+	}
+	if _, err := ca.Admit("192.0.2.2:5060"); err != nil {
+		t.Errorf("INVITE from another IP rejected: %s", err)
+	}
+}
+
+func TestAdmissionReleasedOnce(t *testing.T) {
+	ca := NewCallAdmission(CallAdmissionLimits{maxConcurrentCalls: 1})
+
+	release, err := ca.Admit("192.0.2.1:5060")
+	if err != nil {
+		t.Fatalf("INVITE rejected: %s", err)
+	}
+	if _, err := ca.Admit("192.0.2.2:5060"); err == nil {
+		t.Fatal("call admitted beyond the concurrency limit")
+	}
+	release()
+	release()
+	if active := ca.ActiveCalls(); active != 0 {
+		t.Errorf("%d active calls after release, expected 0", active)
+	}
+}
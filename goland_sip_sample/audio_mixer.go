@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// with audio.mix every call mixes its own audio: the prompt or tone in front, background music under it, beeps on
+// top of both and comfort noise below everything, so the caller never hears dead silence. Prompts are decoded once
+// when the resources are loaded. A prompt that replaces another fades in while the other one fades out, music is
+// ducked while something plays in front. Frames of 20 ms are mixed and encoded with libopus as they become due
+const (
+	// background music is that much lower while a prompt or tone plays
+	audioMusicDuckingDB = 12
+	// the comfort noise generator, a xorshift, starts from here
+	comfortNoiseSeed = 0x9e3779b9
+)
+
+// audioPrompt is a prompt as read from its file, and decoded when audio is mixed
+type audioPrompt struct {
+	pages []OggAudioPage
+	// interleaved stereo, nil unless audio is mixed
+	pcm []int16
+}
+
+// readAudioPrompt reads an Ogg/Opus file, and decodes it for mixing if decode
+func readAudioPrompt(path string, decode bool) (*audioPrompt, error) {
+	pages, err := readOggFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prompt := &audioPrompt{pages: pages}
+	if decode {
+		if prompt.pcm, err = decodeOpus(pages); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+	}
+	return prompt, nil
+}
+
+// decibels converts a gain in dB to a factor
+func decibels(db int) float32 {
+	return float32(math.Pow(10, float64(db)/20))
+}
+
+// pcmSample converts a sample of full scale 1 to 16 bit, clipping it
+func pcmSample(value float32) int16 {
+	value *= math.MaxInt16
+	if value > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if value < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(value)
+}
+
+// audioSource is something the mixer plays
+type audioSource interface {
+	// read writes the next interleaved samples into buf, at full scale 1, and returns how many.
+	// fewer than len(buf) once the source ended
+	read(buf []float32) int
+}
+
+// pcmSource plays decoded audio
+type pcmSource struct {
+	pcm      []int16
+	position int
+	loop     bool
+}
+
+func (s *pcmSource) read(buf []float32) int {
+	n := 0
+	for n < len(buf) {
+		if s.position == len(s.pcm) {
+			if !s.loop || len(s.pcm) == 0 {
+				break
+			}
+			s.position = 0
+		}
+		buf[n] = float32(s.pcm[s.position]) / math.MaxInt16
+		n++
+		s.position++
+	}
+	return n
+}
+
+// audioLayer is a source in the mix with a gain that fades toward target
+type audioLayer struct {
+	source audioSource
+	gain   float32
+	target float32
+	// per sample of a channel
+	step float32
+	tone bool
+	// closed once the layer left the mix
+	done chan struct{}
+}
+
+func newAudioLayer(source audioSource, gain float32) *audioLayer {
+	return &audioLayer{source: source, gain: gain, target: gain, done: make(chan struct{})}
+}
+
+// fadeTo fades the gain to target within samples
+func (l *audioLayer) fadeTo(target float32, samples int) {
+	l.target = target
+	if samples < 1 {
+		l.gain = target
+		return
+	}
+	l.step = float32(math.Abs(float64(target-l.gain))) / float32(samples)
+}
+
+// mixInto adds the layer to mix, scratch is as long as mix. false once the source ended or it faded out
+func (l *audioLayer) mixInto(mix []float32, scratch []float32) bool {
+	n := l.source.read(scratch)
+	for i := 0; i < n; i += audioChannels {
+		switch {
+		case l.gain < l.target:
+			l.gain = min(l.gain+l.step, l.target)
+		case l.gain > l.target:
+			l.gain = max(l.gain-l.step, l.target)
+		}
+		for channel := 0; channel < audioChannels; channel++ {
+			mix[i+channel] += scratch[i+channel] * l.gain
+		}
+	}
+	return n == len(mix) && (l.gain > 0 || l.target > 0)
+}
+
+// audioMixer mixes the audio of a call. It is fed from any goroutine and read from the one that sends the audio
+type audioMixer struct {
+	mutex sync.Mutex
+	// the prompt or tone in front, nil for none
+	front *audioLayer
+	// what was in front before and fades out
+	fading  []*audioLayer
+	music   *audioLayer
+	effects []*audioLayer
+	// samples per channel
+	crossfade  int
+	musicGain  float32
+	noiseLevel float32
+	noise      uint32
+	mix        []float32
+	scratch    []float32
+}
+
+func newAudioMixer(settings AudioConfig, music []int16) *audioMixer {
+	m := &audioMixer{
+		crossfade: int(settings.Crossfade * audioClockRate / time.Second),
+		noise:     comfortNoiseSeed,
+		mix:       make([]float32, audioFrameLength),
+		scratch:   make([]float32, audioFrameLength),
+	}
+	if settings.ComfortNoiseLevel != 0 {
+		m.noiseLevel = decibels(settings.ComfortNoiseLevel)
+	}
+	if music != nil {
+		m.musicGain = decibels(settings.MusicLevel)
+		m.music = newAudioLayer(&pcmSource{pcm: music, loop: true}, m.musicGain)
+	}
+	return m
+}
+
+// play puts source in front. What was there fades out, and source fades in unless nothing was there
+func (m *audioMixer) play(source audioSource, tone bool) *audioLayer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	layer := newAudioLayer(source, 1)
+	layer.tone = tone
+	if m.front != nil {
+		m.fadeOutLocked(m.front)
+		layer.gain = 0
+		layer.fadeTo(1, m.crossfade)
+	}
+	m.front = layer
+	m.duckMusicLocked()
+	return layer
+}
+
+// fadeOut fades layer out if it is still in front
+func (m *audioMixer) fadeOut(layer *audioLayer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.front == layer {
+		m.fadeOutLocked(layer)
+		m.duckMusicLocked()
+	}
+}
+
+// stopTone fades out what is in front if it is a tone
+func (m *audioMixer) stopTone() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.front != nil && m.front.tone {
+		m.fadeOutLocked(m.front)
+		m.duckMusicLocked()
+	}
+}
+
+func (m *audioMixer) fadeOutLocked(layer *audioLayer) {
+	layer.fadeTo(0, m.crossfade)
+	m.fading = append(m.fading, layer)
+	m.front = nil
+}
+
+func (m *audioMixer) duckMusicLocked() {
+	if m.music == nil {
+		return
+	}
+	gain := m.musicGain
+	if m.front != nil {
+		gain = m.musicGain / decibels(audioMusicDuckingDB)
+	}
+	m.music.fadeTo(gain, m.crossfade)
+}
+
+// playEffect plays source on top of everything else
+func (m *audioMixer) playEffect(source audioSource) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.effects = append(m.effects, newAudioLayer(source, 1))
+}
+
+// next mixes the next frame into pcm
+func (m *audioMixer) next(pcm []int16) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.mix {
+		m.mix[i] = m.nextNoise()
+	}
+	if m.music != nil {
+		m.music.mixInto(m.mix, m.scratch)
+	}
+	m.fading = m.mixLayers(m.fading)
+	if m.front != nil && !m.front.mixInto(m.mix, m.scratch) {
+		close(m.front.done)
+		m.front = nil
+		m.duckMusicLocked()
+	}
+	m.effects = m.mixLayers(m.effects)
+	for i, value := range m.mix {
+		pcm[i] = pcmSample(value)
+	}
+}
+
+// mixLayers mixes layers and returns those that go on
+func (m *audioMixer) mixLayers(layers []*audioLayer) []*audioLayer {
+	playing := layers[:0]
+	for _, layer := range layers {
+		if layer.mixInto(m.mix, m.scratch) {
+			playing = append(playing, layer)
+		} else {
+			close(layer.done)
+		}
+	}
+	return playing
+}
+
+// nextNoise is white noise at the comfort noise level
+func (m *audioMixer) nextNoise() float32 {
+	if m.noiseLevel == 0 {
+		return 0
+	}
+	m.noise ^= m.noise << 13
+	m.noise ^= m.noise >> 17
+	m.noise ^= m.noise << 5
+	return (float32(m.noise)/math.MaxUint32*2 - 1) * m.noiseLevel
+}
+
+// mixAudio sends the mix of the call from the time ICE connects until the call ends. Frames are timestamped by
+// their number, so that the receiver plays them without gaps, and mixed as they become due on the wall clock
+func (vmi *VoiceMenuInstance) mixAudio() {
+	ctx := vmi._voiceMenuInstanceContext
+	select {
+	case <-vmi._iceConnectedCtx.Done():
+	case <-ctx.Done():
+		return
+	}
+	encoder, err := NewAudioEncoder(vmi._vmr.audio.Bitrate, vmi._log)
+	if err != nil {
+		vmi._log.Errorf("Failed to create the audio encoder, the call gets no audio: %s", err)
+		return
+	}
+	defer encoder.Close()
+
+	ticker := time.NewTicker(audioOggPageDuration)
+	defer ticker.Stop()
+	start := time.Now()
+	startTimestamp := vmi._audioTrack.timestampAt(start)
+	pcm := make([]int16, audioFrameLength)
+	for frame := 0; ; {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for ; !start.Add(time.Duration(frame) * audioOggPageDuration).After(now); frame++ {
+				vmi._audioMixer.next(pcm)
+				packet, err := encoder.Encode(pcm)
+				if err != nil {
+					vmi._log.Errorf("Failed to encode audio: %s", err)
+					return
+				}
+				if packet != nil {
+					vmi.sendAudioPacket(packet, startTimestamp+uint32(frame*audioFrameSamples))
+				}
+			}
+		}
+	}
+}
+
+func (vmi *VoiceMenuInstance) sendAudioPacket(packet []byte, timestamp uint32) {
+	if err := vmi.writeAudioPacket(packet, timestamp); err != nil {
+		vmi._log.Errorf("Failed to send audio, ending the call: %s", err)
+		vmi.Close()
+	}
+}
+
+// separate function to defer mutex unlock
+func (vmi *VoiceMenuInstance) writeAudioPacket(packet []byte, timestamp uint32) error {
+	vmi._connectionReInitMutex.RLock()
+	defer vmi._connectionReInitMutex.RUnlock()
+	if vmi._closed {
+		return nil
+	}
+	if err := vmi._audioTrack.writeFrame(packet, timestamp); err != nil {
+		return err
+	}
+	audioFramesMixedTotal.Inc()
+	return nil
+}
+
+// playPrompt returns once the prompt is played or ctx is done. Mixed prompts then fade out, the next one may
+// already start meanwhile
+func (vmi *VoiceMenuInstance) playPrompt(ctx context.Context, prompt *audioPrompt) {
+	if vmi._audioMixer == nil {
+		playbackTrack(ctx, vmi, prompt.pages)
+		return
+	}
+	vmi._log.Info("Start prompt playback. Num samples: ", len(prompt.pcm)/audioChannels)
+	layer := vmi._audioMixer.play(&pcmSource{pcm: prompt.pcm}, false)
+	select {
+	case <-layer.done:
+	case <-ctx.Done():
+		vmi._audioMixer.fadeOut(layer)
+	}
+}
+
+// PlayTone plays a tone of audio.country or audio.tones in place of a prompt, like ringback or busy. It goes on
+// until it ends, StopTone or the next prompt
+func (vmi *VoiceMenuInstance) PlayTone(name string) error {
+	if vmi._audioMixer == nil {
+		return errors.New("tones need audio.mix")
+	}
+	t, known := vmi._vmr.tones[name]
+	if !known {
+		return fmt.Errorf("unknown tone %q", name)
+	}
+	vmi._audioMixer.play(newToneSource(t), true)
+	return nil
+}
+
+// StopTone fades out the tone that plays, a prompt goes on
+func (vmi *VoiceMenuInstance) StopTone() {
+	if vmi._audioMixer != nil {
+		vmi._audioMixer.stopTone()
+	}
+}
+
+// beep plays the beep tone over whatever plays, if audio is mixed and it is not turned off in audio.tones
+func (vmi *VoiceMenuInstance) beep() {
+	if t, known := vmi._vmr.tones[beepToneName]; known && vmi._audioMixer != nil {
+		vmi._audioMixer.playEffect(newToneSource(t))
+	}
+}
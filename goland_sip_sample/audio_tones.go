@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// call progress tones are written like in Asterisk's indications.conf: parts separated by commas, each one or two
+// frequencies in Hz and how long they sound in ms, e.g. 440+480/2000,0/4000 for the US ringback. 0 is silence,
+// f1*f2 is f1 modulated by f2, a part without a duration goes on until the tone is stopped. Parts starting with !
+// are played once, the tone repeats from the first part without !, or ends if there is none
+const (
+	defaultAudioCountry = "us"
+	// of each frequency, about -14 dBFS
+	toneAmplitude = 0.2
+	// the depth of f1*f2, as Asterisk has it
+	toneModulationDepth = 0.9
+	// confirms a DTMF digit, the same everywhere
+	beepToneName = "beep"
+	beepTone     = "!1000/100"
+)
+
+// countryTones are the tones of Asterisk's sample indications.conf for a few countries
+var countryTones = map[string]map[string]string{
+	"us": {
+		"dial":       "350+440",
+		"ringback":   "440+480/2000,0/4000",
+		"busy":       "480+620/500,0/500",
+		"congestion": "480+620/250,0/250",
+	},
+	"uk": {
+		"dial":       "350+440",
+		"ringback":   "400+450/400,0/200,400+450/400,0/2000",
+		"busy":       "400/375,0/375",
+		"congestion": "400/400,0/350,400/225,0/525",
+	},
+	"de": {
+		"dial":       "425",
+		"ringback":   "425/1000,0/4000",
+		"busy":       "425/480,0/480",
+		"congestion": "425/240,0/240",
+	},
+	"fr": {
+		"dial":       "440",
+		"ringback":   "440/1500,0/3500",
+		"busy":       "440/500,0/500",
+		"congestion": "440/250,0/250",
+	},
+	"jp": {
+		"dial":       "400",
+		"ringback":   "400+15/1000,0/2000",
+		"busy":       "400/500,0/500",
+		"congestion": "400/500,0/500",
+	},
+}
+
+func countryNames() []string {
+	names := make([]string, 0, len(countryTones))
+	for name := range countryTones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type tonePart struct {
+	// the second one is 0 for a single frequency
+	frequencies [2]float64
+	modulated   bool
+	// samples per channel, 0 for as long as the tone plays
+	length int
+	once   bool
+}
+
+type tone struct {
+	parts []tonePart
+	// where the tone repeats from, -1 if it ends after the last part
+	repeatFrom int
+}
+
+// parseTone reads a tone written like in indications.conf
+func parseTone(definition string) (*tone, error) {
+	t := &tone{repeatFrom: -1}
+	for _, part := range strings.Split(definition, ",") {
+		var p tonePart
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "!") {
+			p.once = true
+			part = part[1:]
+		} else if t.repeatFrom < 0 {
+			t.repeatFrom = len(t.parts)
+		}
+
+		frequencies, duration, timed := strings.Cut(part, "/")
+		if timed {
+			ms, err := strconv.Atoi(duration)
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("%q is no duration in ms", duration)
+			}
+			p.length = int(time.Duration(ms) * time.Millisecond * audioClockRate / time.Second)
+		}
+		separator := "+"
+		if strings.Contains(frequencies, "*") {
+			separator, p.modulated = "*", true
+		}
+		for i, frequency := range strings.SplitN(frequencies, separator, 2) {
+			hz, err := strconv.ParseFloat(frequency, 64)
+			if err != nil || hz < 0 || hz > audioClockRate/2 {
+				return nil, fmt.Errorf("%q is no frequency in Hz", frequency)
+			}
+			p.frequencies[i] = hz
+		}
+		t.parts = append(t.parts, p)
+	}
+	for i, p := range t.parts {
+		if p.length == 0 && i != len(t.parts)-1 {
+			return nil, errors.New("only the last part may go without a duration")
+		}
+	}
+	return t, nil
+}
+
+// loadTones parses the tones of country and the configured ones, which add to them or replace them. An empty
+// definition removes a tone
+func loadTones(country string, configured map[string]string) (map[string]*tone, error) {
+	definitions := map[string]string{beepToneName: beepTone}
+	for name, definition := range countryTones[country] {
+		definitions[name] = definition
+	}
+	for name, definition := range configured {
+		definitions[name] = definition
+	}
+	tones := make(map[string]*tone)
+	for name, definition := range definitions {
+		if definition == "" {
+			continue
+		}
+		t, err := parseTone(definition)
+		if err != nil {
+			return nil, fmt.Errorf("tone %s: %w", name, err)
+		}
+		tones[name] = t
+	}
+	return tones, nil
+}
+
+// toneSource is an audioSource that plays a tone
+type toneSource struct {
+	tone *tone
+	part int
+	// samples per channel into the part, and since the start for the phase
+	position int
+	sample   int
+}
+
+func newToneSource(t *tone) *toneSource {
+	return &toneSource{tone: t}
+}
+
+func (s *toneSource) read(buf []float32) int {
+	n := 0
+	for ; n+audioChannels <= len(buf); n += audioChannels {
+		part := &s.tone.parts[s.part]
+		for part.length > 0 && s.position >= part.length {
+			s.part, s.position = s.part+1, 0
+			if s.part == len(s.tone.parts) {
+				if s.tone.repeatFrom < 0 {
+					s.part--
+					return n
+				}
+				s.part = s.tone.repeatFrom
+			}
+			part = &s.tone.parts[s.part]
+		}
+
+		value := float32(part.value(float64(s.sample) / audioClockRate))
+		for channel := 0; channel < audioChannels; channel++ {
+			buf[n+channel] = value
+		}
+		s.position++
+		s.sample++
+	}
+	return n
+}
+
+// value is the part at t seconds
+func (p *tonePart) value(t float64) float64 {
+	first := math.Sin(2 * math.Pi * p.frequencies[0] * t)
+	second := math.Sin(2 * math.Pi * p.frequencies[1] * t)
+	if p.modulated {
+		return toneAmplitude * first * (1 - toneModulationDepth + toneModulationDepth*math.Abs(second))
+	}
+	return toneAmplitude * (first + second)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"github.com/pion/rtp/codecs/av1/obu"
+)
+
+// AV1 frames are temporal units of OBUs with size fields, as encoders and IVF files have them. The RTP payload
+// format (https://aomediacodec.github.io/av1-rtp-spec/) carries OBUs without size fields, each preceded by its length
+// in the aggregation, and leaves out temporal delimiters, tile lists and padding. pion's AV1Payloader takes a single
+// OBU at a time, which the packetizer would mark as a frame of its own
+const (
+	av1OBUForbiddenBit   = 0x80
+	av1OBUExtensionFlag  = 0x04
+	av1OBUHasSizeField   = 0x02
+	av1OBUTypeShift      = 3
+	av1OBUTypeMask       = 0x0f
+	av1OBUSequenceHeader = 1
+	av1OBUTemporalDelim  = 2
+	av1OBUTileList       = 8
+	av1OBUPadding        = 15
+
+	// the aggregation header: the first element continues an OBU, the last one continues in the next packet,
+	// the packet starts a coded video sequence
+	av1AggregationZ = 0x80
+	av1AggregationY = 0x40
+	av1AggregationN = 0x08
+)
+
+var errAV1ForbiddenBit = errors.New("AV1 OBU with the forbidden bit set")
+
+type av1OBU struct {
+	obuType int
+	// the header without the size field flag, followed by the payload
+	data []byte
+}
+
+// parseAV1OBUs splits a temporal unit into its OBUs, the last one may go without a size field
+func parseAV1OBUs(frame []byte) ([]av1OBU, error) {
+	var obus []av1OBU
+	for len(frame) > 0 {
+		header := frame[0]
+		if header&av1OBUForbiddenBit != 0 {
+			return nil, errAV1ForbiddenBit
+		}
+		headerSize := 1
+		if header&av1OBUExtensionFlag != 0 {
+			headerSize = 2
+		}
+		if len(frame) < headerSize {
+			return nil, errors.New("truncated AV1 OBU header")
+		}
+
+		payloadStart, payloadEnd := headerSize, len(frame)
+		if header&av1OBUHasSizeField != 0 {
+			size, sizeLength, err := obu.ReadLeb128(frame[headerSize:])
+			if err != nil {
+				return nil, err
+			}
+			payloadStart += int(sizeLength)
+			payloadEnd = payloadStart + int(size)
+			if payloadEnd > len(frame) {
+				return nil, errors.New("truncated AV1 OBU")
+			}
+		}
+
+		data := make([]byte, 0, headerSize+payloadEnd-payloadStart)
+		data = append(data, header&^av1OBUHasSizeField)
+		data = append(data, frame[1:headerSize]...)
+		data = append(data, frame[payloadStart:payloadEnd]...)
+		obus = append(obus, av1OBU{obuType: int(header>>av1OBUTypeShift) & av1OBUTypeMask, data: data})
+		frame = frame[payloadEnd:]
+	}
+	return obus, nil
+}
+
+// av1IsKeyframe looks for a sequence header, which encoders put in front of every keyframe
+func av1IsKeyframe(frame []byte) bool {
+	obus, err := parseAV1OBUs(frame)
+	if err != nil {
+		return false
+	}
+	for _, o := range obus {
+		if o.obuType == av1OBUSequenceHeader {
+			return true
+		}
+	}
+	return false
+}
+
+func leb128Length(value int) int {
+	length := 1
+	for ; value >= 0x80; value >>= 7 {
+		length++
+	}
+	return length
+}
+
+func appendLEB128(b []byte, value int) []byte {
+	for ; value >= 0x80; value >>= 7 {
+		b = append(b, byte(value&0x7f)|0x80)
+	}
+	return append(b, byte(value))
+}
+
+// av1Payloader packetizes whole temporal units. Every OBU element is preceded by its length, W is 0
+type av1Payloader struct{}
+
+func (p *av1Payloader) Payload(mtu uint16, frame []byte) [][]byte {
+	obus, err := parseAV1OBUs(frame)
+	// the aggregation header, a length and a byte of an OBU
+	if err != nil || mtu < 3 {
+		return nil
+	}
+
+	var payloads [][]byte
+	payload := []byte{0}
+	for _, o := range obus {
+		if o.obuType == av1OBUTemporalDelim || o.obuType == av1OBUTileList || o.obuType == av1OBUPadding {
+			continue
+		}
+		element := o.data
+		for {
+			space := int(mtu) - len(payload)
+			length := len(element)
+			if length+leb128Length(length) > space {
+				length = space - leb128Length(space)
+			}
+			if length <= 0 {
+				payloads = append(payloads, payload)
+				payload = []byte{0}
+				continue
+			}
+			payload = appendLEB128(payload, length)
+			payload = append(payload, element[:length]...)
+			element = element[length:]
+			if len(element) == 0 {
+				break
+			}
+			payload[0] |= av1AggregationY
+			payloads = append(payloads, payload)
+			payload = []byte{av1AggregationZ}
+		}
+	}
+	if len(payload) > 1 {
+		payloads = append(payloads, payload)
+	}
+	if len(payloads) > 0 && av1IsKeyframe(frame) {
+		payloads[0][0] |= av1AggregationN
+	}
+	return payloads
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+	"sync"
+)
+
+// bandwidthEstimatorSettings bound the send side estimate of one call, in bits per second for everything we send
+type bandwidthEstimatorSettings struct {
+	initialBitrate int
+	minBitrate     int
+	maxBitrate     int
+}
+
+// bandwidthEstimators hands the GCC estimator the congestion control interceptor creates to the peer connection it
+// belongs to. pion builds the interceptors of every peer connection with the same empty id, so estimators can not
+// be told apart by id. They are created synchronously within NewPeerConnection though, so peer connections are
+// created one at a time and each takes the estimator created last
+type bandwidthEstimators struct {
+	mutex    sync.Mutex
+	settings bandwidthEstimatorSettings
+	created  cc.BandwidthEstimator
+}
+
+// registerBandwidthEstimation adds transport wide congestion control to interceptors, see bandwidthEstimators
+func registerBandwidthEstimation(interceptors *interceptor.Registry) (*bandwidthEstimators, error) {
+	estimators := &bandwidthEstimators{}
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		estimator, err := gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(estimators.settings.initialBitrate),
+			gcc.SendSideBWEMinBitrate(estimators.settings.minBitrate),
+			gcc.SendSideBWEMaxBitrate(estimators.settings.maxBitrate),
+			// the encoder keeps to the target on its own, the leaky bucket pacer would only queue without bound when it overshoots
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &twccStreamsEstimator{estimator}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		estimators.created = estimator
+	})
+	interceptors.Add(congestionController)
+	return estimators, nil
+}
+
+// newPeerConnection creates a peer connection of api, which must have been built with the registry passed to
+// registerBandwidthEstimation, together with its estimator
+func (b *bandwidthEstimators) newPeerConnection(
+	api *webrtc.API,
+	configuration webrtc.Configuration,
+	settings bandwidthEstimatorSettings) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.settings = settings
+	b.created = nil
+	peerConnection, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, nil, err
+	}
+	estimator := b.created
+	b.created = nil
+	return peerConnection, estimator, nil
+}
+
+// twccStreamsEstimator leaves out streams the caller did not negotiate transport wide sequence numbers for.
+// GCC fails every packet without one, and there is no feedback to estimate from for them anyway
+type twccStreamsEstimator struct {
+	cc.BandwidthEstimator
+}
+
+func (e *twccStreamsEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == sdp.TransportCCURI {
+			return e.BandwidthEstimator.AddStream(info, writer)
+		}
+	}
+	return writer
+}
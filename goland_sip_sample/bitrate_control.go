@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// the video bitrate follows the target of the GCC congestion controller (draft-ietf-rmcat-gcc-02) for the transport,
+// minus what the audio needs. It is capped by the configured maximum, the b= line of the offer and REMB from the receiver.
+// When the bitrate gets too low for the configured resolution and frame rate, those are lowered in steps
+const (
+	minVideoBitrate          = 100000
+	audioBitrateReserve      = 64000
+	bitrateMinRelativeChange = 0.05
+
+	// below this many bits per pixel of a frame the picture falls apart, resolution and frame rate are lowered instead
+	minVideoBitsPerPixel = 0.03
+	// a better quality is only taken back with this much headroom, so that it does not flap around the threshold
+	videoQualityUpgradeHeadroom = 1.5
+	videoQualityHoldTime        = time.Second * 5
+	// encoders that can not change the bitrate on the fly are recreated for it, no more often than this
+	bitrateRecreateInterval = time.Second * 5
+)
+
+// videoQuality divides the configured resolution and frame rate
+type videoQuality struct {
+	scaleDivisor int
+	fpsDivisor   int
+}
+
+// from best to worst. the frame rate goes first, text stays readable longer that way
+var videoQualityLevels = []videoQuality{
+	{scaleDivisor: 1, fpsDivisor: 1},
+	{scaleDivisor: 1, fpsDivisor: 2},
+	{scaleDivisor: 2, fpsDivisor: 2},
+	{scaleDivisor: 2, fpsDivisor: 4},
+}
+
+// size is rounded down to even dimensions as the encoder requires, and never below a macroblock like the
+// negotiated size
+func (q videoQuality) size(videoConfig VideoConfig) (width int, height int) {
+	return scaledDimension(videoConfig.Width, q.scaleDivisor), scaledDimension(videoConfig.Height, q.scaleDivisor)
+}
+
+func scaledDimension(dimension int, divisor int) int {
+	scaled := (dimension / divisor) &^ 1
+	if scaled < h264MacroblockSize {
+		return h264MacroblockSize
+	}
+	return scaled
+}
+
+func (q videoQuality) fps(videoConfig VideoConfig) int {
+	fps := videoConfig.FPS / q.fpsDivisor
+	if fps < 1 {
+		return 1
+	}
+	return fps
+}
+
+func (q videoQuality) bitsPerPixel(videoConfig VideoConfig, bitrate int) float64 {
+	width, height := q.size(videoConfig)
+	return float64(bitrate) / float64(width*height*q.fps(videoConfig))
+}
+
+type bitrateController struct {
+	mutex       sync.Mutex
+	videoConfig VideoConfig
+	// configured bitrate or the b= line of the offer, whichever is lower. never exceeded
+	maxBitrate int
+	// kept free for the audio out of the congestion controller target, 0 without audio
+	audioReserve int
+	// last REMB, 0 until one arrives
+	estimatedBitrate int
+	// last target of the congestion controller for the whole transport
+	congestionBitrate int
+	targetBitrate     int
+	appliedBitrate    int
+	// index into videoQualityLevels
+	quality          int
+	qualityChangedAt time.Time
+	applyBitrate     func(bitrate int)
+	applyQuality     func(quality int)
+}
+
+func newBitrateController(
+	videoConfig VideoConfig,
+	initialBitrate int,
+	maxBitrate int,
+	audioReserve int,
+	applyBitrate func(bitrate int),
+	applyQuality func(quality int)) *bitrateController {
+	c := &bitrateController{
+		videoConfig:       videoConfig,
+		maxBitrate:        maxBitrate,
+		audioReserve:      audioReserve,
+		congestionBitrate: initialBitrate + audioReserve,
+		applyBitrate:      applyBitrate,
+		applyQuality:      applyQuality,
+	}
+	// the encoder is created with what the controller starts with, nothing to apply yet
+	c.targetBitrate = c.videoTarget()
+	c.appliedBitrate = c.targetBitrate
+	c.quality = c.bestQuality()
+	c.qualityChangedAt = time.Now()
+	return c
+}
+
+// onEstimate takes the bitrate the receiver estimates it can take (REMB)
+func (c *bitrateController) onEstimate(bitrate int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.estimatedBitrate = bitrate
+	c.update()
+}
+
+// onCongestionTarget takes the target bitrate of the congestion controller for everything we send
+func (c *bitrateController) onCongestionTarget(bitrate int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.congestionBitrate = bitrate
+	c.update()
+}
+
+// videoTarget is what the video may use now. must be called under the mutex
+func (c *bitrateController) videoTarget() int {
+	target := c.congestionBitrate - c.audioReserve
+	if target > c.maxBitrate {
+		target = c.maxBitrate
+	}
+	if c.estimatedBitrate > 0 && target > c.estimatedBitrate {
+		target = c.estimatedBitrate
+	}
+	if target < minVideoBitrate {
+		target = minVideoBitrate
+	}
+	return target
+}
+
+// bestQuality is the index of the best quality the target bitrate is enough for. must be called under the mutex
+func (c *bitrateController) bestQuality() int {
+	for i, level := range videoQualityLevels {
+		threshold := minVideoBitsPerPixel
+		if i < c.quality {
+			threshold *= videoQualityUpgradeHeadroom
+		}
+		if level.bitsPerPixel(c.videoConfig, c.targetBitrate) >= threshold {
+			return i
+		}
+	}
+	return len(videoQualityLevels) - 1
+}
+
+// update hands the target to the encoder when it differs enough from what it has, and the quality when it held
+// long enough. must be called under the mutex
+func (c *bitrateController) update() {
+	c.targetBitrate = c.videoTarget()
+
+	if quality := c.bestQuality(); quality != c.quality && time.Since(c.qualityChangedAt) >= videoQualityHoldTime {
+		c.quality = quality
+		c.qualityChangedAt = time.Now()
+		c.applyQuality(quality)
+	}
+
+	change := float64(c.targetBitrate-c.appliedBitrate) / float64(c.appliedBitrate)
+	if change < bitrateMinRelativeChange && change > -bitrateMinRelativeChange {
+		return
+	}
+	c.appliedBitrate = c.targetBitrate
+	c.applyBitrate(c.targetBitrate)
+}
+
+func (c *bitrateController) bitrates() (estimated int, target int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.estimatedBitrate, c.targetBitrate
+}
+
+// encoderSettings is what the encoder was last given, for when it has to be created anew
+func (c *bitrateController) encoderSettings() (bitrate int, quality int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.appliedBitrate, c.quality
+}
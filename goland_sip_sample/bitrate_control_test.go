@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVideoQualitySize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		quality       videoQuality
+		wantW, wantH  int
+	}{
+		{1280, 720, videoQuality{scaleDivisor: 1, fpsDivisor: 1}, 1280, 720},
+		{1280, 720, videoQuality{scaleDivisor: 2, fpsDivisor: 2}, 640, 360},
+		{642, 362, videoQuality{scaleDivisor: 2, fpsDivisor: 2}, 320, 180},
+		// the smallest negotiated size is a macroblock, halving it must not leave nothing for the encoder
+		{16, 16, videoQuality{scaleDivisor: 2, fpsDivisor: 4}, 16, 16},
+		{18, 30, videoQuality{scaleDivisor: 2, fpsDivisor: 4}, 16, 16},
+		{1, 1, videoQuality{scaleDivisor: 2, fpsDivisor: 4}, 16, 16},
+	}
+	for _, test := range tests {
+		width, height := test.quality.size(VideoConfig{Width: test.width, Height: test.height})
+		if width != test.wantW || height != test.wantH {
+			t.Errorf("%dx%d divided by %d is %dx%d, want %dx%d", test.width, test.height, test.quality.scaleDivisor,
+				width, height, test.wantW, test.wantH)
+		}
+	}
+}
+
+func TestVideoQualityFPS(t *testing.T) {
+	if fps := (videoQuality{scaleDivisor: 2, fpsDivisor: 4}).fps(VideoConfig{FPS: 2}); fps != 1 {
+		t.Errorf("2 fps divided by 4 is %d, want 1", fps)
+	}
+}
+
+// recordingBitrateController remembers what the controller applies
+type recordingBitrateController struct {
+	*bitrateController
+	applied   []int
+	qualities []int
+}
+
+func newTestBitrateController(initialBitrate int, maxBitrate int) *recordingBitrateController {
+	r := &recordingBitrateController{}
+	r.bitrateController = newBitrateController(
+		VideoConfig{Width: 1280, Height: 720, FPS: 10},
+		initialBitrate,
+		maxBitrate,
+		audioBitrateReserve,
+		func(bitrate int) { r.applied = append(r.applied, bitrate) },
+		func(quality int) { r.qualities = append(r.qualities, quality) },
+	)
+	return r
+}
+
+// holdElapsed lets the next update change the quality
+func (r *recordingBitrateController) holdElapsed() {
+	r.qualityChangedAt = time.Now().Add(-videoQualityHoldTime)
+}
+
+func (r *recordingBitrateController) lastBitrate() int {
+	if len(r.applied) == 0 {
+		return 0
+	}
+	return r.applied[len(r.applied)-1]
+}
+
+func TestBitrateControllerFollowsCongestionTarget(t *testing.T) {
+	c := newTestBitrateController(1000000, 2000000)
+	if bitrate, quality := c.encoderSettings(); bitrate != 1000000 || quality != 0 {
+		t.Fatalf("starts at %d bit/s and quality %d, want 1000000 and 0", bitrate, quality)
+	}
+
+	// the congestion controller targets the whole transport, the audio keeps its share
+	c.onCongestionTarget(1500000 + audioBitrateReserve)
+	if c.lastBitrate() != 1500000 {
+		t.Errorf("applied %v, want 1500000 last", c.applied)
+	}
+	c.onCongestionTarget(1520000 + audioBitrateReserve)
+	if len(c.applied) != 1 {
+		t.Errorf("a change of less than 5%% was applied: %v", c.applied)
+	}
+	c.onCongestionTarget(5000000)
+	if c.lastBitrate() != 2000000 {
+		t.Errorf("applied %v, want the maximum of 2000000 last", c.applied)
+	}
+	c.onCongestionTarget(0)
+	if c.lastBitrate() != minVideoBitrate {
+		t.Errorf("applied %v, want the minimum of %d last", c.applied, minVideoBitrate)
+	}
+}
+
+func TestBitrateControllerCappedByEstimate(t *testing.T) {
+	c := newTestBitrateController(1000000, 2000000)
+	c.onEstimate(500000)
+	c.onCongestionTarget(1800000)
+	if estimated, target := c.bitrates(); estimated != 500000 || target != 500000 {
+		t.Errorf("REMB of 500000 gives estimated %d and target %d", estimated, target)
+	}
+	if c.lastBitrate() != 500000 {
+		t.Errorf("applied %v, want 500000 last", c.applied)
+	}
+}
+
+func TestBitrateControllerStepsQuality(t *testing.T) {
+	c := newTestBitrateController(1000000, 2000000)
+
+	// 200 kbit/s is too little for 1280x720 at 10 fps, enough at 5 fps. not before the quality held long enough
+	c.onCongestionTarget(200000 + audioBitrateReserve)
+	if len(c.qualities) != 0 {
+		t.Fatalf("quality changed to %v within the hold time", c.qualities)
+	}
+	c.holdElapsed()
+	c.onCongestionTarget(200000 + audioBitrateReserve)
+	if len(c.qualities) != 1 || c.qualities[0] != 1 {
+		t.Fatalf("qualities %v, want 1", c.qualities)
+	}
+
+	// enough for the best quality, but not with the headroom to take it back
+	c.holdElapsed()
+	c.onCongestionTarget(300000 + audioBitrateReserve)
+	if len(c.qualities) != 1 {
+		t.Errorf("quality went back to %v without headroom", c.qualities)
+	}
+	c.holdElapsed()
+	c.onCongestionTarget(500000 + audioBitrateReserve)
+	if len(c.qualities) != 2 || c.qualities[1] != 0 {
+		t.Errorf("qualities %v, want 1 and then 0", c.qualities)
+	}
+
+	// the minimum bitrate is enough for half the size
+	c.holdElapsed()
+	c.onCongestionTarget(0)
+	if _, quality := c.encoderSettings(); quality != 2 {
+		t.Errorf("quality %d at the minimum bitrate, want 2", quality)
+	}
+}
@@ -1,28 +1,21 @@
 package main
 
-// #cgo CFLAGS: -g -w
-// #include <stdlib.h>
-// #include <stdio.h>
-// #include <libavcodec/avcodec.h>
-//
-import "C"
-
 import (
 	//"github.com/ghettovoice/gosip"
 	//"github.com/ghettovoice/gosip/sip"
 	//"os"
 	//"os/signal"
 	//"syscall"
-	"github.com/ghettovoice/gosip"
-	"github.com/ghettovoice/gosip/sip"
 	"github.com/golang/freetype/truetype"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/basicfont"
 	"golang.org/x/image/math/fixed"
+	"errors"
+	"flag"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
-	"unsafe"
 
 	//"image"
 	//"image/color"
@@ -36,7 +29,7 @@ import (
 )
 
 func addLabel(vmr *VoiceMenuResources, img *image.RGBA, x, y int, label string, col color.Color) {
-	point := fixed.Point26_6{fixed.I(x), fixed.I(y)}
+	point := fixed.Point26_6{X: fixed.I(x), Y: fixed.I(y)}
 
 	var face font.Face
 	if vmr != nil {
@@ -60,10 +53,13 @@ func addLabel(vmr *VoiceMenuResources, img *image.RGBA, x, y int, label string,
 
 func main1() {
 
-	f := C.fopen(C.CString("result.mpeg"), C.CString("w"))
-	defer C.fclose(f)
+	f, err := os.Create("result.mpeg")
+	if err != nil {
+		log.Panicf("Unable to create output: %q", err)
+	}
+	defer f.Close()
 
-	e, err := NewEncoder(CODEC_ID_H264, image.NewRGBA(image.Rect(0,0,1280,720)), 30)
+	e, err := NewVideoEncoder(CODEC_ID_H264, image.NewRGBA(image.Rect(0,0,1280,720)), EncoderSettings{Width: 1280, Height: 720, FPS: 30, Bitrate: defaultVideoBitrate, GOPSize: keyframeIntervalFrames(defaultVideoKeyframeInterval, 30)}, logger)
 	defer e.Close()
 
 	if err != nil {
@@ -72,9 +68,6 @@ func main1() {
 
 	start := time.Now()
 
-	avPacket, freePacket := e.allocPacket()
-	defer freePacket()
-
 	for i := 0; i < 30*5; i++ {
 		//c := color.RGBA{0, 0, uint8(i % 255), 255}
 		// uint8(i%255), uint8(i%255), 255}
@@ -82,54 +75,93 @@ func main1() {
 
 		myred := color.RGBA{200, 0, 0, 100}
 		myBlack := color.RGBA{0, 0, 0, 100}
-		draw.Draw(e.inputImage, image.Rect(0, 0, e.inputImage.Rect.Max.X, e.inputImage.Rect.Max.Y), &image.Uniform{myBlack}, image.Point{}, draw.Src)
-		draw.Draw(e.inputImage, image.Rect(60+i, 80, 120+i, 160), &image.Uniform{myred}, image.Point{}, draw.Src)
+		inputImage := e.InputImage()
+		draw.Draw(inputImage, image.Rect(0, 0, inputImage.Rect.Max.X, inputImage.Rect.Max.Y), &image.Uniform{myBlack}, image.Point{}, draw.Src)
+		draw.Draw(inputImage, image.Rect(60+i, 80, 120+i, 160), &image.Uniform{myred}, image.Point{}, draw.Src)
 
-		addLabel(nil, e.inputImage, 400 + i, 500, "heyhey", RGBA_COLOR_ORANGE)
+		addLabel(nil, inputImage, 400 + i, 500, "heyhey", RGBA_COLOR_ORANGE)
 
-		e.initPacket(avPacket, i)
-		err, outSize := e.WriteFrame(avPacket)
-		packet := (*C.AVPacket)(avPacket)
-		if outSize >= 0 {
-			C.fwrite(unsafe.Pointer(packet.data), C.ulong(packet.size), 1, f)
+		frame, err := e.EncodeFrame(i)
+		if err == nil {
+			_, err = f.Write(frame)
 		}
-		//f.Write()
 		if err != nil {
 			log.Panicf("Problem writing frame: %q", err)
 		}
 	}
 
+	frames, err := e.Flush()
+	if err != nil {
+		log.Panicf("Problem flushing encoder: %q", err)
+	}
+	for _, frame := range frames {
+		if _, err := f.Write(frame); err != nil {
+			log.Panicf("Problem writing frame: %q", err)
+		}
+	}
+
 	log.Printf("Took %s", time.Since(start))
 }
 
 func main() {
-	err := os.Setenv("PION_LOG_", "all")
+	config, printConfig, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	if printConfig {
+		if err = config.Print(os.Stdout); err != nil {
+			panic(err)
+		}
+		return
+	}
+	configureLogging(config.Logging)
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
-	go setupHttpServer()
+	initVideoEncoder()
 
-	srvConf := gosip.ServerConfig{}
-	srv := gosip.NewServer(srvConf, nil, nil, logger)
+	serverContext, err := NewServerContext(config, os.Args[1:])
+	if err != nil {
+		panic(err)
+	}
+	defer serverContext.Close()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			logger.Info("SIGHUP received. Reloading configuration and resources")
+			if err := serverContext.Reload(); err != nil {
+				logger.Errorf("Reload failed, keeping the previous configuration: %s", err)
+			}
+		}
+	}()
 
-	if srv.OnRequest(sip.INVITE, onInvite) != nil {
-		panic("Failed to register invite handler")
+	serverContext.setupHttpServer(config.HTTP)
+	if config.Admin.ListenAddress != "" {
+		serverContext.setupAdminServer(config.Admin.ListenAddress)
 	}
-	//err = srv.Listen("ws", "0.0.0.0:5080", nil)
-	//if err != nil { panic(err) }
-	//srv.Listen("wss", "0.0.0.0:5081", &transport.TLSConfig{Cert: "certs/cert.pem", Key: "certs/key.pem"})
-	err = srv.Listen("udp", "0.0.0.0:5060", nil)
+
+	err = serverContext.setupSIPServer(config.SIP)
 	if err != nil {
 		panic(err)
 	}
 
 	logger.Info("SIP server Started")
 
-	<-stop
+	sig := <-stop
+	logger.Infof("%s received. Draining calls", sig)
+	go func() {
+		// a second signal skips the drain
+		<-stop
+		logger.Warn("Second signal received. Exiting without waiting for calls")
+		os.Exit(1)
+	}()
 
-	srv.Shutdown()
+	serverContext.Shutdown(serverContext.currentState().config.Shutdown.DrainTimeout)
 }
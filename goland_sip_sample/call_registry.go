@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ghettovoice/gosip/log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const callRegistryPollInterval = time.Millisecond * 100
+
+type ActiveCall struct {
+	// SIP Call-ID, or a generated one for calls from the web client
+	id         string
+	remoteAddr string
+	startedAt  time.Time
+	vmi        *VoiceMenuInstance
+	// nil for calls from the web client
+	dialog *sipDialog
+	log    log.Logger
+}
+
+// CallRegistry knows every call in progress, so that they can be found by Call-ID and hung up on shutdown
+type CallRegistry struct {
+	mutex        sync.Mutex
+	calls        map[string]*ActiveCall
+	webCallSeqNo atomic.Uint64
+}
+
+func NewCallRegistry() *CallRegistry {
+	return &CallRegistry{
+		calls: make(map[string]*ActiveCall),
+	}
+}
+
+func (cr *CallRegistry) newWebCallID() string {
+	return fmt.Sprintf("web-%d-%d", time.Now().Unix(), cr.webCallSeqNo.Add(1))
+}
+
+// Add registers the call until its voice menu instance is closed
+func (cr *CallRegistry) Add(call *ActiveCall) {
+	cr.mutex.Lock()
+	cr.calls[call.id] = call
+	cr.mutex.Unlock()
+	activeCalls.Inc()
+
+	call.vmi.OnClose(func() {
+		cr.remove(call)
+	})
+}
+
+func (cr *CallRegistry) remove(call *ActiveCall) {
+	activeCalls.Dec()
+	callDurationSeconds.Observe(time.Since(call.startedAt).Seconds())
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	// a retransmitted INVITE may have replaced the entry
+	if cr.calls[call.id] == call {
+		delete(cr.calls, call.id)
+	}
+}
+
+func (cr *CallRegistry) Get(id string) *ActiveCall {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.calls[id]
+}
+
+func (cr *CallRegistry) Snapshot() []*ActiveCall {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	result := make([]*ActiveCall, 0, len(cr.calls))
+	for _, call := range cr.calls {
+		result = append(result, call)
+	}
+	return result
+}
+
+// Stats reports every call in progress, oldest first
+func (cr *CallRegistry) Stats() []CallStats {
+	calls := cr.Snapshot()
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].startedAt.Before(calls[j].startedAt)
+	})
+
+	result := make([]CallStats, 0, len(calls))
+	for _, call := range calls {
+		stats := call.vmi.Stats()
+		stats.ID = call.id
+		stats.RemoteAddr = call.remoteAddr
+		stats.StartedAt = call.startedAt
+		result = append(result, stats)
+	}
+	return result
+}
+
+func (cr *CallRegistry) Len() int {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return len(cr.calls)
+}
+
+// WaitEmpty blocks until every call has ended or ctx is done
+func (cr *CallRegistry) WaitEmpty(ctx context.Context) error {
+	ticker := time.NewTicker(callRegistryPollInterval)
+	defer ticker.Stop()
+	for cr.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pion/logging"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration is resolved in this order, later sources win:
+// built in defaults, the YAML file passed with -config (or SAMPLE_CONFIG), SAMPLE_* environment variables, command line flags.
+// Every field that can be overridden from the environment or the command line names the variable and the flag in its tags
+const (
+	configFileEnv                = "SAMPLE_CONFIG"
+	defaultSIPTransport          = "udp"
+	defaultSIPListen             = "0.0.0.0:5060"
+	defaultHTTPListen            = ":8885"
+	defaultHTTPStaticDir         = "./httpStatic"
+	defaultAdminListen           = "127.0.0.1:8886"
+	defaultVideoWidth            = 1280
+	defaultVideoHeight           = 720
+	defaultVideoFPS              = 10
+	defaultVideoBitrate          = 10485760 //10 MBit
+	defaultVideoInitialBitrate   = 1000000
+	defaultVideoKeyframeInterval = time.Second * 2
+	defaultAudioBitrate          = 48000
+	defaultAudioMusicLevel       = -18
+	defaultComfortNoiseLevel     = -70
+	defaultAudioCrossfade        = time.Millisecond * 200
+	defaultTTSCommand            = "espeak-ng -v {voice} -w {output} --stdin"
+	defaultTTSVoice              = "en-us"
+	defaultTTSTimeout            = time.Second * 10
+	defaultTTSCacheSize          = 64
+	defaultSessionTimeout        = time.Minute * 2
+	defaultDrainTimeout          = time.Second * 30
+	defaultLogLevel              = "info"
+	defaultLogFormat             = logFormatText
+	defaultPionLogLevel          = "warn"
+)
+
+type Config struct {
+	SIP          SIPConfig          `yaml:"sip"`
+	HTTP         HTTPConfig         `yaml:"http"`
+	Admin        AdminConfig        `yaml:"admin"`
+	ICE          ICEConfig          `yaml:"ice"`
+	Admission    AdmissionConfig    `yaml:"admission"`
+	Resources    ResourcesConfig    `yaml:"resources"`
+	Video        VideoConfig        `yaml:"video"`
+	Audio        AudioConfig        `yaml:"audio"`
+	TTS          TTSConfig          `yaml:"tts"`
+	Session      SessionConfig      `yaml:"session"`
+	Shutdown     ShutdownConfig     `yaml:"shutdown"`
+	Logging      LoggingConfig      `yaml:"logging"`
+	PlayFromDisk PlayFromDiskConfig `yaml:"playFromDisk"`
+}
+
+type SIPConfig struct {
+	Transport     string `yaml:"transport" env:"SAMPLE_SIP_TRANSPORT" flag:"sip-transport" usage:"SIP transport: udp, tcp or ws"`
+	ListenAddress string `yaml:"listenAddress" env:"SAMPLE_SIP_LISTEN" flag:"sip-listen" usage:"SIP listen address"`
+}
+
+type HTTPConfig struct {
+	ListenAddress string `yaml:"listenAddress" env:"SAMPLE_HTTP_LISTEN" flag:"http-listen" usage:"HTTP listen address for the web client and /offer"`
+	StaticDir     string `yaml:"staticDir" env:"SAMPLE_HTTP_STATIC_DIR" flag:"http-static-dir" usage:"directory served as the web client"`
+}
+
+// admin endpoints must not be reachable by callers, so they get their own listener
+type AdminConfig struct {
+	ListenAddress string `yaml:"listenAddress" env:"SAMPLE_ADMIN_LISTEN" flag:"admin-listen" usage:"listen address for admin endpoints like /admin/reload, empty to disable"`
+}
+
+type ICEConfig struct {
+	StunServer string `yaml:"stunServer" env:"SAMPLE_STUN_SERVER" flag:"stun-server" usage:"STUN server URL, e.g. stun:stun.l.google.com:19302"`
+	UDPMuxPort int    `yaml:"udpMuxPort" env:"SAMPLE_ICE_UDP_MUX_PORT" flag:"ice-udp-mux-port" usage:"UDP port shared by all calls, 0 to use the port range"`
+	UDPPortMin int    `yaml:"udpPortMin" env:"SAMPLE_ICE_UDP_PORT_MIN" flag:"ice-udp-port-min" usage:"lowest ephemeral ICE port when the mux is disabled"`
+	UDPPortMax int    `yaml:"udpPortMax" env:"SAMPLE_ICE_UDP_PORT_MAX" flag:"ice-udp-port-max" usage:"highest ephemeral ICE port when the mux is disabled"`
+}
+
+type AdmissionConfig struct {
+	MaxCalls                 int           `yaml:"maxCalls" env:"SAMPLE_MAX_CALLS" flag:"max-calls" usage:"concurrent calls limit, 0 for unlimited"`
+	MaxCallsPerIP            int           `yaml:"maxCallsPerIP" env:"SAMPLE_MAX_CALLS_PER_IP" flag:"max-calls-per-ip" usage:"concurrent calls limit per source IP, 0 for unlimited"`
+	MaxInvitesPerSecond      int           `yaml:"maxInvitesPerSecond" env:"SAMPLE_MAX_INVITES_PER_SECOND" flag:"max-invites-per-second" usage:"new calls per second, 0 for unlimited"`
+	MaxInvitesPerSecondPerIP int           `yaml:"maxInvitesPerSecondPerIP" env:"SAMPLE_MAX_INVITES_PER_SECOND_PER_IP" flag:"max-invites-per-second-per-ip" usage:"new calls per second per source IP, 0 for unlimited"`
+	RetryAfter               time.Duration `yaml:"retryAfter" env:"SAMPLE_ADMISSION_RETRY_AFTER" flag:"admission-retry-after" usage:"Retry-After suggested when the call limits are hit"`
+}
+
+type ResourcesConfig struct {
+	GreetingAudio     string `yaml:"greetingAudio" env:"SAMPLE_GREETING_AUDIO" flag:"greeting-audio" usage:"Ogg/Opus greeting prompt"`
+	DTMFAudio         string `yaml:"dtmfAudio" env:"SAMPLE_DTMF_AUDIO" flag:"dtmf-audio" usage:"Ogg/Opus DTMF prompt"`
+	DurationWarnAudio string `yaml:"durationWarnAudio" env:"SAMPLE_DURATION_WARN_AUDIO" flag:"duration-warn-audio" usage:"Ogg/Opus call duration warning prompt"`
+	Font              string `yaml:"font" env:"SAMPLE_FONT" flag:"font" usage:"TrueType font used in the video menu"`
+	GoodbyeAudio      string `yaml:"goodbyeAudio" env:"SAMPLE_GOODBYE_AUDIO" flag:"goodbye-audio" usage:"Ogg/Opus prompt played to callers on shutdown, empty for none"`
+	// more TrueType fonts by the name video scenes use them by, e.g. arabic: ./resources/NotoSansArabic.ttf.
+	// text also takes the characters its font lacks from them. file only
+	Fonts map[string]string `yaml:"fonts"`
+	// PNG, JPEG, GIF or animated PNG files by the name video scenes use them by, e.g. logo: ./resources/logo.png.
+	// file only
+	Images map[string]string `yaml:"images"`
+	// encoded video prompts by name, a file for each codec calls may use: IVF with VP8, VP9 or AV1, H.264 Annex B
+	// or MP4 with H.264, e.g. welcome: [./resources/welcome.ivf, ./resources/welcome.h264]. file only
+	VideoClips    map[string][]string `yaml:"videoClips"`
+	GreetingVideo string              `yaml:"greetingVideo" env:"SAMPLE_GREETING_VIDEO" flag:"greeting-video" usage:"name of a video clip of resources.videoClips played when a call starts, empty for none"`
+	// decoded as a whole, a few minutes take tens of megabytes
+	BackgroundMusic string `yaml:"backgroundMusic" env:"SAMPLE_BACKGROUND_MUSIC" flag:"background-music" usage:"Ogg/Opus file looped under the prompts when audio is mixed, empty for none"`
+	// more Ogg/Opus prompts by the name PlayPrompt plays them by, e.g. thanks: ./resources/thanks.ogg. greeting,
+	// dtmf, durationWarn and goodbye are taken. file only
+	Prompts map[string]string `yaml:"prompts"`
+}
+
+type VideoConfig struct {
+	Width   int `yaml:"width" env:"SAMPLE_VIDEO_WIDTH" flag:"video-width" usage:"video width in pixels, even"`
+	Height  int `yaml:"height" env:"SAMPLE_VIDEO_HEIGHT" flag:"video-height" usage:"video height in pixels, even"`
+	FPS     int `yaml:"fps" env:"SAMPLE_VIDEO_FPS" flag:"video-fps" usage:"video frames per second"`
+	Bitrate int `yaml:"bitrate" env:"SAMPLE_VIDEO_BITRATE" flag:"video-bitrate" usage:"maximum video encoder bitrate in bits per second"`
+	// the congestion controller starts from here unless the offer has a lower b= line for the video
+	InitialBitrate int `yaml:"initialBitrate" env:"SAMPLE_VIDEO_INITIAL_BITRATE" flag:"video-initial-bitrate" usage:"video bitrate in bits per second a call starts with"`
+	// converted to a GOP length at the frame rate of the call
+	KeyframeInterval time.Duration `yaml:"keyframeInterval" env:"SAMPLE_VIDEO_KEYFRAME_INTERVAL" flag:"video-keyframe-interval" usage:"time between periodic keyframes, callers get one in between on PLI or FIR"`
+	// calls that negotiate the same video share one encoder, see video_broadcast.go
+	Broadcast bool `yaml:"broadcast" env:"SAMPLE_VIDEO_BROADCAST" flag:"video-broadcast" usage:"encode the video once for all calls with the same codec, size and frame rate instead of once per call"`
+}
+
+// see audio_mixer.go and audio_tones.go
+type AudioConfig struct {
+	// without it, and always with -tags stubencoder, the prompts are sent as they are stored, and there is
+	// neither music nor tones
+	Mix               bool          `yaml:"mix" env:"SAMPLE_AUDIO_MIX" flag:"audio-mix" usage:"mix prompts, background music and tones, and encode the mix with libopus"`
+	Bitrate           int           `yaml:"bitrate" env:"SAMPLE_AUDIO_BITRATE" flag:"audio-bitrate" usage:"Opus bitrate of mixed audio in bits per second"`
+	MusicLevel        int           `yaml:"musicLevel" env:"SAMPLE_AUDIO_MUSIC_LEVEL" flag:"audio-music-level" usage:"gain of the background music in dB, it is 12 dB lower while a prompt plays"`
+	ComfortNoiseLevel int           `yaml:"comfortNoiseLevel" env:"SAMPLE_AUDIO_COMFORT_NOISE_LEVEL" flag:"audio-comfort-noise-level" usage:"level of the noise under everything in dBFS, 0 for none"`
+	Crossfade         time.Duration `yaml:"crossfade" env:"SAMPLE_AUDIO_CROSSFADE" flag:"audio-crossfade" usage:"how long a prompt fades into the next one and music is ducked, 0 to cut"`
+	Country           string        `yaml:"country" env:"SAMPLE_AUDIO_COUNTRY" flag:"audio-country" usage:"call progress tones as in this country: de, fr, jp, uk or us"`
+	// tones added to those of the country or replacing them, written like in Asterisk's indications.conf,
+	// e.g. ringback: 425/1000,0/4000. beep is played on every DTMF digit, an empty tone removes it. file only
+	Tones map[string]string `yaml:"tones"`
+}
+
+// see tts_prompts.go
+type TTSConfig struct {
+	// {text}, {voice} and {output} are replaced, without {text} the text goes to the standard input. piper for
+	// example: piper --model {voice} --output_file {output}
+	Command   string        `yaml:"command" env:"SAMPLE_TTS_COMMAND" flag:"tts-command" usage:"speech engine that writes a 16 bit WAV file to {output}, empty to speak no text"`
+	Voice     string        `yaml:"voice" env:"SAMPLE_TTS_VOICE" flag:"tts-voice" usage:"voice text is spoken in unless the menu asks for another, passed to the engine as {voice}"`
+	Timeout   time.Duration `yaml:"timeout" env:"SAMPLE_TTS_TIMEOUT" flag:"tts-timeout" usage:"the engine is stopped after this long"`
+	CacheSize int           `yaml:"cacheSize" env:"SAMPLE_TTS_CACHE_SIZE" flag:"tts-cache-size" usage:"megabytes of spoken text kept for all calls, 0 keeps none"`
+}
+
+type SessionConfig struct {
+	Timeout time.Duration `yaml:"timeout" env:"SAMPLE_SESSION_TIMEOUT" flag:"session-timeout" usage:"calls are hung up after this long"`
+}
+
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `yaml:"drainTimeout" env:"SAMPLE_SHUTDOWN_DRAIN_TIMEOUT" flag:"shutdown-drain-timeout" usage:"how long calls may take to hang up on SIGTERM before they are cut"`
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level" env:"SAMPLE_LOG_LEVEL" flag:"log-level" usage:"server log level: trace, debug, info, warn, error"`
+	Format string `yaml:"format" env:"SAMPLE_LOG_FORMAT" flag:"log-format" usage:"log format: text or json"`
+	// pion logs go through the server log, so they are also subject to its level
+	PionLevel string `yaml:"pionLevel" env:"SAMPLE_PION_LOG_LEVEL" flag:"pion-log-level" usage:"default pion log level: disabled, error, warn, info, debug, trace"`
+	// per pion scope, e.g. ice: debug. file only
+	PionScopeLevels map[string]string `yaml:"pionScopeLevels"`
+}
+
+// files for the play-from-disk sample, see play_from_disk.go
+type PlayFromDiskConfig struct {
+	AudioFile string `yaml:"audioFile" env:"SAMPLE_PLAY_FROM_DISK_AUDIO" flag:"play-from-disk-audio" usage:"Ogg/Opus file for the play-from-disk sample"`
+	VideoFile string `yaml:"videoFile" env:"SAMPLE_PLAY_FROM_DISK_VIDEO" flag:"play-from-disk-video" usage:"IVF file for the play-from-disk sample"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		SIP: SIPConfig{
+			Transport:     defaultSIPTransport,
+			ListenAddress: defaultSIPListen,
+		},
+		HTTP: HTTPConfig{
+			ListenAddress: defaultHTTPListen,
+			StaticDir:     defaultHTTPStaticDir,
+		},
+		Admin: AdminConfig{
+			ListenAddress: defaultAdminListen,
+		},
+		ICE: ICEConfig{
+			UDPMuxPort: defaultICEUDPMuxPort,
+			UDPPortMin: defaultICEUDPPortMin,
+			UDPPortMax: defaultICEUDPPortMax,
+		},
+		Admission: AdmissionConfig{
+			MaxCalls:                 defaultMaxConcurrentCalls,
+			MaxCallsPerIP:            defaultMaxConcurrentCallsPerIP,
+			MaxInvitesPerSecond:      defaultMaxInvitesPerSecond,
+			MaxInvitesPerSecondPerIP: defaultMaxInvitesPerSecondPerIP,
+			RetryAfter:               defaultAdmissionRetryAfter,
+		},
+		Resources: ResourcesConfig{
+			GreetingAudio:     greetingAudioFileName,
+			DTMFAudio:         dtmfAudioFileName,
+			DurationWarnAudio: durationWarnAudioFileName,
+			Font:              fontFile,
+		},
+		Video: VideoConfig{
+			Width:            defaultVideoWidth,
+			Height:           defaultVideoHeight,
+			FPS:              defaultVideoFPS,
+			Bitrate:          defaultVideoBitrate,
+			InitialBitrate:   defaultVideoInitialBitrate,
+			KeyframeInterval: defaultVideoKeyframeInterval,
+		},
+		Audio: AudioConfig{
+			Mix:               true,
+			Bitrate:           defaultAudioBitrate,
+			MusicLevel:        defaultAudioMusicLevel,
+			ComfortNoiseLevel: defaultComfortNoiseLevel,
+			Crossfade:         defaultAudioCrossfade,
+			Country:           defaultAudioCountry,
+		},
+		TTS: TTSConfig{
+			Command:   defaultTTSCommand,
+			Voice:     defaultTTSVoice,
+			Timeout:   defaultTTSTimeout,
+			CacheSize: defaultTTSCacheSize,
+		},
+		Session: SessionConfig{
+			Timeout: defaultSessionTimeout,
+		},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: defaultDrainTimeout,
+		},
+		Logging: LoggingConfig{
+			Level:     defaultLogLevel,
+			Format:    defaultLogFormat,
+			PionLevel: defaultPionLogLevel,
+			PionScopeLevels: map[string]string{
+				"ice": "warn",
+			},
+		},
+		PlayFromDisk: PlayFromDiskConfig{
+			AudioFile: audioFileName,
+			VideoFile: videoFileName,
+		},
+	}
+}
+
+// configField is a leaf of Config that can be set from a string
+type configField struct {
+	path  string
+	value reflect.Value
+	env   string
+	flag  string
+	usage string
+}
+
+func collectConfigFields(v reflect.Value, prefix string, result []configField) []configField {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if field.Type.Kind() == reflect.Struct {
+			result = collectConfigFields(v.Field(i), name, result)
+			continue
+		}
+		result = append(result, configField{
+			path:  name,
+			value: v.Field(i),
+			env:   field.Tag.Get("env"),
+			flag:  field.Tag.Get("flag"),
+			usage: field.Tag.Get("usage"),
+		})
+	}
+	return result
+}
+
+func (f configField) set(str string) error {
+	switch {
+	case f.value.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a duration like 30s or 2m", f.path, str)
+		}
+		f.value.SetInt(int64(d))
+	case f.value.Kind() == reflect.Int:
+		i, err := strconv.Atoi(str)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", f.path, str)
+		}
+		f.value.SetInt(int64(i))
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(str)
+	case f.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", f.path, str)
+		}
+		f.value.SetBool(b)
+	default:
+		return fmt.Errorf("%s can only be set in the config file", f.path)
+	}
+	return nil
+}
+
+type pendingFlag struct {
+	field configField
+	value string
+}
+
+// LoadConfig resolves the configuration from args (without the program name), the environment and the config file.
+// printConfig is true when the effective configuration should be printed instead of starting the server
+func LoadConfig(args []string) (cfg *Config, printConfig bool, err error) {
+	cfg = DefaultConfig()
+	fields := collectConfigFields(reflect.ValueOf(cfg).Elem(), "", nil)
+
+	flags := flag.NewFlagSet("goland_sip_sample", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv(configFileEnv), "YAML config file, also "+configFileEnv)
+	flags.BoolVar(&printConfig, "print-config", false, "print the effective configuration as YAML and exit")
+
+	// flags are applied after the file and the environment, so only remember them while parsing
+	var pendingFlags []pendingFlag
+	for _, field := range fields {
+		if field.flag == "" {
+			continue
+		}
+		field := field
+		usage := field.usage
+		if field.env != "" {
+			usage += ", also " + field.env
+		}
+		remember := func(value string) error {
+			pendingFlags = append(pendingFlags, pendingFlag{field, value})
+			return nil
+		}
+		// -flag alone sets a bool flag, like the flag package does
+		if field.value.Kind() == reflect.Bool {
+			flags.BoolFunc(field.flag, usage, remember)
+		} else {
+			flags.Func(field.flag, usage, remember)
+		}
+	}
+	if err = flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	if *configPath != "" {
+		if err = cfg.readFile(*configPath); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, field := range fields {
+		if field.env == "" {
+			continue
+		}
+		if value, present := os.LookupEnv(field.env); present {
+			if err = field.set(value); err != nil {
+				return nil, false, fmt.Errorf("environment variable %s: %w", field.env, err)
+			}
+		}
+	}
+
+	for _, pending := range pendingFlags {
+		if err = pending.field.set(pending.value); err != nil {
+			return nil, false, fmt.Errorf("flag -%s: %w", pending.field.flag, err)
+		}
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, false, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, printConfig, nil
+}
+
+func (c *Config) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	// typos in the config should not be silently ignored
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func parsePionLogLevel(level string) (logging.LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "disabled":
+		return logging.LogLevelDisabled, nil
+	case "error":
+		return logging.LogLevelError, nil
+	case "warn", "warning":
+		return logging.LogLevelWarn, nil
+	case "info":
+		return logging.LogLevelInfo, nil
+	case "debug":
+		return logging.LogLevelDebug, nil
+	case "trace":
+		return logging.LogLevelTrace, nil
+	}
+	return logging.LogLevelDisabled, fmt.Errorf("unknown pion log level %q, expected one of disabled, error, warn, info, debug, trace", level)
+}
+
+func validateListenAddress(path string, address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("%s: %q is not a host:port address", path, address)
+	}
+	return nil
+}
+
+func validatePort(path string, port int) error {
+	if port < 0 || port > 0xFFFF {
+		return fmt.Errorf("%s: %d is not a valid port", path, port)
+	}
+	return nil
+}
+
+func validateFileExists(path string, fileName string) error {
+	if _, err := os.Stat(fileName); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func validateNotNegative(path string, value int) error {
+	if value < 0 {
+		return fmt.Errorf("%s: must not be negative, got %d", path, value)
+	}
+	return nil
+}
+
+// Validate reports every problem in the configuration at once
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch c.SIP.Transport {
+	case "udp", "tcp", "ws":
+	default:
+		add(fmt.Errorf("sip.transport: %q is not supported, expected udp, tcp or ws", c.SIP.Transport))
+	}
+	add(validateListenAddress("sip.listenAddress", c.SIP.ListenAddress))
+	add(validateListenAddress("http.listenAddress", c.HTTP.ListenAddress))
+	if c.Admin.ListenAddress != "" {
+		add(validateListenAddress("admin.listenAddress", c.Admin.ListenAddress))
+	}
+
+	add(validatePort("ice.udpMuxPort", c.ICE.UDPMuxPort))
+	if c.ICE.UDPMuxPort == 0 {
+		add(validatePort("ice.udpPortMin", c.ICE.UDPPortMin))
+		add(validatePort("ice.udpPortMax", c.ICE.UDPPortMax))
+		if c.ICE.UDPPortMin == 0 || c.ICE.UDPPortMin > c.ICE.UDPPortMax {
+			add(fmt.Errorf("ice: port range %d-%d is empty, set ice.udpPortMin and ice.udpPortMax or enable ice.udpMuxPort",
+				c.ICE.UDPPortMin, c.ICE.UDPPortMax))
+		}
+	}
+	if c.ICE.StunServer != "" && !strings.HasPrefix(c.ICE.StunServer, "stun:") {
+		add(fmt.Errorf("ice.stunServer: %q must start with stun:", c.ICE.StunServer))
+	}
+
+	add(validateNotNegative("admission.maxCalls", c.Admission.MaxCalls))
+	add(validateNotNegative("admission.maxCallsPerIP", c.Admission.MaxCallsPerIP))
+	add(validateNotNegative("admission.maxInvitesPerSecond", c.Admission.MaxInvitesPerSecond))
+	add(validateNotNegative("admission.maxInvitesPerSecondPerIP", c.Admission.MaxInvitesPerSecondPerIP))
+	if c.Admission.RetryAfter < time.Second {
+		add(fmt.Errorf("admission.retryAfter: must be at least 1s, got %s", c.Admission.RetryAfter))
+	}
+
+	add(validateFileExists("resources.greetingAudio", c.Resources.GreetingAudio))
+	add(validateFileExists("resources.dtmfAudio", c.Resources.DTMFAudio))
+	add(validateFileExists("resources.durationWarnAudio", c.Resources.DurationWarnAudio))
+	add(validateFileExists("resources.font", c.Resources.Font))
+	for name, path := range c.Resources.Fonts {
+		add(validateFileExists("resources.fonts."+name, path))
+	}
+	for name, path := range c.Resources.Images {
+		add(validateFileExists("resources.images."+name, path))
+	}
+	for name, paths := range c.Resources.VideoClips {
+		for _, path := range paths {
+			add(validateFileExists("resources.videoClips."+name, path))
+		}
+	}
+	if _, known := c.Resources.VideoClips[c.Resources.GreetingVideo]; c.Resources.GreetingVideo != "" && !known {
+		add(fmt.Errorf("resources.greetingVideo: %q is not in resources.videoClips", c.Resources.GreetingVideo))
+	}
+	if c.Resources.GoodbyeAudio != "" {
+		add(validateFileExists("resources.goodbyeAudio", c.Resources.GoodbyeAudio))
+	}
+	for name, path := range c.Resources.Prompts {
+		for _, builtin := range builtinPromptNames {
+			if name == builtin {
+				add(fmt.Errorf("resources.prompts.%s: the name is taken by resources.%sAudio", name, name))
+			}
+		}
+		add(validateFileExists("resources.prompts."+name, path))
+	}
+	if c.Resources.BackgroundMusic != "" {
+		add(validateFileExists("resources.backgroundMusic", c.Resources.BackgroundMusic))
+	}
+	if info, err := os.Stat(c.HTTP.StaticDir); err != nil || !info.IsDir() {
+		add(fmt.Errorf("http.staticDir: %q is not a directory", c.HTTP.StaticDir))
+	}
+
+	if c.Video.Width < 16 || c.Video.Width > 4096 || c.Video.Width%2 == 1 {
+		add(fmt.Errorf("video.width: must be an even number between 16 and 4096, got %d", c.Video.Width))
+	}
+	if c.Video.Height < 16 || c.Video.Height > 4096 || c.Video.Height%2 == 1 {
+		add(fmt.Errorf("video.height: must be an even number between 16 and 4096, got %d", c.Video.Height))
+	}
+	if c.Video.FPS < 1 || c.Video.FPS > 60 {
+		add(fmt.Errorf("video.fps: must be between 1 and 60, got %d", c.Video.FPS))
+	}
+	if c.Video.Bitrate < 32000 {
+		add(fmt.Errorf("video.bitrate: must be at least 32000 bits per second, got %d", c.Video.Bitrate))
+	}
+	if c.Video.InitialBitrate < 32000 {
+		add(fmt.Errorf("video.initialBitrate: must be at least 32000 bits per second, got %d", c.Video.InitialBitrate))
+	}
+	if c.Video.KeyframeInterval <= 0 || c.Video.KeyframeInterval > time.Minute {
+		add(fmt.Errorf("video.keyframeInterval: must be positive and at most 1m, got %s", c.Video.KeyframeInterval))
+	}
+
+	if c.Audio.Bitrate < 6000 || c.Audio.Bitrate > 510000 {
+		add(fmt.Errorf("audio.bitrate: must be between 6000 and 510000 bits per second, got %d", c.Audio.Bitrate))
+	}
+	if c.Audio.MusicLevel < -60 || c.Audio.MusicLevel > 0 {
+		add(fmt.Errorf("audio.musicLevel: must be between -60 and 0 dB, got %d", c.Audio.MusicLevel))
+	}
+	if c.Audio.ComfortNoiseLevel < -96 || c.Audio.ComfortNoiseLevel > 0 {
+		add(fmt.Errorf("audio.comfortNoiseLevel: must be between -96 and 0 dBFS, got %d", c.Audio.ComfortNoiseLevel))
+	}
+	if c.Audio.Crossfade < 0 || c.Audio.Crossfade > time.Second*5 {
+		add(fmt.Errorf("audio.crossfade: must not be negative and at most 5s, got %s", c.Audio.Crossfade))
+	}
+	if _, known := countryTones[c.Audio.Country]; !known {
+		add(fmt.Errorf("audio.country: %q is not supported, expected one of %s", c.Audio.Country, strings.Join(countryNames(), ", ")))
+	}
+	for name, definition := range c.Audio.Tones {
+		if definition == "" {
+			continue
+		}
+		if _, err := parseTone(definition); err != nil {
+			add(fmt.Errorf("audio.tones.%s: %w", name, err))
+		}
+	}
+
+	if c.TTS.Command != "" && !strings.Contains(c.TTS.Command, ttsOutputPlaceholder) {
+		add(fmt.Errorf("tts.command: %q has no %s to write the WAV file to", c.TTS.Command, ttsOutputPlaceholder))
+	}
+	if c.TTS.Timeout <= 0 {
+		add(fmt.Errorf("tts.timeout: must be positive, got %s", c.TTS.Timeout))
+	}
+	add(validateNotNegative("tts.cacheSize", c.TTS.CacheSize))
+
+	if c.Session.Timeout <= 0 {
+		add(fmt.Errorf("session.timeout: must be positive, got %s", c.Session.Timeout))
+	}
+	if c.Shutdown.DrainTimeout < 0 {
+		add(fmt.Errorf("shutdown.drainTimeout: must not be negative, got %s", c.Shutdown.DrainTimeout))
+	}
+
+	if _, err := logrus.ParseLevel(c.Logging.Level); err != nil {
+		add(fmt.Errorf("logging.level: %w", err))
+	}
+	if c.Logging.Format != logFormatText && c.Logging.Format != logFormatJSON {
+		add(fmt.Errorf("logging.format: %q is not supported, expected text or json", c.Logging.Format))
+	}
+	if _, err := parsePionLogLevel(c.Logging.PionLevel); err != nil {
+		add(fmt.Errorf("logging.pionLevel: %w", err))
+	}
+	for scope, level := range c.Logging.PionScopeLevels {
+		if _, err := parsePionLogLevel(level); err != nil {
+			add(fmt.Errorf("logging.pionScopeLevels.%s: %w", scope, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write the config file: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags []string
+		fps   int
+	}{
+		{name: "default", fps: defaultVideoFPS},
+		{name: "file over default", file: "video:\n  fps: 15\n", fps: 15},
+		{name: "env over file", file: "video:\n  fps: 15\n", env: map[string]string{"SAMPLE_VIDEO_FPS": "20"}, fps: 20},
+		{name: "flag over env", file: "video:\n  fps: 15\n", env: map[string]string{"SAMPLE_VIDEO_FPS": "20"}, flags: []string{"-video-fps", "25"}, fps: 25},
+		{name: "flag over file", file: "video:\n  fps: 15\n", flags: []string{"-video-fps=25"}, fps: 25},
+		{name: "file from the environment", env: map[string]string{configFileEnv: "{file}"}, file: "video:\n  fps: 15\n", fps: 15},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var args []string
+			var path string
+			if test.file != "" {
+				path = writeTestConfig(t, test.file)
+				if _, fromEnv := test.env[configFileEnv]; !fromEnv {
+					args = append(args, "-config", path)
+				}
+			}
+			for name, value := range test.env {
+				t.Setenv(name, strings.ReplaceAll(value, "{file}", path))
+			}
+			args = append(args, test.flags...)
+
+			cfg, _, err := LoadConfig(args)
+			if err != nil {
+				t.Fatalf("failed to load: %s", err)
+			}
+			if cfg.Video.FPS != test.fps {
+				t.Errorf("video.fps is %d, want %d", cfg.Video.FPS, test.fps)
+			}
+			// what no source sets keeps its default
+			if cfg.Video.Width != defaultVideoWidth {
+				t.Errorf("video.width is %d, want the default", cfg.Video.Width)
+			}
+		})
+	}
+}
+
+func TestLoadConfigParsesEveryKind(t *testing.T) {
+	t.Setenv("SAMPLE_SESSION_TIMEOUT", "90s")
+	t.Setenv("SAMPLE_SIP_TRANSPORT", "tcp")
+	cfg, printConfig, err := LoadConfig([]string{"-video-broadcast", "-audio-mix=false", "-max-calls", "7", "-print-config"})
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if cfg.Session.Timeout != 90*time.Second || cfg.SIP.Transport != "tcp" {
+		t.Errorf("session.timeout %s and sip.transport %q from the environment", cfg.Session.Timeout, cfg.SIP.Transport)
+	}
+	if !cfg.Video.Broadcast || cfg.Audio.Mix || cfg.Admission.MaxCalls != 7 {
+		t.Errorf("video.broadcast %t, audio.mix %t, admission.maxCalls %d from the flags", cfg.Video.Broadcast, cfg.Audio.Mix, cfg.Admission.MaxCalls)
+	}
+	if !printConfig {
+		t.Error("-print-config not reported")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags []string
+		want  string
+	}{
+		{name: "env not an integer", env: map[string]string{"SAMPLE_VIDEO_FPS": "fast"}, want: "environment variable SAMPLE_VIDEO_FPS: video.fps"},
+		{name: "env not a duration", env: map[string]string{"SAMPLE_SESSION_TIMEOUT": "2"}, want: "not a duration"},
+		{name: "env not a bool", env: map[string]string{"SAMPLE_AUDIO_MIX": "yes please"}, want: "not true or false"},
+		{name: "flag not an integer", flags: []string{"-video-fps", "fast"}, want: "flag -video-fps: video.fps"},
+		{name: "unknown flag", flags: []string{"-no-such-flag"}, want: "no-such-flag"},
+		{name: "unknown field in the file", file: "video:\n  fsp: 15\n", want: "fsp"},
+		{name: "missing file", flags: []string{"-config", "/nonexistent/config.yaml"}, want: "failed to read config file"},
+		{name: "invalid after the flags", file: "video:\n  fps: 15\n", flags: []string{"-video-fps", "0"}, want: "video.fps: must be between 1 and 60"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var args []string
+			if test.file != "" {
+				args = append(args, "-config", writeTestConfig(t, test.file))
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			args = append(args, test.flags...)
+
+			if _, _, err := LoadConfig(args); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error with %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		// empty if the configuration is valid
+		want string
+	}{
+		{name: "defaults", change: func(c *Config) {}},
+		{name: "unknown transport", change: func(c *Config) { c.SIP.Transport = "sctp" }, want: "sip.transport"},
+		{name: "listen address without port", change: func(c *Config) { c.SIP.ListenAddress = "0.0.0.0" }, want: "sip.listenAddress"},
+		{name: "admin disabled", change: func(c *Config) { c.Admin.ListenAddress = "" }},
+		{name: "port range without mux", change: func(c *Config) { c.ICE.UDPMuxPort = 0 }},
+		{name: "port range ignored with mux", change: func(c *Config) { c.ICE.UDPPortMin, c.ICE.UDPPortMax = 0, 0 }},
+		{name: "empty port range", change: func(c *Config) { c.ICE.UDPMuxPort, c.ICE.UDPPortMin = 0, 0 }, want: "ice: port range 0-20000 is empty"},
+		{name: "reversed port range", change: func(c *Config) { c.ICE.UDPMuxPort, c.ICE.UDPPortMin, c.ICE.UDPPortMax = 0, 20000, 10000 }, want: "ice: port range 20000-10000 is empty"},
+		{name: "single port range", change: func(c *Config) { c.ICE.UDPMuxPort, c.ICE.UDPPortMin, c.ICE.UDPPortMax = 0, 10000, 10000 }},
+		{name: "port too high", change: func(c *Config) { c.ICE.UDPMuxPort, c.ICE.UDPPortMax = 0, 70000 }, want: "ice.udpPortMax: 70000 is not a valid port"},
+		{name: "stun server without scheme", change: func(c *Config) { c.ICE.StunServer = "stun.l.google.com:19302" }, want: "ice.stunServer"},
+		{name: "negative call limit", change: func(c *Config) { c.Admission.MaxCallsPerIP = -1 }, want: "admission.maxCallsPerIP: must not be negative"},
+		{name: "short retry after", change: func(c *Config) { c.Admission.RetryAfter = time.Millisecond }, want: "admission.retryAfter"},
+		{name: "missing prompt", change: func(c *Config) { c.Resources.GreetingAudio = "./resources/none.ogg" }, want: "resources.greetingAudio"},
+		{name: "taken prompt name", change: func(c *Config) { c.Resources.Prompts = map[string]string{"greeting": greetingAudioFileName} }, want: "resources.prompts.greeting: the name is taken"},
+		{name: "unknown greeting video", change: func(c *Config) { c.Resources.GreetingVideo = "welcome" }, want: "resources.greetingVideo"},
+		{name: "odd width", change: func(c *Config) { c.Video.Width = 641 }, want: "video.width"},
+		{name: "tiny height", change: func(c *Config) { c.Video.Height = 8 }, want: "video.height"},
+		{name: "keyframe interval", change: func(c *Config) { c.Video.KeyframeInterval = 0 }, want: "video.keyframeInterval"},
+		{name: "audio bitrate", change: func(c *Config) { c.Audio.Bitrate = 1000 }, want: "audio.bitrate"},
+		{name: "unknown country", change: func(c *Config) { c.Audio.Country = "xx" }, want: "audio.country"},
+		{name: "broken tone", change: func(c *Config) { c.Audio.Tones = map[string]string{"ringback": "loud"} }, want: "audio.tones.ringback"},
+		{name: "removed tone", change: func(c *Config) { c.Audio.Tones = map[string]string{"beep": ""} }},
+		{name: "tts without output", change: func(c *Config) { c.TTS.Command = "espeak-ng {text}" }, want: "tts.command"},
+		{name: "tts disabled", change: func(c *Config) { c.TTS.Command = "" }},
+		{name: "tts cache off", change: func(c *Config) { c.TTS.CacheSize = 0 }},
+		{name: "negative tts cache", change: func(c *Config) { c.TTS.CacheSize = -1 }, want: "tts.cacheSize"},
+		{name: "log format", change: func(c *Config) { c.Logging.Format = "xml" }, want: "logging.format"},
+		{name: "pion scope level", change: func(c *Config) { c.Logging.PionScopeLevels["ice"] = "loud" }, want: "logging.pionScopeLevels.ice"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			test.change(cfg)
+			err := cfg.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("rejected: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error with %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Video.FPS = 0
+	cfg.Session.Timeout = 0
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "video.fps") || !strings.Contains(err.Error(), "session.timeout") {
+		t.Errorf("got %v, want both problems", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"strings"
+)
+
+// DTMF arrives as RFC 4733 telephone events next to the audio of the caller
+const (
+	mimeTypeTelephoneEvent    = "audio/telephone-event"
+	telephoneEventClockRate   = 8000
+	telephoneEventPayloadType = 101
+	telephoneEventPayloadSize = 4
+	telephoneEventEndBit      = 0x80
+)
+
+// events 0-15, 16 and up are flash and tones we do not care about
+var telephoneEventDigits = []string{
+	"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "*", "#", "A", "B", "C", "D",
+}
+
+func registerTelephoneEventCodec(mediaEngine *webrtc.MediaEngine) error {
+	return mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    mimeTypeTelephoneEvent,
+			ClockRate:   telephoneEventClockRate,
+			SDPFmtpLine: "0-16",
+		},
+		PayloadType: telephoneEventPayloadType,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+// dtmfDetector turns telephone event packets into digits. The end of an event is sent three times
+// with the same timestamp, the digit is reported on the first one
+type dtmfDetector struct {
+	endedTimestamp uint32
+	ended          bool
+}
+
+func (d *dtmfDetector) push(packet *rtp.Packet) (string, bool) {
+	if len(packet.Payload) < telephoneEventPayloadSize || packet.Payload[1]&telephoneEventEndBit == 0 {
+		return "", false
+	}
+	if d.ended && d.endedTimestamp == packet.Timestamp {
+		return "", false
+	}
+	d.ended = true
+	d.endedTimestamp = packet.Timestamp
+
+	event := int(packet.Payload[0])
+	if event >= len(telephoneEventDigits) {
+		return "", false
+	}
+	return telephoneEventDigits[event], true
+}
+
+// readRemoteTrack drains what the caller sends and picks the DTMF digits out of it
+func (vmi *VoiceMenuInstance) readRemoteTrack(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	var detector dtmfDetector
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if !strings.EqualFold(track.Codec().MimeType, mimeTypeTelephoneEvent) {
+			continue
+		}
+		if digit, ok := detector.push(packet); ok {
+			vmi._log.Infof("DTMF digit %s received", digit)
+			dtmfDigitsReceivedTotal.WithLabelValues(digit).Inc()
+			vmi.enterDigit(digit)
+		}
+	}
+}
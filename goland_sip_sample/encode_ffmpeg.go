@@ -0,0 +1,499 @@
+//go:build !stubencoder
+
+package main
+
+import "C"
+import (
+	"fmt"
+	"github.com/ghettovoice/gosip/log"
+	"image"
+	"image/color"
+	"reflect"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// #cgo CFLAGS: -g -w
+// #include <stdlib.h>
+//#include <libavcodec/avcodec.h>
+// #include <libswscale/swscale.h>
+// #include <libavutil/imgutils.h>
+// #include <libavutil/opt.h>
+// #include "video_utils.h"
+//
+// // ... yes. Don't ask.
+// typedef struct SwsContext SwsContext;
+//
+// #ifndef PIX_FMT_RGB0
+// #define PIX_FMT_RGB0 PIX_FMT_RGB32
+// #endif
+//
+//int FFMPEG_WAIT_FOR_INPUT_AVERROR = AVERROR(EAGAIN);
+//int FFMPEG_END_OF_STREAM_AVERROR = AVERROR_EOF;
+//
+// #cgo pkg-config: libavdevice libavformat libavfilter libavcodec libswscale libavutil
+import "C"
+
+import (
+	"errors"
+)
+
+// example: https://github.com/pwaller/go-ffmpeg-video-encoding/blob/master/ffmpeg.go
+// directly in ffmpeg: https://stackoverflow.com/questions/35569830/correctly-allocate-and-fill-frame-in-ffmpeg
+// https://github.com/UnickSoft/FFmpeg-encode-example/blob/master/ffmpegEncoder/VideoEncoder.cpp#L121 - one more example
+func avCodecID(codec VideoCodecID) uint32 {
+	switch codec {
+	case CODEC_ID_H264:
+		return C.AV_CODEC_ID_H264
+	case CODEC_ID_VP8:
+		return C.AV_CODEC_ID_VP8
+	case CODEC_ID_VP9:
+		return C.AV_CODEC_ID_VP9
+	case CODEC_ID_AV1:
+		return C.AV_CODEC_ID_AV1
+	}
+	return C.AV_CODEC_ID_NONE
+}
+
+// Encoder is the libavcodec VideoEncoder
+type Encoder struct {
+	codec VideoCodecID
+	//im            image.Image
+	//underlying_im image.Image
+	//Output        io.Writer
+
+	_codec      *C.AVCodec
+	_context    *C.AVCodecContext
+	_swscontext *C.SwsContext
+	_frame      *C.AVFrame
+
+	// receives encoded frames, they are copied out and the packet is unreferenced right away
+	_packet *C.AVPacket
+	// set by Flush, the encoder takes no more frames
+	_flushed bool
+	// of the next frame, in frames. frame_number of the context is deprecated
+	_pts int64
+
+	inputImage      *image.RGBA
+	_input_data     **C.uint8_t
+	_input_linesize [1]C.int
+
+	// 4:2:0 frames of another size than the encoder are copied here and scaled, see EncodeYCbCr. made for the
+	// size of the last such frame
+	_yuv_swscontext *C.SwsContext
+	_yuv_size       image.Point
+	_yuv_data       [4]*C.uint8_t
+	_yuv_linesize   [4]C.int
+
+	_log log.Logger
+
+	// set from RTCP goroutines, applied by EncodeFrame before the next frame
+	_keyframeRequested atomic.Bool
+	_requestedBitrate  atomic.Int64
+}
+
+func yuvColor(y int, u int, v int) C.YUVColor {
+	return C.yuv_color(C.uint8_t(y), C.uint8_t(u), C.uint8_t(v))
+}
+
+// drawBox fills a box of a 4:2:0 frame
+func drawBox(frame *C.AVFrame, x int, y int, width int, height int, color C.YUVColor) {
+	C.draw_box(frame, C.uint32_t(x), C.uint32_t(y), C.uint32_t(width), C.uint32_t(height), color)
+}
+
+func ptr(buf []byte) *C.uint8_t {
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&buf))
+	return (*C.uint8_t)(unsafe.Pointer(h.Data))
+}
+
+func dptr(buf []byte) **C.uint8_t {
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&buf))
+	return (**C.uint8_t)(unsafe.Pointer(h.Data))
+}
+
+/*
+type EncoderOptions struct {
+    BitRate uint32
+    W, H int
+    TimeBase
+} */
+
+/*
+var DefaultEncoderOptions = EncoderOptions{
+    BitRate:400000,
+    W: 0, H: 0,
+    c.time_base = C.AVRational{1,25}
+    c.gop_size = 10
+    c.max_b_frames = 1
+    c.pix_fmt = C.PIX_FMT_RGB
+} */
+
+type YCbCrWithSet struct {
+	image.YCbCr
+}
+
+func (p *YCbCrWithSet) Set(x int, y int, c color.Color) {
+	c1 := color.YCbCrModel.Convert(c).(color.YCbCr)
+	p.Y[p.YOffset(x, y)] = c1.Y
+	p.Cb[p.COffset(x, y)] = c1.Cb
+	p.Cr[p.COffset(x, y)] = c1.Cr
+}
+
+// codecs register themselves since ffmpeg 4, only the log level is left to set
+func initVideoEncoder() {
+	C.av_log_set_level(C.AV_LOG_WARNING)
+	//C.av_log_set_level(C.AV_LOG_DEBUG)
+}
+
+// videoEncoderSupports tells whether the ffmpeg we are linked against has an encoder for codec,
+// VP8 and VP9 need it built with libvpx
+func videoEncoderSupports(codec VideoCodecID) bool {
+	return C.avcodec_find_encoder(avCodecID(codec)) != nil
+}
+
+// NewVideoEncoder creates the libavcodec encoder, see NewEncoder
+func NewVideoEncoder(codec VideoCodecID, inputImage *image.RGBA, settings EncoderSettings, encoderLogger log.Logger) (VideoEncoder, error) {
+	e, err := NewEncoder(codec, inputImage, settings, encoderLogger)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// encoderLogger is usually the logger of the call the encoder belongs to
+func NewEncoder(codec VideoCodecID, inputImage *image.RGBA, settings EncoderSettings, encoderLogger log.Logger) (*Encoder, error) {
+	_codec := C.avcodec_find_encoder(avCodecID(codec))
+	if _codec == nil {
+		return nil, fmt.Errorf("could not find codec")
+	}
+
+	width := settings.Width
+	height := settings.Height
+
+	// resolution must be a multiple of two
+	if width%2 == 1 || height%2 == 1 {
+		return nil, fmt.Errorf("Bad image dimensions (%d, %d), must be even", width, height)
+	}
+	encoderLogger.Infof("Encoder dimensions: %d, %d at %d fps and %d bit/s", width, height, settings.FPS, settings.Bitrate)
+
+	avContext := C.avcodec_alloc_context3(_codec)
+	avContext.width = C.int(width)
+	avContext.height = C.int(height)
+	avContext.time_base = C.AVRational{1, C.int(settings.FPS)} // FPS
+	avContext.gop_size = C.int(settings.GOPSize)
+	avContext.max_b_frames = 0
+	avContext.delay = 0
+
+	avContext.pix_fmt = C.AV_PIX_FMT_YUV420P
+	setRateControl(avContext, settings.Bitrate)
+
+	setCodecOptions(avContext, codec, settings)
+
+	avFrame := C.av_frame_alloc()
+	if avFrame == nil {
+		panic("Failed to allicate avFrame")
+	}
+
+	avFrame.format = C.AV_PIX_FMT_YUV420P
+	avFrame.width = avContext.width
+	avFrame.height = avContext.height
+
+	//from AV
+	avFrameData := [8]*C.uint8_t{}
+	avFrameLinesizes := [8]C.int32_t{}
+	C.av_image_alloc(&avFrameData[0], &avFrameLinesizes[0], avContext.width, avContext.height, C.AV_PIX_FMT_YUV420P, C.int(1))
+	avFrame.data = avFrameData
+	avFrame.linesize = avFrameLinesizes
+
+	if C.avcodec_open2(avContext, _codec, nil) < 0 {
+		C.av_free(unsafe.Pointer(avFrame.data[0]))
+		C.av_frame_free(&avFrame)
+		C.avcodec_free_context(&avContext)
+		return nil, fmt.Errorf("could not open codec")
+	}
+
+	_swscontext := C.sws_getContext(C.int(inputImage.Bounds().Dx()), C.int(inputImage.Bounds().Dy()), C.AV_PIX_FMT_RGB0, avContext.width, avContext.height, C.AV_PIX_FMT_YUV420P,
+		C.SWS_BICUBIC, nil, nil, nil)
+
+	input_data := (**C.uint8_t)(C.wrapWithArray(ptr(inputImage.Pix)))
+	input_linesize := [1]C.int{C.int(inputImage.Bounds().Dx() * 4)}
+	e := &Encoder{
+		codec:           codec,
+		_codec:          _codec,
+		_context:        avContext,
+		_swscontext:     _swscontext,
+		_frame:          avFrame,
+		_packet:         C.av_packet_alloc(),
+		inputImage:      inputImage,
+		_input_data:     input_data,
+		_input_linesize: input_linesize,
+		_log:            encoderLogger,
+	}
+	videoEncodersOpen.Inc()
+	return e, nil
+}
+
+func (e *Encoder) InputImage() *image.RGBA {
+	return e.inputImage
+}
+
+// RequestKeyframe makes the next frame written an IDR frame with SPS and PPS
+func (e *Encoder) RequestKeyframe() {
+	e._keyframeRequested.Store(true)
+}
+
+func (e *Encoder) SetBitrate(bitrate int) {
+	e._requestedBitrate.Store(int64(bitrate))
+}
+
+// setCodecOptions tunes libx264, libvpx or libaom for real time, one frame in, one frame out
+func setCodecOptions(avContext *C.AVCodecContext, codec VideoCodecID, settings EncoderSettings) {
+	switch codec {
+	case CODEC_ID_H264:
+		setPrivateOption(avContext, "preset", "ultrafast")
+		setPrivateOption(avContext, "tune", "zerolatency")
+		// requested keyframes must be IDR frames, otherwise a receiver that lost the stream still can not decode.
+		// without AV_CODEC_FLAG_GLOBAL_HEADER x264 repeats SPS and PPS in front of every IDR
+		setPrivateOption(avContext, "forced-idr", "1")
+		if settings.Profile != "" {
+			setPrivateOption(avContext, "profile", settings.Profile)
+		}
+		if settings.Level > 0 {
+			avContext.level = C.int(settings.Level)
+		}
+	case CODEC_ID_VP8, CODEC_ID_VP9:
+		setPrivateOption(avContext, "deadline", "realtime")
+		setPrivateOption(avContext, "cpu-used", "8")
+		setPrivateOption(avContext, "lag-in-frames", "0")
+	case CODEC_ID_AV1:
+		setPrivateOption(avContext, "usage", "realtime")
+		setPrivateOption(avContext, "cpu-used", "8")
+		setPrivateOption(avContext, "lag-in-frames", "0")
+	}
+}
+
+// setPrivateOption sets an option of the encoder library behind avContext
+func setPrivateOption(avContext *C.AVCodecContext, name string, value string) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	C.av_opt_set(avContext.priv_data, cName, cValue, 0)
+}
+
+// libx264 is reconfigured on the fly, libvpx and libaom only read the bitrate when they are opened
+func (e *Encoder) ReconfiguresBitrate() bool {
+	return e.codec == CODEC_ID_H264
+}
+
+// setRateControl caps the bitrate with VBV as well, without it x264 takes bit_rate as an average over the whole call
+// and overshoots for seconds after a drop
+func setRateControl(avContext *C.AVCodecContext, bitrate int) {
+	avContext.bit_rate = C.long(bitrate)
+	avContext.rc_max_rate = C.int64_t(bitrate)
+	// half a second of video, the receiver has to buffer no more than that
+	avContext.rc_buffer_size = C.int(bitrate / 2)
+}
+
+func (e *Encoder) FPS() int {
+	return int(e._context.time_base.den)
+}
+
+// applyRequests must be called from the goroutine that writes frames
+func (e *Encoder) applyRequests() {
+	// libx264 picks up changed rate control on the next frame and reconfigures itself
+	if bitrate := e._requestedBitrate.Swap(0); bitrate > 0 && bitrate != int64(e._context.bit_rate) {
+		e._log.Debugf("Encoder bitrate changed from %d to %d", int64(e._context.bit_rate), bitrate)
+		setRateControl(e._context, int(bitrate))
+	}
+
+	if e._keyframeRequested.Swap(false) {
+		e._log.Debug("Keyframe requested")
+		e._frame.pict_type = C.AV_PICTURE_TYPE_I
+	} else {
+		e._frame.pict_type = C.AV_PICTURE_TYPE_NONE
+	}
+}
+
+func (e *Encoder) EncodeFrame(frameNum int) ([]byte, error) {
+	if e._flushed {
+		return nil, errors.New("encoder is flushed")
+	}
+	C.sws_scale(e._swscontext, e._input_data, &e._input_linesize[0],
+		0, C.int(e.inputImage.Bounds().Dy()),
+		&e._frame.data[0], &e._frame.linesize[0])
+	return e.encode()
+}
+
+// EncodeYCbCr copies a frame of the encoder's size into the AVFrame as it is and scales others
+func (e *Encoder) EncodeYCbCr(frameNum int, frame *image.YCbCr) ([]byte, error) {
+	if e._flushed {
+		return nil, errors.New("encoder is flushed")
+	}
+	size := frame.Rect.Size()
+	if size == image.Pt(int(e._context.width), int(e._context.height)) {
+		copyYCbCr(e._frame.data[:3], e._frame.linesize[:3], frame)
+		return e.encode()
+	}
+
+	if size != e._yuv_size {
+		e.freeYUVScaling()
+		if C.av_image_alloc(&e._yuv_data[0], &e._yuv_linesize[0], C.int(size.X), C.int(size.Y), C.AV_PIX_FMT_YUV420P, C.int(1)) < 0 {
+			return nil, fmt.Errorf("could not allocate a %dx%d frame to scale", size.X, size.Y)
+		}
+		e._yuv_swscontext = C.sws_getContext(C.int(size.X), C.int(size.Y), C.AV_PIX_FMT_YUV420P, e._context.width, e._context.height, C.AV_PIX_FMT_YUV420P,
+			C.SWS_BICUBIC, nil, nil, nil)
+		e._yuv_size = size
+	}
+	copyYCbCr(e._yuv_data[:3], e._yuv_linesize[:3], frame)
+	C.sws_scale(e._yuv_swscontext, &e._yuv_data[0], &e._yuv_linesize[0],
+		0, C.int(size.Y),
+		&e._frame.data[0], &e._frame.linesize[0])
+	return e.encode()
+}
+
+// copyYCbCr copies the planes of frame into the Y, U and V planes of a C allocated YUV420P image
+func copyYCbCr(data []*C.uint8_t, linesize []C.int, frame *image.YCbCr) {
+	width, height := frame.Rect.Dx(), frame.Rect.Dy()
+	copyPlane(data[0], int(linesize[0]), frame.Y, frame.YStride, width, height)
+	copyPlane(data[1], int(linesize[1]), frame.Cb, frame.CStride, (width+1)/2, (height+1)/2)
+	copyPlane(data[2], int(linesize[2]), frame.Cr, frame.CStride, (width+1)/2, (height+1)/2)
+}
+
+func copyPlane(dst *C.uint8_t, dstStride int, src []uint8, srcStride int, width int, height int) {
+	plane := unsafe.Slice((*uint8)(unsafe.Pointer(dst)), dstStride*(height-1)+width)
+	for y := 0; y < height; y++ {
+		copy(plane[y*dstStride:y*dstStride+width], src[y*srcStride:y*srcStride+width])
+	}
+}
+
+func (e *Encoder) freeYUVScaling() {
+	if e._yuv_swscontext == nil {
+		return
+	}
+	C.sws_freeContext(e._yuv_swscontext)
+	C.av_free(unsafe.Pointer(e._yuv_data[0]))
+	e._yuv_swscontext, e._yuv_data, e._yuv_size = nil, [4]*C.uint8_t{}, image.Point{}
+}
+
+// encode encodes what is in the AVFrame
+func (e *Encoder) encode() ([]byte, error) {
+	e._frame.pts = C.int64_t(e._pts)
+	e._pts++
+	e.applyRequests()
+
+	err, outSize := doEncodeVideo(e, e._packet)
+	if err != nil {
+		return nil, err
+	}
+	//sometimes ffmpeg skips frames
+	if outSize < 0 {
+		return nil, nil
+	}
+	return e.takePacket(), nil
+}
+
+// takePacket copies the encoded frame out of _packet and hands its buffer back to libavcodec, which reuses it
+func (e *Encoder) takePacket() []byte {
+	frame := C.GoBytes(unsafe.Pointer(e._packet.data), e._packet.size)
+	C.av_packet_unref(e._packet)
+	return frame
+}
+
+// Flush ends the stream and returns the frames libavcodec still held back
+func (e *Encoder) Flush() ([][]byte, error) {
+	if e._flushed {
+		return nil, nil
+	}
+	e._flushed = true
+	if result := C.avcodec_send_frame(e._context, nil); result != 0 {
+		return nil, fmt.Errorf("failed to call avcodec_send_frame to flush: %d", result)
+	}
+	var frames [][]byte
+	for {
+		result := C.avcodec_receive_packet(e._context, e._packet)
+		// EAGAIN is not supposed to come while draining, but there is nothing more either way
+		if result == C.FFMPEG_END_OF_STREAM_AVERROR || result == C.FFMPEG_WAIT_FOR_INPUT_AVERROR {
+			return frames, nil
+		}
+		if result != 0 {
+			return frames, fmt.Errorf("failed to call avcodec_receive_packet to flush: %d", result)
+		}
+		frames = append(frames, e.takePacket())
+	}
+}
+
+func doEncodeVideo(e *Encoder, packet *C.AVPacket) (error, int) {
+	start := time.Now()
+
+	gotPacketStr := C.int(0)
+
+	var successInt C.int = C.avcodec_send_frame(
+		e._context,
+		e._frame,
+	)
+
+	if int(successInt) != 0 {
+		return errors.New(fmt.Sprintf(
+				"failed to call avcodec_send_frame: %d. result length: %d",
+				successInt,
+				gotPacketStr,
+			)),
+			0
+	}
+
+	successInt = C.avcodec_receive_packet(
+		e._context,
+		packet,
+	)
+
+	if successInt == C.FFMPEG_WAIT_FOR_INPUT_AVERROR {
+		e._log.Info("Frame not encoded by libavicodec")
+		videoFramesNotEncodedTotal.Inc()
+		return nil, -1
+	}
+
+	if int(successInt) != 0 {
+		return errors.New(fmt.Sprintf(
+				"failed to call avcodec_receive_packet: %d. result length: %d",
+				successInt,
+				gotPacketStr,
+			)),
+			0
+	}
+
+	encoderFrameSeconds.Observe(time.Since(start).Seconds())
+	e._log.Trace("successfully encoded frame."+
+		"\npresentation ts: ", packet.pts,
+		"\nstream index: ", packet.stream_index,
+		"\npacket duration: ", packet.duration,
+		"\nresult len: ", packet.size,
+		"\nencoding took: ", time.Since(start),
+	)
+
+	return nil, int(packet.size)
+}
+
+// Close drains the encoder unless Flush did, dropping the frames, and frees everything it allocated
+func (e *Encoder) Close() {
+	if e._context == nil {
+		return
+	}
+	if frames, err := e.Flush(); err != nil {
+		e._log.Warnf("Failed to flush encoder: %s", err)
+	} else if len(frames) > 0 {
+		e._log.Debugf("Dropped %d frames the encoder held back", len(frames))
+	}
+
+	C.sws_freeContext(e._swscontext)
+	e.freeYUVScaling()
+	C.avcodec_free_context(&e._context)
+	// allocated with av_image_alloc, av_frame_free only releases reference counted buffers
+	C.av_free(unsafe.Pointer(e._frame.data[0]))
+	C.av_frame_free(&e._frame)
+	C.av_packet_free(&e._packet)
+	C.freeWrappedArray(e._input_data)
+	e._codec, e._swscontext, e._input_data = nil, nil, nil
+	videoEncodersOpen.Dec()
+}
@@ -0,0 +1,293 @@
+//go:build stubencoder
+
+package main
+
+import (
+	"fmt"
+	"github.com/ghettovoice/gosip/log"
+	"image"
+	"sync/atomic"
+	"time"
+)
+
+// the stub encoder writes a valid H.264 stream without looking at the input image: a mid gray IDR frame with every
+// macroblock DC predicted and no residual, followed by P frames that skip every macroblock. It is constrained
+// baseline, which every H.264 decoder takes whatever profile it asked for. Good enough to test calls end to end
+// without cgo and the ffmpeg headers, build with -tags stubencoder
+const (
+	// what the stream says when the offer does not limit the level, up to 1920x1080 at 30 fps
+	stubEncoderDefaultLevel = 40
+	// log2_max_frame_num and log2_max_pic_order_cnt_lsb
+	stubFrameNumBits       = 4
+	stubPicOrderCntLsbBits = 16
+	h264SliceTypeP         = 5
+	h264SliceTypeI         = 7
+	// I_16x16_2_0_0: DC prediction, no coded luma AC and chroma
+	h264MbTypeI16x16DC = 3
+)
+
+func initVideoEncoder() {
+}
+
+func videoEncoderSupports(codec VideoCodecID) bool {
+	return codec == CODEC_ID_H264
+}
+
+// StubEncoder is the VideoEncoder built with -tags stubencoder
+type StubEncoder struct {
+	settings   EncoderSettings
+	inputImage *image.RGBA
+	// in macroblocks of 16x16 pixels
+	widthMbs  int
+	heightMbs int
+
+	// since the last keyframe, 0 right after one
+	framesSinceKeyframe int
+	idrPicID            int
+	// a keyframe is written when true, starts out true
+	keyframeRequested atomic.Bool
+	closed            bool
+
+	_log log.Logger
+}
+
+// NewVideoEncoder creates the stub encoder. the input image is ignored, the output has the size of settings
+func NewVideoEncoder(codec VideoCodecID, inputImage *image.RGBA, settings EncoderSettings, encoderLogger log.Logger) (VideoEncoder, error) {
+	if codec != CODEC_ID_H264 {
+		return nil, fmt.Errorf("stub encoder only writes H.264")
+	}
+	if settings.Width <= 0 || settings.Height <= 0 || settings.Width%2 == 1 || settings.Height%2 == 1 {
+		return nil, fmt.Errorf("Bad image dimensions (%d, %d), must be even", settings.Width, settings.Height)
+	}
+	encoderLogger.Infof("Stub encoder dimensions: %d, %d at %d fps", settings.Width, settings.Height, settings.FPS)
+
+	e := &StubEncoder{
+		settings:   settings,
+		inputImage: inputImage,
+		widthMbs:   (settings.Width + h264MacroblockSize - 1) / h264MacroblockSize,
+		heightMbs:  (settings.Height + h264MacroblockSize - 1) / h264MacroblockSize,
+		_log:       encoderLogger,
+	}
+	e.keyframeRequested.Store(true)
+	videoEncodersOpen.Inc()
+	return e, nil
+}
+
+func (e *StubEncoder) InputImage() *image.RGBA {
+	return e.inputImage
+}
+
+func (e *StubEncoder) FPS() int {
+	return e.settings.FPS
+}
+
+func (e *StubEncoder) RequestKeyframe() {
+	e.keyframeRequested.Store(true)
+}
+
+// the bitrate is whatever the stream takes, a few bytes per frame
+func (e *StubEncoder) SetBitrate(bitrate int) {
+}
+
+func (e *StubEncoder) ReconfiguresBitrate() bool {
+	return true
+}
+
+func (e *StubEncoder) EncodeFrame(frameNum int) ([]byte, error) {
+	start := time.Now()
+	var frame []byte
+	if e.keyframeRequested.Swap(false) || e.framesSinceKeyframe >= e.settings.GOPSize {
+		frame = appendNALUnit(frame, 3, h264NALUnitTypeSPS, e.sequenceParameterSet())
+		frame = appendNALUnit(frame, 3, h264NALUnitTypePPS, e.pictureParameterSet())
+		frame = appendNALUnit(frame, 3, h264NALUnitTypeIDR, e.idrSlice())
+		e.idrPicID = (e.idrPicID + 1) % 65536
+		e.framesSinceKeyframe = 0
+	} else {
+		// P frames only reference the IDR frame, so losing one does not break the ones after it
+		frame = appendNALUnit(frame, 0, h264NALUnitTypeSlice, e.skippedSlice())
+	}
+	e.framesSinceKeyframe++
+	encoderFrameSeconds.Observe(time.Since(start).Seconds())
+	e._log.Trace("Stub encoded frame ", frameNum, ", ", len(frame), " bytes")
+	return frame, nil
+}
+
+// the stub ignores what it is given either way
+func (e *StubEncoder) EncodeYCbCr(frameNum int, image *image.YCbCr) ([]byte, error) {
+	return e.EncodeFrame(frameNum)
+}
+
+// every frame is written as soon as it is given
+func (e *StubEncoder) Flush() ([][]byte, error) {
+	return nil, nil
+}
+
+func (e *StubEncoder) Close() {
+	if e.closed {
+		return
+	}
+	e.closed = true
+	videoEncodersOpen.Dec()
+}
+
+func (e *StubEncoder) sequenceParameterSet() []byte {
+	var w h264BitWriter
+	level := e.settings.Level
+	if level <= 0 {
+		level = stubEncoderDefaultLevel
+	}
+	// constraint_set0, 1 and 2: constrained baseline
+	constraints := 0xe0
+	if level == h264LevelIDC1b {
+		constraints |= h264ConstraintSet3
+		level = 11
+	}
+	w.u(8, h264ProfileIDCBaseline)
+	w.u(8, constraints)
+	w.u(8, level)
+	w.ue(0) // seq_parameter_set_id
+	w.ue(stubFrameNumBits - 4)
+	w.ue(0) // pic_order_cnt_type
+	w.ue(stubPicOrderCntLsbBits - 4)
+	w.ue(1)   // max_num_ref_frames
+	w.u(1, 0) // gaps_in_frame_num_value_allowed_flag
+	w.ue(e.widthMbs - 1)
+	w.ue(e.heightMbs - 1)
+	w.u(1, 1) // frame_mbs_only_flag
+	w.u(1, 1) // direct_8x8_inference_flag
+	// cropped in units of 2 pixels for 4:2:0
+	cropRight := (e.widthMbs*h264MacroblockSize - e.settings.Width) / 2
+	cropBottom := (e.heightMbs*h264MacroblockSize - e.settings.Height) / 2
+	if cropRight > 0 || cropBottom > 0 {
+		w.u(1, 1)
+		w.ue(0)
+		w.ue(cropRight)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(1, 0) // vui_parameters_present_flag
+	return w.trailingBits()
+}
+
+func (e *StubEncoder) pictureParameterSet() []byte {
+	var w h264BitWriter
+	w.ue(0)   // pic_parameter_set_id
+	w.ue(0)   // seq_parameter_set_id
+	w.u(1, 0) // entropy_coding_mode_flag, CAVLC
+	w.u(1, 0) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)   // num_slice_groups_minus1
+	w.ue(0)   // num_ref_idx_l0_default_active_minus1
+	w.ue(0)   // num_ref_idx_l1_default_active_minus1
+	w.u(1, 0) // weighted_pred_flag
+	w.u(2, 0) // weighted_bipred_idc
+	w.se(0)   // pic_init_qp_minus26
+	w.se(0)   // pic_init_qs_minus26
+	w.se(0)   // chroma_qp_index_offset
+	w.u(1, 0) // deblocking_filter_control_present_flag
+	w.u(1, 0) // constrained_intra_pred_flag
+	w.u(1, 0) // redundant_pic_cnt_present_flag
+	return w.trailingBits()
+}
+
+func (e *StubEncoder) idrSlice() []byte {
+	var w h264BitWriter
+	w.ue(0) // first_mb_in_slice
+	w.ue(h264SliceTypeI)
+	w.ue(0)                  // pic_parameter_set_id
+	w.u(stubFrameNumBits, 0) // frame_num
+	w.ue(e.idrPicID)
+	w.u(stubPicOrderCntLsbBits, 0)
+	w.u(1, 0) // no_output_of_prior_pics_flag
+	w.u(1, 0) // long_term_reference_flag
+	w.se(0)   // slice_qp_delta
+	for i := 0; i < e.widthMbs*e.heightMbs; i++ {
+		// without neighbours DC prediction is mid gray, with them it is what they are
+		w.ue(h264MbTypeI16x16DC)
+		w.ue(0)   // intra_chroma_pred_mode DC
+		w.se(0)   // mb_qp_delta
+		w.u(1, 1) // coeff_token of the luma DC block: no coefficients
+	}
+	return w.trailingBits()
+}
+
+func (e *StubEncoder) skippedSlice() []byte {
+	var w h264BitWriter
+	w.ue(0) // first_mb_in_slice
+	w.ue(h264SliceTypeP)
+	w.ue(0)                  // pic_parameter_set_id
+	w.u(stubFrameNumBits, 1) // frame_num, the one after the IDR frame
+	w.u(stubPicOrderCntLsbBits, (2*e.framesSinceKeyframe)%(1<<stubPicOrderCntLsbBits))
+	w.u(1, 0)                      // num_ref_idx_active_override_flag
+	w.u(1, 0)                      // ref_pic_list_modification_flag_l0
+	w.se(0)                        // slice_qp_delta
+	w.ue(e.widthMbs * e.heightMbs) // mb_skip_run
+	return w.trailingBits()
+}
+
+// appendNALUnit appends rbsp as a NAL unit with an Annex B start code, the way libx264 writes them
+func appendNALUnit(frame []byte, refIdc int, unitType int, rbsp []byte) []byte {
+	frame = append(frame, 0, 0, 0, 1, byte(refIdc<<5|unitType))
+	zeros := 0
+	for _, b := range rbsp {
+		// emulation prevention, the payload must not contain a start code
+		if zeros == 2 && b <= 3 {
+			frame = append(frame, 3)
+			zeros = 0
+		}
+		frame = append(frame, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return frame
+}
+
+// h264BitWriter writes the bits of a raw byte sequence payload, most significant first
+type h264BitWriter struct {
+	bytes   []byte
+	current byte
+	bits    int
+}
+
+func (w *h264BitWriter) u(bits int, value int) {
+	for i := bits - 1; i >= 0; i-- {
+		w.current = w.current<<1 | byte(value>>i&1)
+		w.bits++
+		if w.bits == 8 {
+			w.bytes = append(w.bytes, w.current)
+			w.current, w.bits = 0, 0
+		}
+	}
+}
+
+// ue is unsigned Exp-Golomb
+func (w *h264BitWriter) ue(value int) {
+	length := 0
+	for v := value + 1; v > 1; v >>= 1 {
+		length++
+	}
+	w.u(length, 0)
+	w.u(length+1, value+1)
+}
+
+// se is signed Exp-Golomb
+func (w *h264BitWriter) se(value int) {
+	if value > 0 {
+		w.ue(2*value - 1)
+	} else {
+		w.ue(-2 * value)
+	}
+}
+
+// trailingBits ends the payload with the stop bit and returns it
+func (w *h264BitWriter) trailingBits() []byte {
+	w.u(1, 1)
+	for w.bits != 0 {
+		w.u(1, 0)
+	}
+	return w.bytes
+}
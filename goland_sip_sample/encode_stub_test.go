@@ -0,0 +1,273 @@
+//go:build stubencoder
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// h264BitReader reads what h264BitWriter wrote, for checking the stub's bitstream
+type h264BitReader struct {
+	bytes    []byte
+	position int
+}
+
+func (r *h264BitReader) u(bits int) int {
+	value := 0
+	for i := 0; i < bits; i++ {
+		bit := int(r.bytes[r.position/8]>>(7-r.position%8)) & 1
+		value = value<<1 | bit
+		r.position++
+	}
+	return value
+}
+
+func (r *h264BitReader) ue() int {
+	zeros := 0
+	for r.u(1) == 0 {
+		zeros++
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
+
+func (r *h264BitReader) se() int {
+	value := r.ue()
+	if value%2 == 1 {
+		return (value + 1) / 2
+	}
+	return -value / 2
+}
+
+// moreData tells whether anything but the stop bit and its padding is left
+func (r *h264BitReader) moreData() bool {
+	rest := r.bytes[r.position/8:]
+	last := len(rest) - 1
+	for last > 0 && rest[last] == 0 {
+		last--
+	}
+	stopBit := 7 - bitsTrailing(rest[last])
+	return last > 0 || r.position%8 < stopBit
+}
+
+func bitsTrailing(b byte) int {
+	n := 0
+	for b&1 == 0 && n < 8 {
+		b >>= 1
+		n++
+	}
+	return n
+}
+
+type testNALUnit struct {
+	refIdc   int
+	unitType int
+	rbsp     []byte
+}
+
+// parseTestFrame splits a frame into its NAL units and removes the emulation prevention bytes
+func parseTestFrame(t *testing.T, frame []byte) []testNALUnit {
+	t.Helper()
+	if !bytes.HasPrefix(frame, []byte{0, 0, 1}) && !bytes.HasPrefix(frame, []byte{0, 0, 0, 1}) {
+		t.Fatalf("frame does not start with a start code: % x", frame)
+	}
+	var units []testNALUnit
+	for _, unit := range splitAnnexB(frame) {
+		var rbsp []byte
+		zeros := 0
+		for _, b := range unit[1:] {
+			if zeros == 2 && b == 3 {
+				zeros = 0
+				continue
+			}
+			if zeros == 2 && b < 3 {
+				t.Fatalf("start code emulated in % x", unit)
+			}
+			rbsp = append(rbsp, b)
+			if b == 0 {
+				zeros++
+			} else {
+				zeros = 0
+			}
+		}
+		units = append(units, testNALUnit{refIdc: int(unit[0] >> 5), unitType: int(unit[0] & 0x1f), rbsp: rbsp})
+	}
+	return units
+}
+
+func newTestStubEncoder(t *testing.T, settings EncoderSettings) *StubEncoder {
+	t.Helper()
+	encoder, err := NewVideoEncoder(CODEC_ID_H264, nil, settings, logger)
+	if err != nil {
+		t.Fatalf("failed to create the stub encoder: %s", err)
+	}
+	t.Cleanup(encoder.Close)
+	return encoder.(*StubEncoder)
+}
+
+func encodeTestFrame(t *testing.T, encoder VideoEncoder, frameNum int) []testNALUnit {
+	t.Helper()
+	frame, err := encoder.EncodeFrame(frameNum)
+	if err != nil {
+		t.Fatalf("failed to encode frame %d: %s", frameNum, err)
+	}
+	return parseTestFrame(t, frame)
+}
+
+func TestStubEncoderKeyframe(t *testing.T) {
+	// 360 is not a multiple of 16, the SPS has to crop
+	e := newTestStubEncoder(t, EncoderSettings{Width: 640, Height: 360, FPS: 30, GOPSize: 60, Level: 30})
+	units := encodeTestFrame(t, e, 0)
+	if len(units) != 3 || units[0].unitType != h264NALUnitTypeSPS || units[1].unitType != h264NALUnitTypePPS ||
+		units[2].unitType != h264NALUnitTypeIDR {
+		t.Fatalf("keyframe has NAL units %+v, want SPS, PPS and IDR", units)
+	}
+	for _, unit := range units {
+		if unit.refIdc != 3 {
+			t.Errorf("NAL unit %d has nal_ref_idc %d, want 3", unit.unitType, unit.refIdc)
+		}
+	}
+
+	sps := h264BitReader{bytes: units[0].rbsp}
+	if profile, constraints, level := sps.u(8), sps.u(8), sps.u(8); profile != h264ProfileIDCBaseline || constraints != 0xe0 || level != 30 {
+		t.Errorf("SPS of profile %#x, constraints %#x, level %d, want constrained baseline at 30", profile, constraints, level)
+	}
+	if id := sps.ue(); id != 0 {
+		t.Errorf("seq_parameter_set_id %d", id)
+	}
+	frameNumBits, pocType, pocBits := sps.ue()+4, sps.ue(), sps.ue()+4
+	if frameNumBits != stubFrameNumBits || pocType != 0 || pocBits != stubPicOrderCntLsbBits {
+		t.Errorf("frame_num of %d bits, pic_order_cnt_type %d of %d bits", frameNumBits, pocType, pocBits)
+	}
+	if refFrames, gaps := sps.ue(), sps.u(1); refFrames != 1 || gaps != 0 {
+		t.Errorf("%d reference frames, gaps %d", refFrames, gaps)
+	}
+	widthMbs, heightMbs := sps.ue()+1, sps.ue()+1
+	if widthMbs != 40 || heightMbs != 23 {
+		t.Errorf("%dx%d macroblocks, want 40x23", widthMbs, heightMbs)
+	}
+	if frameMbsOnly, direct8x8 := sps.u(1), sps.u(1); frameMbsOnly != 1 || direct8x8 != 1 {
+		t.Errorf("frame_mbs_only_flag %d, direct_8x8_inference_flag %d", frameMbsOnly, direct8x8)
+	}
+	if cropping := sps.u(1); cropping != 1 {
+		t.Fatal("no frame cropping for 360 lines")
+	}
+	if left, right, top, bottom := sps.ue(), sps.ue(), sps.ue(), sps.ue(); left != 0 || right != 0 || top != 0 || bottom != 4 {
+		t.Errorf("cropped by %d, %d, %d, %d, want 4 at the bottom", left, right, top, bottom)
+	}
+	if vui := sps.u(1); vui != 0 || sps.moreData() {
+		t.Error("SPS does not end after vui_parameters_present_flag")
+	}
+
+	pps := h264BitReader{bytes: units[1].rbsp}
+	for i, name := range []string{"pic_parameter_set_id", "seq_parameter_set_id"} {
+		if value := pps.ue(); value != 0 {
+			t.Errorf("PPS field %d %s is %d", i, name, value)
+		}
+	}
+	if entropy := pps.u(1); entropy != 0 {
+		t.Error("PPS is not CAVLC")
+	}
+
+	idr := h264BitReader{bytes: units[2].rbsp}
+	if first, sliceType, ppsID := idr.ue(), idr.ue(), idr.ue(); first != 0 || sliceType != h264SliceTypeI || ppsID != 0 {
+		t.Errorf("IDR slice starts at %d with type %d and PPS %d", first, sliceType, ppsID)
+	}
+	if frameNum, idrPicID, poc := idr.u(stubFrameNumBits), idr.ue(), idr.u(stubPicOrderCntLsbBits); frameNum != 0 || idrPicID != 0 || poc != 0 {
+		t.Errorf("IDR slice has frame_num %d, idr_pic_id %d, pic_order_cnt_lsb %d", frameNum, idrPicID, poc)
+	}
+	idr.u(2)
+	if qpDelta := idr.se(); qpDelta != 0 {
+		t.Errorf("slice_qp_delta %d", qpDelta)
+	}
+	for mb := 0; mb < widthMbs*heightMbs; mb++ {
+		mbType, chroma, qpDelta, coeffToken := idr.ue(), idr.ue(), idr.se(), idr.u(1)
+		if mbType != h264MbTypeI16x16DC || chroma != 0 || qpDelta != 0 || coeffToken != 1 {
+			t.Fatalf("macroblock %d is %d, %d, %d, %d", mb, mbType, chroma, qpDelta, coeffToken)
+		}
+	}
+	if idr.moreData() {
+		t.Error("IDR slice goes on after the last macroblock")
+	}
+}
+
+func TestStubEncoderSkippedFrames(t *testing.T) {
+	e := newTestStubEncoder(t, EncoderSettings{Width: 320, Height: 240, FPS: 30, GOPSize: 60})
+	encodeTestFrame(t, e, 0)
+	for frameNum := 1; frameNum < 4; frameNum++ {
+		units := encodeTestFrame(t, e, frameNum)
+		if len(units) != 1 || units[0].unitType != h264NALUnitTypeSlice || units[0].refIdc != 0 {
+			t.Fatalf("frame %d has NAL units %+v, want one non reference slice", frameNum, units)
+		}
+		slice := h264BitReader{bytes: units[0].rbsp}
+		if first, sliceType, ppsID := slice.ue(), slice.ue(), slice.ue(); first != 0 || sliceType != h264SliceTypeP || ppsID != 0 {
+			t.Errorf("frame %d starts at %d with type %d and PPS %d", frameNum, first, sliceType, ppsID)
+		}
+		if frameNumField, poc := slice.u(stubFrameNumBits), slice.u(stubPicOrderCntLsbBits); frameNumField != 1 || poc != 2*frameNum {
+			t.Errorf("frame %d has frame_num %d and pic_order_cnt_lsb %d", frameNum, frameNumField, poc)
+		}
+		slice.u(2)
+		slice.se()
+		if skipped := slice.ue(); skipped != 20*15 {
+			t.Errorf("frame %d skips %d macroblocks, want 300", frameNum, skipped)
+		}
+		if slice.moreData() {
+			t.Errorf("frame %d goes on after mb_skip_run", frameNum)
+		}
+	}
+}
+
+func TestStubEncoderKeyframeInterval(t *testing.T) {
+	e := newTestStubEncoder(t, EncoderSettings{Width: 320, Height: 240, FPS: 30, GOPSize: 3})
+	var keyframes []int
+	for frameNum := 0; frameNum < 7; frameNum++ {
+		if encodeTestFrame(t, e, frameNum)[0].unitType == h264NALUnitTypeSPS {
+			keyframes = append(keyframes, frameNum)
+		}
+	}
+	if len(keyframes) != 3 || keyframes[1] != 3 || keyframes[2] != 6 {
+		t.Errorf("keyframes at %v, want 0, 3 and 6", keyframes)
+	}
+
+	e.RequestKeyframe()
+	e.RequestKeyframe()
+	if units := encodeTestFrame(t, e, 7); units[0].unitType != h264NALUnitTypeSPS {
+		t.Error("no keyframe after RequestKeyframe")
+	}
+	if units := encodeTestFrame(t, e, 8); units[0].unitType == h264NALUnitTypeSPS {
+		t.Error("coalesced requests gave a second keyframe")
+	}
+	idr := h264BitReader{bytes: encodeTestFrameAfterRequest(t, e, 9)}
+	idr.ue()
+	idr.ue()
+	idr.ue()
+	idr.u(stubFrameNumBits)
+	if idrPicID := idr.ue(); idrPicID != 4 {
+		t.Errorf("fifth IDR frame has idr_pic_id %d, want 4", idrPicID)
+	}
+}
+
+func encodeTestFrameAfterRequest(t *testing.T, e VideoEncoder, frameNum int) []byte {
+	t.Helper()
+	e.RequestKeyframe()
+	units := encodeTestFrame(t, e, frameNum)
+	return units[len(units)-1].rbsp
+}
+
+func TestStubEncoderLevel1b(t *testing.T) {
+	e := newTestStubEncoder(t, EncoderSettings{Width: 176, Height: 144, FPS: 15, GOPSize: 30, Level: h264LevelIDC1b})
+	sps := h264BitReader{bytes: encodeTestFrame(t, e, 0)[0].rbsp}
+	sps.u(8)
+	if constraints, level := sps.u(8), sps.u(8); constraints != 0xe0|h264ConstraintSet3 || level != 11 {
+		t.Errorf("level 1b written as constraints %#x and level %d", constraints, level)
+	}
+}
+
+func TestStubEncoderRejects(t *testing.T) {
+	if _, err := NewVideoEncoder(CODEC_ID_VP8, nil, EncoderSettings{Width: 320, Height: 240, FPS: 30, GOPSize: 30}, logger); err == nil {
+		t.Error("stub encoder took VP8")
+	}
+	if _, err := NewVideoEncoder(CODEC_ID_H264, nil, EncoderSettings{Width: 321, Height: 240, FPS: 30, GOPSize: 30}, logger); err == nil {
+		t.Error("stub encoder took an odd width")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/ghettovoice/gosip/sip"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// time left for the BYE transaction and the HTTP servers once the drain deadline has passed
+const shutdownGracePeriod = time.Second * 5
+
+// hangUp plays the goodbye prompt, sends BYE when the call came over SIP and closes the call
+func (sc *ServerContext) hangUp(ctx context.Context, call *ActiveCall, goodbye *audioPrompt) {
+	call.vmi.PlayGoodbye(ctx, goodbye)
+
+	if call.dialog != nil {
+		// the caller should learn that we are gone even if the goodbye used up the drain deadline
+		byeCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+		if bye, err := call.dialog.newRequest(sip.BYE); err != nil {
+			call.log.Errorf("Failed to build BYE: %s", err)
+		} else if response, err := sc.sipServer.RequestWithContext(byeCtx, bye); err != nil {
+			call.log.Warnf("BYE failed: %s", err)
+		} else {
+			call.log.Infof("BYE answered with %d %s", response.StatusCode(), response.Reason())
+		}
+	}
+
+	call.vmi.Close()
+}
+
+// Shutdown stops taking calls, hangs up the ones in progress and waits up to drainTimeout for them to end.
+// Calls still running after that are cut. The HTTP and SIP servers are shut down last
+func (sc *ServerContext) Shutdown(drainTimeout time.Duration) {
+	sc.callAdmission.StopAdmitting()
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+
+	goodbye := sc.currentState().vmr.goodbyePrompt
+	calls := sc.calls.Snapshot()
+	logger.Infof("Hanging up %d calls, waiting up to %s", len(calls), drainTimeout)
+
+	var wg sync.WaitGroup
+	for _, call := range calls {
+		wg.Add(1)
+		go func(call *ActiveCall) {
+			defer wg.Done()
+			sc.hangUp(drainCtx, call, goodbye)
+		}(call)
+	}
+	wg.Wait()
+
+	// calls admitted right before StopAdmitting may have registered after the snapshot
+	if err := sc.calls.WaitEmpty(drainCtx); err != nil {
+		remaining := sc.calls.Snapshot()
+		logger.Warnf("Drain timed out, cutting %d calls", len(remaining))
+		for _, call := range remaining {
+			call.vmi.Close()
+		}
+	}
+	logger.Info("All calls ended")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	for _, server := range []*http.Server{sc.httpServer, sc.adminServer} {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Failed to shut down HTTP server on %s: %s", server.Addr, err)
+		}
+	}
+
+	if sc.sipServer != nil {
+		sc.sipServer.Shutdown()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pion/ice/v3"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v4"
+)
+
+// by default all calls share one UDP port, demultiplexed by ICE ufrag, so a single firewall rule is enough.
+// setting ice.udpMuxPort to 0 switches to a dedicated ephemeral port per peer connection instead
+const (
+	defaultICEUDPMuxPort = 10000
+	defaultICEUDPPortMin = 10000
+	defaultICEUDPPortMax = 20000
+	iceUDPMuxLoggerScope = "ice-udp-mux"
+)
+
+type ICETransportSettings struct {
+	udpMuxPort int
+	udpPortMin int
+	udpPortMax int
+}
+
+func iceTransportSettingsFromConfig(c ICEConfig) ICETransportSettings {
+	return ICETransportSettings{
+		udpMuxPort: c.UDPMuxPort,
+		udpPortMin: c.UDPPortMin,
+		udpPortMax: c.UDPPortMax,
+	}
+}
+
+func (s ICETransportSettings) useUDPMux() bool {
+	return s.udpMuxPort > 0
+}
+
+// newICEUDPMux opens the shared UDP mux. It returns nil when a port range is configured
+func newICEUDPMux(settings ICETransportSettings, loggerFactory logging.LoggerFactory) (ice.UDPMux, error) {
+	if !settings.useUDPMux() {
+		logger.Infof("ICE uses ephemeral UDP ports %d-%d", settings.udpPortMin, settings.udpPortMax)
+		return nil, nil
+	}
+
+	udpMux, err := ice.NewMultiUDPMuxFromPort(
+		settings.udpMuxPort,
+		ice.UDPMuxFromPortWithLogger(loggerFactory.NewLogger(iceUDPMuxLoggerScope)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for ICE on UDP port %d: %w", settings.udpMuxPort, err)
+	}
+	logger.Infof("ICE uses UDP mux on port %d", settings.udpMuxPort)
+	return udpMux, nil
+}
+
+// udpMux is nil when the port range should be used
+func (s ICETransportSettings) applyTo(settingEngine *webrtc.SettingEngine, udpMux ice.UDPMux) {
+	if udpMux != nil {
+		settingEngine.SetICEUDPMux(udpMux)
+		return
+	}
+	if err := settingEngine.SetEphemeralUDPPortRange(uint16(s.udpPortMin), uint16(s.udpPortMax)); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	xdraw "golang.org/x/image/draw"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// images of the video menu are PNG, JPEG, animated GIF or animated PNG files listed in resources.images. The frames of
+// an animation are composed when loaded, so drawing one is a copy. Scenes draw them scaled to the frame, the scaled
+// images are cached for all calls
+const (
+	// the scaled images the cache keeps, in bytes of pixels. it starts over beyond that
+	scaledImageCacheBytes = 64 << 20
+	// what browsers show frames for that have no or a very short delay
+	defaultAnimationFrameDelay = time.Millisecond * 100
+	minAnimationFrameDelay     = time.Millisecond * 20
+)
+
+// imageAsset is a still image, or the frames of an animation
+type imageAsset struct {
+	frames []*image.RGBA
+	// how long each frame is shown, nil for a still image
+	delays   []time.Duration
+	duration time.Duration
+	// times the animation is played before it stays on the last frame, 0 for ever
+	plays int
+}
+
+// frameAt is the frame shown elapsed after the animation started
+func (a *imageAsset) frameAt(elapsed time.Duration) int {
+	if len(a.frames) == 1 || a.duration <= 0 {
+		return 0
+	}
+	if a.plays > 0 && elapsed >= time.Duration(a.plays)*a.duration {
+		return len(a.frames) - 1
+	}
+	elapsed %= a.duration
+	for i, delay := range a.delays {
+		if elapsed < delay {
+			return i
+		}
+		elapsed -= delay
+	}
+	return len(a.frames) - 1
+}
+
+func newStillImageAsset(img image.Image) *imageAsset {
+	return &imageAsset{frames: []*image.RGBA{toRGBA(img)}}
+}
+
+func (a *imageAsset) addFrame(frame *image.RGBA, delay time.Duration) {
+	if delay < minAnimationFrameDelay {
+		delay = defaultAnimationFrameDelay
+	}
+	a.frames = append(a.frames, frame)
+	a.delays = append(a.delays, delay)
+	a.duration += delay
+}
+
+// toRGBA is a copy of img with its origin at 0, 0
+func toRGBA(img image.Image) *image.RGBA {
+	result := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(result, result.Bounds(), img, img.Bounds().Min, draw.Src)
+	return result
+}
+
+func readImageFile(path string) (*imageAsset, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var asset *imageAsset
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	switch {
+	case err != nil:
+	case format == "gif":
+		asset, err = decodeGIF(data)
+	case format == "png" && isAnimatedPNG(data):
+		asset, err = decodeAnimatedPNG(data)
+	default:
+		var img image.Image
+		if img, _, err = image.Decode(bytes.NewReader(data)); err == nil {
+			asset = newStillImageAsset(img)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image %s: %w", path, err)
+	}
+	return asset, nil
+}
+
+func decodeGIF(data []byte) (*imageAsset, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 1 {
+		return newStillImageAsset(g.Image[0]), nil
+	}
+
+	// LoopCount 0 is for ever, -1 once, anything else that many times more
+	asset := &imageAsset{plays: g.LoopCount + 1}
+	if g.LoopCount == 0 {
+		asset.plays = 0
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = toRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		asset.addFrame(toRGBA(canvas), time.Duration(g.Delay[i])*time.Millisecond*10)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return asset, nil
+}
+
+// the chunks of an animated PNG, see https://wiki.mozilla.org/APNG_Specification
+const (
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendOver         = 1
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type pngChunk struct {
+	chunkType string
+	data      []byte
+}
+
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a PNG file")
+	}
+	var chunks []pngChunk
+	for rest := data[len(pngSignature):]; len(rest) > 0; {
+		if len(rest) < 12 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(rest))
+		if length > len(rest)-12 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunks = append(chunks, pngChunk{chunkType: string(rest[4:8]), data: rest[8 : 8+length]})
+		rest = rest[12+length:]
+	}
+	return chunks, nil
+}
+
+func appendPNGChunk(out []byte, chunkType string, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	start := len(out)
+	out = append(out, chunkType...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// isAnimatedPNG is true for PNG files with an acTL chunk, image/png decodes only their default image
+func isAnimatedPNG(data []byte) bool {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return false
+	}
+	for _, chunk := range chunks {
+		switch chunk.chunkType {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+	}
+	return false
+}
+
+// apngFrame is a frame control chunk and the image data that follows it
+type apngFrame struct {
+	width, height, x, y int
+	delay               time.Duration
+	dispose, blend      byte
+	data                [][]byte
+}
+
+// decodeAnimatedPNG decodes every frame as a PNG file of its own: the header of the animation with the size of the
+// frame, the chunks before the image data like the palette, and the image data of the frame
+func decodeAnimatedPNG(data []byte) (*imageAsset, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var header []byte
+	var shared []pngChunk
+	var frames []*apngFrame
+	asset := &imageAsset{}
+	seenImageData := false
+	for _, chunk := range chunks {
+		switch chunk.chunkType {
+		case "IHDR":
+			header = chunk.data
+		case "acTL":
+			if len(chunk.data) < 8 {
+				return nil, errors.New("bad acTL chunk")
+			}
+			asset.plays = int(binary.BigEndian.Uint32(chunk.data[4:]))
+		case "fcTL":
+			if len(chunk.data) < 26 {
+				return nil, errors.New("bad fcTL chunk")
+			}
+			d := chunk.data
+			delayNum, delayDen := binary.BigEndian.Uint16(d[20:]), binary.BigEndian.Uint16(d[22:])
+			if delayDen == 0 {
+				delayDen = 100
+			}
+			frames = append(frames, &apngFrame{
+				width:   int(binary.BigEndian.Uint32(d[4:])),
+				height:  int(binary.BigEndian.Uint32(d[8:])),
+				x:       int(binary.BigEndian.Uint32(d[12:])),
+				y:       int(binary.BigEndian.Uint32(d[16:])),
+				delay:   time.Duration(delayNum) * time.Second / time.Duration(delayDen),
+				dispose: d[24],
+				blend:   d[25],
+			})
+		case "IDAT":
+			seenImageData = true
+			// the default image is the first frame only if a frame control chunk comes before it
+			if len(frames) > 0 {
+				frames[len(frames)-1].data = append(frames[len(frames)-1].data, chunk.data)
+			}
+		case "fdAT":
+			if len(frames) > 0 && len(chunk.data) > 4 {
+				frames[len(frames)-1].data = append(frames[len(frames)-1].data, chunk.data[4:])
+			}
+		case "IEND":
+		default:
+			if !seenImageData {
+				shared = append(shared, chunk)
+			}
+		}
+	}
+	if len(header) < 13 || len(frames) == 0 {
+		return nil, errors.New("animated PNG without frames")
+	}
+
+	width, height := binary.BigEndian.Uint32(header), binary.BigEndian.Uint32(header[4:])
+	canvas := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	for _, frame := range frames {
+		frameHeader := append([]byte{}, header...)
+		binary.BigEndian.PutUint32(frameHeader, uint32(frame.width))
+		binary.BigEndian.PutUint32(frameHeader[4:], uint32(frame.height))
+		file := appendPNGChunk(append([]byte{}, pngSignature...), "IHDR", frameHeader)
+		for _, chunk := range shared {
+			file = appendPNGChunk(file, chunk.chunkType, chunk.data)
+		}
+		file = appendPNGChunk(file, "IDAT", bytes.Join(frame.data, nil))
+		file = appendPNGChunk(file, "IEND", nil)
+		img, err := png.Decode(bytes.NewReader(file))
+		if err != nil {
+			return nil, err
+		}
+
+		region := image.Rect(frame.x, frame.y, frame.x+frame.width, frame.y+frame.height)
+		var previous *image.RGBA
+		if frame.dispose == apngDisposePrevious {
+			previous = toRGBA(canvas)
+		}
+		op := draw.Src
+		if frame.blend == apngBlendOver {
+			op = draw.Over
+		}
+		draw.Draw(canvas, region, img, img.Bounds().Min, op)
+		asset.addFrame(toRGBA(canvas), frame.delay)
+
+		switch frame.dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, region, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = previous
+		}
+	}
+	if len(asset.frames) == 1 {
+		asset.delays, asset.duration = nil, 0
+	}
+	return asset, nil
+}
+
+type scaledImageKey struct {
+	asset *imageAsset
+	frame int
+	size  image.Point
+}
+
+// scaledImageCache keeps frames of assets scaled to the sizes scenes draw them at. the images are shared and must
+// not be modified
+type scaledImageCache struct {
+	mutex  sync.Mutex
+	images map[scaledImageKey]*image.RGBA
+	bytes  int
+}
+
+func newScaledImageCache() *scaledImageCache {
+	return &scaledImageCache{images: make(map[scaledImageKey]*image.RGBA)}
+}
+
+// scaled is frame of asset scaled to size
+func (c *scaledImageCache) scaled(asset *imageAsset, frame int, size image.Point) *image.RGBA {
+	key := scaledImageKey{asset: asset, frame: frame, size: size}
+	c.mutex.Lock()
+	img, cached := c.images[key]
+	c.mutex.Unlock()
+	if cached {
+		return img
+	}
+
+	// scaled without the lock, two calls may do it at the same time. the one that stores it first wins, the other
+	// image is dropped so that every call gets the same one and it is only counted once
+	img = image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	source := asset.frames[frame]
+	xdraw.ApproxBiLinear.Scale(img, img.Bounds(), source, source.Bounds(), draw.Src, nil)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if stored, cached := c.images[key]; cached {
+		return stored
+	}
+	if c.bytes+len(img.Pix) > scaledImageCacheBytes {
+		c.images = make(map[scaledImageKey]*image.RGBA)
+		c.bytes = 0
+	}
+	c.images[key] = img
+	c.bytes += len(img.Pix)
+	return img
+}
+
+// fitInside is the largest rectangle with the aspect ratio of size centered within rect
+func fitInside(size image.Point, rect image.Rectangle) image.Rectangle {
+	if size.X <= 0 || size.Y <= 0 || rect.Empty() {
+		return image.Rectangle{}
+	}
+	width, height := rect.Dx(), rect.Dx()*size.Y/size.X
+	if height > rect.Dy() {
+		width, height = rect.Dy()*size.X/size.Y, rect.Dy()
+	}
+	min := rect.Min.Add(image.Pt((rect.Dx()-width)/2, (rect.Dy()-height)/2))
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(width, height))}
+}
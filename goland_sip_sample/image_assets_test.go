@@ -0,0 +1,57 @@
+package main
+
+import (
+	"image"
+	"sync"
+	"testing"
+)
+
+func TestScaledImageCacheSharesConcurrentScaling(t *testing.T) {
+	cache := newScaledImageCache()
+	asset := &imageAsset{frames: []*image.RGBA{image.NewRGBA(image.Rect(0, 0, 2048, 2048))}}
+	size := image.Pt(1024, 1024)
+
+	const callers = 8
+	images := make([]*image.RGBA, callers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			images[i] = cache.scaled(asset, 0, size)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, img := range images {
+		if img != images[0] {
+			t.Fatalf("caller %d got an image of its own", i)
+		}
+	}
+	if want := 1024 * 1024 * 4; cache.bytes != want {
+		t.Errorf("cache counts %d bytes, want %d", cache.bytes, want)
+	}
+	if cache.scaled(asset, 0, size) != images[0] {
+		t.Error("image not kept")
+	}
+}
+
+func TestFitInside(t *testing.T) {
+	tests := []struct {
+		size image.Point
+		rect image.Rectangle
+		want image.Rectangle
+	}{
+		{image.Pt(200, 100), image.Rect(0, 0, 100, 100), image.Rect(0, 25, 100, 75)},
+		{image.Pt(100, 200), image.Rect(10, 10, 110, 110), image.Rect(35, 10, 85, 110)},
+		{image.Pt(0, 100), image.Rect(0, 0, 100, 100), image.Rectangle{}},
+	}
+	for _, test := range tests {
+		if got := fitInside(test.size, test.rect); got != test.want {
+			t.Errorf("%v inside %v is %v, want %v", test.size, test.rect, got, test.want)
+		}
+	}
+}
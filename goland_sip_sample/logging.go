@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/pion/logging"
+	"github.com/sirupsen/logrus"
+	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+	stdlog "log"
+)
+
+// everything is logged through logger: our own code, gosip, pion and the standard log package.
+// lines that belong to a call carry these fields so that one call can be grepped out of a busy log
+const (
+	logFieldCallID     = "call_id"
+	logFieldSessionID  = "session_id"
+	logFieldRemoteAddr = "remote_addr"
+	logFieldPionScope  = "scope"
+	logFieldBroadcast  = "broadcast"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logTimestampFormat = "2006-01-02 15:04:05.000"
+)
+
+var (
+	logrusLogger *logrus.Logger
+	logger       log.Logger
+)
+
+func init() {
+	logrusLogger = logrus.New()
+	logrusLogger.SetFormatter(newLogFormatter(logFormatText))
+	logger = log.NewLogrusLogger(logrusLogger, "Server", nil)
+
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logrusLogger.WriterLevel(logrus.InfoLevel))
+}
+
+func newLogFormatter(format string) logrus.Formatter {
+	if format == logFormatJSON {
+		return &logrus.JSONFormatter{TimestampFormat: logTimestampFormat}
+	}
+	return &prefixed.TextFormatter{
+		FullTimestamp:   true,
+		TimestampFormat: logTimestampFormat,
+	}
+}
+
+// configureLogging applies level and format, on startup and on reload. they are validated by Config.Validate
+func configureLogging(loggingConfig LoggingConfig) {
+	level, _ := logrus.ParseLevel(loggingConfig.Level)
+	logrusLogger.SetLevel(level)
+	logrusLogger.SetFormatter(newLogFormatter(loggingConfig.Format))
+}
+
+// newSessionID tells apart the voice menu instances of calls that share a Call-ID, like a retried INVITE
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newCallLogger is the logger for everything that happens within one call
+func newCallLogger(callID string, remoteAddr string) log.Logger {
+	return logger.WithFields(log.Fields{
+		logFieldCallID:     callID,
+		logFieldSessionID:  newSessionID(),
+		logFieldRemoteAddr: remoteAddr,
+	})
+}
+
+// pionLoggerFactory hands pion loggers that write to logger, filtered by the per scope levels from the configuration.
+// levels are validated by Config.Validate
+func pionLoggerFactory(loggingConfig LoggingConfig) logging.LoggerFactory {
+	defaultLevel, _ := parsePionLogLevel(loggingConfig.PionLevel)
+	scopeLevels := make(map[string]logging.LogLevel)
+	for scope, level := range loggingConfig.PionScopeLevels {
+		scopeLevels[scope], _ = parsePionLogLevel(level)
+	}
+	return &pionLogrusLoggerFactory{
+		defaultLevel: defaultLevel,
+		scopeLevels:  scopeLevels,
+	}
+}
+
+type pionLogrusLoggerFactory struct {
+	defaultLevel logging.LogLevel
+	scopeLevels  map[string]logging.LogLevel
+}
+
+func (f *pionLogrusLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	level, present := f.scopeLevels[scope]
+	if !present {
+		level = f.defaultLevel
+	}
+	return &pionLogrusLogger{
+		level: level,
+		log:   logger.WithPrefix("pion").WithFields(log.Fields{logFieldPionScope: scope}),
+	}
+}
+
+// pionLogrusLogger drops what is below the pion level of its scope, the rest is also subject to the logrus level
+type pionLogrusLogger struct {
+	level logging.LogLevel
+	log   log.Logger
+}
+
+func (l *pionLogrusLogger) enabled(level logging.LogLevel) bool {
+	return l.level >= level
+}
+
+func (l *pionLogrusLogger) Trace(msg string) {
+	if l.enabled(logging.LogLevelTrace) {
+		l.log.Trace(msg)
+	}
+}
+
+func (l *pionLogrusLogger) Tracef(format string, args ...interface{}) {
+	if l.enabled(logging.LogLevelTrace) {
+		l.log.Tracef(format, args...)
+	}
+}
+
+func (l *pionLogrusLogger) Debug(msg string) {
+	if l.enabled(logging.LogLevelDebug) {
+		l.log.Debug(msg)
+	}
+}
+
+func (l *pionLogrusLogger) Debugf(format string, args ...interface{}) {
+	if l.enabled(logging.LogLevelDebug) {
+		l.log.Debugf(format, args...)
+	}
+}
+
+func (l *pionLogrusLogger) Info(msg string) {
+	if l.enabled(logging.LogLevelInfo) {
+		l.log.Info(msg)
+	}
+}
+
+func (l *pionLogrusLogger) Infof(format string, args ...interface{}) {
+	if l.enabled(logging.LogLevelInfo) {
+		l.log.Infof(format, args...)
+	}
+}
+
+func (l *pionLogrusLogger) Warn(msg string) {
+	if l.enabled(logging.LogLevelWarn) {
+		l.log.Warn(msg)
+	}
+}
+
+func (l *pionLogrusLogger) Warnf(format string, args ...interface{}) {
+	if l.enabled(logging.LogLevelWarn) {
+		l.log.Warnf(format, args...)
+	}
+}
+
+func (l *pionLogrusLogger) Error(msg string) {
+	if l.enabled(logging.LogLevelError) {
+		l.log.Error(msg)
+	}
+}
+
+func (l *pionLogrusLogger) Errorf(format string, args ...interface{}) {
+	if l.enabled(logging.LogLevelError) {
+		l.log.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"time"
+)
+
+const (
+	// what pion uses for the tracks it packetizes itself
+	rtpOutboundMTU = 1200
+
+	videoClockRate = 90000
+	audioClockRate = 48000
+)
+
+// mediaClock is the time base of all tracks of a call. RTP timestamps count from its origin, so the sender reports
+// pion sends for each track map them to the same wall clock and the receiver can play audio and video in sync
+type mediaClock struct {
+	// carries the monotonic clock reading, so changes of the wall clock do not matter
+	origin time.Time
+}
+
+func newMediaClock() *mediaClock {
+	return &mediaClock{origin: time.Now()}
+}
+
+// ticks is the time from the origin to t in units of clockRate. it wraps around like RTP timestamps do
+func (c *mediaClock) ticks(t time.Time, clockRate uint32) uint32 {
+	elapsed := t.Sub(c.origin)
+	if elapsed < 0 {
+		return 0
+	}
+	return uint32(uint64(elapsed) * uint64(clockRate) / uint64(time.Second))
+}
+
+// clockedTrack sends frames with RTP timestamps from the media clock of the call. TrackLocalStaticSample can not,
+// it makes up timestamps by adding up the durations of samples from a random start
+type clockedTrack struct {
+	track      *webrtc.TrackLocalStaticRTP
+	packetizer rtp.Packetizer
+	clock      *mediaClock
+	clockRate  uint32
+	// random start of the timestamps, RFC 3550 5.1
+	timestampOffset uint32
+}
+
+func newClockedTrack(
+	codecCapability webrtc.RTPCodecCapability,
+	id string,
+	streamId string,
+	payloader rtp.Payloader,
+	clock *mediaClock) (*clockedTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codecCapability, id, streamId)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset [4]byte
+	if _, err := rand.Read(offset[:]); err != nil {
+		return nil, err
+	}
+
+	return &clockedTrack{
+		track: track,
+		// payload type and SSRC are set by the track for the peer connection it is bound to
+		packetizer:      rtp.NewPacketizer(rtpOutboundMTU, 0, 0, payloader, rtp.NewRandomSequencer(), codecCapability.ClockRate),
+		clock:           clock,
+		clockRate:       codecCapability.ClockRate,
+		timestampOffset: binary.BigEndian.Uint32(offset[:]),
+	}, nil
+}
+
+// timestampAt is the media clock at t in units of the clock rate of the track
+func (t *clockedTrack) timestampAt(at time.Time) uint32 {
+	return t.clock.ticks(at, t.clockRate)
+}
+
+// writeFrame packetizes one encoded frame, all its packets carry timestamp, see timestampAt.
+// the packetizer is not safe for concurrent use, frames of a track have to be written from one goroutine at a time
+func (t *clockedTrack) writeFrame(frame []byte, timestamp uint32) error {
+	for _, packet := range t.packetizer.Packetize(frame, 0) {
+		packet.Timestamp = t.timestampOffset + timestamp
+		if err := t.track.WriteRTP(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+)
+
+// metrics are served on the admin listener at /metrics
+const metricsNamespace = "voice_menu"
+
+var (
+	sipInvitesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sip_invites_total",
+		Help:      "INVITEs answered, by response code.",
+	}, []string{"code"})
+
+	activeCalls = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_calls",
+		Help:      "Calls in progress, from SIP and from the web client.",
+	})
+
+	callDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "call_duration_seconds",
+		Help:      "Duration of ended calls.",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	})
+
+	iceConnectedSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ice_connected_seconds",
+		Help:      "Time from creating the peer connection until ICE is connected.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+
+	encoderFrameSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "encoder_frame_seconds",
+		Help:      "Time to scale and encode one video frame.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+
+	videoRenderSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "video_render_seconds",
+		Help:      "Time to draw one video frame.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+
+	videoFrameDelaySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "video_frame_delay_seconds",
+		Help:      "Time from the tick a video frame is rendered for until it is sent, rendering, encoding and queueing included.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+
+	videoRepaintedRatio = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "video_repainted_ratio",
+		Help:      "Share of a video frame painted again because the scene changed there, 0 when it did not change.",
+		Buckets:   []float64{0, 0.01, 0.05, 0.2, 0.5, 1},
+	})
+
+	videoFramesDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "video_frames_dropped_total",
+		Help:      "Video frames dropped because the encoder, or with video.broadcast a call, was behind.",
+	})
+
+	videoEncodersOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "video_encoders_open",
+		Help:      "Video encoders created and not closed yet. Back to 0 without calls, otherwise encoders leak.",
+	})
+
+	videoFramesNotEncodedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "video_frames_not_encoded_total",
+		Help:      "Frames given to the encoder that produced no packet and were not sent.",
+	})
+
+	audioPagesSentTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audio_pages_sent_total",
+		Help:      "Ogg pages of prompts sent to callers as they are, when audio is not mixed.",
+	})
+
+	audioFramesMixedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audio_frames_mixed_total",
+		Help:      "20 ms frames of mixed audio encoded and sent to callers.",
+	})
+
+	ttsPromptsSynthesizedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tts_prompts_synthesized_total",
+		Help:      "Texts spoken by the speech engine, those taken from its cache are not counted.",
+	})
+
+	rtcpFractionLost = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rtcp_fraction_lost",
+		Help:      "Fraction of packets lost as reported by callers in RTCP receiver reports.",
+		Buckets:   []float64{0, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1},
+	}, []string{"kind"})
+
+	rtcpJitterSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rtcp_jitter_seconds",
+		Help:      "Interarrival jitter as reported by callers in RTCP receiver reports.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 11),
+	}, []string{"kind"})
+
+	dtmfDigitsReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dtmf_digits_received_total",
+		Help:      "DTMF digits received as RFC 4733 telephone events.",
+	}, []string{"digit"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		sipInvitesTotal,
+		activeCalls,
+		callDurationSeconds,
+		iceConnectedSeconds,
+		encoderFrameSeconds,
+		videoRenderSeconds,
+		videoRepaintedRatio,
+		videoFrameDelaySeconds,
+		videoFramesDroppedTotal,
+		videoEncodersOpen,
+		videoFramesNotEncodedTotal,
+		audioPagesSentTotal,
+		audioFramesMixedTotal,
+		ttsPromptsSynthesizedTotal,
+		rtcpFractionLost,
+		rtcpJitterSeconds,
+		dtmfDigitsReceivedTotal,
+	)
+}
+
+func countInviteResponse(code int) {
+	sipInvitesTotal.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func observeReceptionReport(kind string, fractionLost float64, jitterSeconds float64) {
+	rtcpFractionLost.WithLabelValues(kind).Observe(fractionLost)
+	rtcpJitterSeconds.WithLabelValues(kind).Observe(jitterSeconds)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// calls get Opus at 48 kHz in stereo, see initAudioTrack. Mixed audio is made of 20 ms frames of interleaved 16 bit
+// samples, one Opus packet each, the same duration the Ogg pages of the prompts have
+const (
+	audioChannels = 2
+	// per channel
+	audioFrameSamples = audioClockRate * int(audioOggPageDuration) / int(time.Second)
+	audioFrameLength  = audioFrameSamples * audioChannels
+)
+
+// AudioEncoder turns mixed audio into Opus packets. Like the VideoEncoder the backend is chosen at build time:
+// libopus through libavcodec by default (opus_ffmpeg.go), while -tags stubencoder has none (opus_stub.go) and calls
+// get the Ogg pages of the prompts as they are. Each backend provides audioMixingSupported, NewAudioEncoder and
+// decodeOpus.
+//
+// An encoder is used from one goroutine at a time
+type AudioEncoder interface {
+	// Encode encodes audioFrameLength interleaved samples. packet is nil when the encoder held the frame back
+	Encode(pcm []int16) (packet []byte, err error)
+	// Close releases all the encoder allocated, closing twice does nothing
+	Close()
+}
+
+// isOpusHeaderPage tells the OpusHead and OpusTags pages an Ogg file starts with from audio
+func isOpusHeaderPage(page OggAudioPage) bool {
+	return bytes.HasPrefix(page.pageData, []byte("OpusHead")) || bytes.HasPrefix(page.pageData, []byte("OpusTags"))
+}
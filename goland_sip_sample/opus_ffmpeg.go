@@ -0,0 +1,220 @@
+//go:build !stubencoder
+
+package main
+
+// #include <stdlib.h>
+// #include <libavcodec/avcodec.h>
+// #include <libavutil/channel_layout.h>
+// #include <libavutil/samplefmt.h>
+//
+// // defined in encode_ffmpeg.go
+// extern int FFMPEG_WAIT_FOR_INPUT_AVERROR;
+// extern int FFMPEG_END_OF_STREAM_AVERROR;
+import "C"
+import (
+	"errors"
+	"fmt"
+	"github.com/ghettovoice/gosip/log"
+	"unsafe"
+)
+
+// prompts are decoded with the native Opus decoder of libavcodec, the mix is encoded with libopus, which ffmpeg has
+// to be built with
+const libopusEncoderName = "libopus"
+
+func findLibopus() *C.AVCodec {
+	name := C.CString(libopusEncoderName)
+	defer C.free(unsafe.Pointer(name))
+	return C.avcodec_find_encoder_by_name(name)
+}
+
+func audioMixingSupported() bool {
+	return findLibopus() != nil && C.avcodec_find_decoder(C.AV_CODEC_ID_OPUS) != nil
+}
+
+// channels and channel_layout are gone since FFmpeg 7, the layout is set with ch_layout
+func setAudioFormat(avContext *C.AVCodecContext) {
+	avContext.sample_rate = audioClockRate
+	C.av_channel_layout_default(&avContext.ch_layout, audioChannels)
+	avContext.time_base = C.AVRational{1, audioClockRate}
+}
+
+// OpusEncoder is the libopus AudioEncoder
+type OpusEncoder struct {
+	_context *C.AVCodecContext
+	_frame   *C.AVFrame
+	_packet  *C.AVPacket
+	// in samples
+	_pts int64
+	_log log.Logger
+}
+
+// NewAudioEncoder creates a libopus encoder for 20 ms frames at bitrate
+func NewAudioEncoder(bitrate int, encoderLogger log.Logger) (AudioEncoder, error) {
+	codec := findLibopus()
+	if codec == nil {
+		return nil, errors.New("could not find libopus, ffmpeg has to be built with it")
+	}
+	avContext := C.avcodec_alloc_context3(codec)
+	setAudioFormat(avContext)
+	avContext.sample_fmt = C.AV_SAMPLE_FMT_S16
+	avContext.bit_rate = C.int64_t(bitrate)
+	// voip would band limit the music
+	setPrivateOption(avContext, "application", "audio")
+	setPrivateOption(avContext, "frame_duration", "20")
+	if C.avcodec_open2(avContext, codec, nil) < 0 {
+		C.avcodec_free_context(&avContext)
+		return nil, errors.New("could not open libopus")
+	}
+	if frameSize := int(avContext.frame_size); frameSize != audioFrameSamples {
+		C.avcodec_free_context(&avContext)
+		return nil, fmt.Errorf("libopus takes frames of %d samples, expected %d", frameSize, audioFrameSamples)
+	}
+
+	avFrame := C.av_frame_alloc()
+	avFrame.nb_samples = C.int(audioFrameSamples)
+	avFrame.format = C.AV_SAMPLE_FMT_S16
+	C.av_channel_layout_default(&avFrame.ch_layout, audioChannels)
+	avFrame.sample_rate = audioClockRate
+	if C.av_frame_get_buffer(avFrame, 0) < 0 {
+		C.av_frame_free(&avFrame)
+		C.avcodec_free_context(&avContext)
+		return nil, errors.New("could not allocate an audio frame")
+	}
+	encoderLogger.Debugf("Opus encoder at %d bit/s", bitrate)
+	return &OpusEncoder{
+		_context: avContext,
+		_frame:   avFrame,
+		_packet:  C.av_packet_alloc(),
+		_log:     encoderLogger,
+	}, nil
+}
+
+func (e *OpusEncoder) Encode(pcm []int16) ([]byte, error) {
+	if e._context == nil {
+		return nil, errors.New("encoder is closed")
+	}
+	if C.av_frame_make_writable(e._frame) < 0 {
+		return nil, errors.New("failed to call av_frame_make_writable")
+	}
+	copy(unsafe.Slice((*int16)(unsafe.Pointer(e._frame.data[0])), audioFrameLength), pcm)
+	e._frame.pts = C.int64_t(e._pts)
+	e._pts += int64(audioFrameSamples)
+
+	if result := C.avcodec_send_frame(e._context, e._frame); result != 0 {
+		return nil, fmt.Errorf("failed to call avcodec_send_frame: %d", result)
+	}
+	result := C.avcodec_receive_packet(e._context, e._packet)
+	if result == C.FFMPEG_WAIT_FOR_INPUT_AVERROR {
+		return nil, nil
+	}
+	if result != 0 {
+		return nil, fmt.Errorf("failed to call avcodec_receive_packet: %d", result)
+	}
+	packet := C.GoBytes(unsafe.Pointer(e._packet.data), e._packet.size)
+	C.av_packet_unref(e._packet)
+	return packet, nil
+}
+
+// Close drops what libopus held back, a call does not end on a frame boundary anyway
+func (e *OpusEncoder) Close() {
+	if e._context == nil {
+		return
+	}
+	C.avcodec_free_context(&e._context)
+	C.av_frame_free(&e._frame)
+	C.av_packet_free(&e._packet)
+}
+
+// decodeOpus decodes the pages of an Ogg/Opus file to interleaved stereo. Every page has to hold a single packet,
+// as opusenc and ffmpeg write them for prompts of 20 ms frames
+func decodeOpus(pages []OggAudioPage) ([]int16, error) {
+	codec := C.avcodec_find_decoder(C.AV_CODEC_ID_OPUS)
+	if codec == nil {
+		return nil, errors.New("could not find the Opus decoder")
+	}
+	avContext := C.avcodec_alloc_context3(codec)
+	defer C.avcodec_free_context(&avContext)
+	setAudioFormat(avContext)
+	if C.avcodec_open2(avContext, codec, nil) < 0 {
+		return nil, errors.New("could not open the Opus decoder")
+	}
+	packet := C.av_packet_alloc()
+	defer C.av_packet_free(&packet)
+	frame := C.av_frame_alloc()
+	defer C.av_frame_free(&frame)
+
+	var pcm []int16
+	receive := func() error {
+		for {
+			result := C.avcodec_receive_frame(avContext, frame)
+			if result == C.FFMPEG_WAIT_FOR_INPUT_AVERROR || result == C.FFMPEG_END_OF_STREAM_AVERROR {
+				return nil
+			}
+			if result != 0 {
+				return fmt.Errorf("failed to call avcodec_receive_frame: %d", result)
+			}
+			var err error
+			pcm, err = appendFrameSamples(pcm, frame)
+			C.av_frame_unref(frame)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, page := range pages {
+		if isOpusHeaderPage(page) || len(page.pageData) == 0 {
+			continue
+		}
+		if C.av_new_packet(packet, C.int(len(page.pageData))) < 0 {
+			return nil, errors.New("failed to call av_new_packet")
+		}
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(packet.data)), len(page.pageData)), page.pageData)
+		result := C.avcodec_send_packet(avContext, packet)
+		C.av_packet_unref(packet)
+		if result != 0 {
+			return nil, fmt.Errorf("failed to call avcodec_send_packet: %d", result)
+		}
+		if err := receive(); err != nil {
+			return nil, err
+		}
+	}
+	if result := C.avcodec_send_packet(avContext, nil); result != 0 {
+		return nil, fmt.Errorf("failed to call avcodec_send_packet to flush: %d", result)
+	}
+	return pcm, receive()
+}
+
+// appendFrameSamples appends a decoded frame as interleaved stereo, a mono frame goes to both channels
+func appendFrameSamples(pcm []int16, frame *C.AVFrame) ([]int16, error) {
+	samples, channels := int(frame.nb_samples), int(frame.ch_layout.nb_channels)
+	if channels < 1 {
+		return pcm, fmt.Errorf("decoded audio has %d channels", channels)
+	}
+	var sample func(channel int, i int) int16
+	switch frame.format {
+	case C.AV_SAMPLE_FMT_FLTP:
+		sample = func(channel int, i int) int16 {
+			return pcmSample(unsafe.Slice((*float32)(unsafe.Pointer(frame.data[channel])), samples)[i])
+		}
+	case C.AV_SAMPLE_FMT_FLT:
+		interleaved := unsafe.Slice((*float32)(unsafe.Pointer(frame.data[0])), samples*channels)
+		sample = func(channel int, i int) int16 { return pcmSample(interleaved[i*channels+channel]) }
+	case C.AV_SAMPLE_FMT_S16P:
+		sample = func(channel int, i int) int16 {
+			return unsafe.Slice((*int16)(unsafe.Pointer(frame.data[channel])), samples)[i]
+		}
+	case C.AV_SAMPLE_FMT_S16:
+		interleaved := unsafe.Slice((*int16)(unsafe.Pointer(frame.data[0])), samples*channels)
+		sample = func(channel int, i int) int16 { return interleaved[i*channels+channel] }
+	default:
+		return pcm, fmt.Errorf("decoded audio has the unexpected sample format %d", frame.format)
+	}
+	for i := 0; i < samples; i++ {
+		for channel := 0; channel < audioChannels; channel++ {
+			pcm = append(pcm, sample(min(channel, channels-1), i))
+		}
+	}
+	return pcm, nil
+}
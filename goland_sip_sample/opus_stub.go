@@ -0,0 +1,22 @@
+//go:build stubencoder
+
+package main
+
+import (
+	"errors"
+	"github.com/ghettovoice/gosip/log"
+)
+
+var errNoAudioMixing = errors.New("audio mixing needs the libavcodec backend, the stub encoder has no Opus codec")
+
+func audioMixingSupported() bool {
+	return false
+}
+
+func NewAudioEncoder(bitrate int, encoderLogger log.Logger) (AudioEncoder, error) {
+	return nil, errNoAudioMixing
+}
+
+func decodeOpus(pages []OggAudioPage) ([]int16, error) {
+	return nil, errNoAudioMixing
+}
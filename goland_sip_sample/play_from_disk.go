@@ -23,12 +23,13 @@ import (
 // generate audio: ffmpeg -f lavfi -i "sine=frequency=1000:sample_rate=48000:duration=60" \
 // -i "sine=frequency=400:sample_rate=48000:duration=60" \
 // -filter_complex amerge -c:a libopus -page_duration 20000 -vn testsrc.ogg
+// default locations, see PlayFromDiskConfig. README.MD shows how to generate the files
 const (
-	audioFileName   = "/home/topright/tmp/testvid/testsrc.ogg"
-	videoFileName   = "/home/topright/tmp/testvid/testsrc.ivf"
+	audioFileName = "./resources/testsrc.ogg"
+	videoFileName = "./resources/testsrc.ivf"
 )
 
-func startAudioPlayback(audioTrack *webrtc.TrackLocalStaticSample) {
+func startAudioPlayback(audioTrack *webrtc.TrackLocalStaticSample, audioFileName string) {
 	func() {
 		// Open a OGG file and start reading using our OGGReader
 		file, oggErr := os.Open(audioFileName)
@@ -56,7 +57,7 @@ func startAudioPlayback(audioTrack *webrtc.TrackLocalStaticSample) {
 		for ; true; <-ticker.C {
 			pageData, pageHeader, oggErr := ogg.ParseNextPage()
 			if errors.Is(oggErr, io.EOF) {
-				fmt.Printf("All audio pages parsed and sent")
+				logger.Info("All audio pages parsed and sent")
 				break
 				//os.Exit(0)
 			}
@@ -77,7 +78,7 @@ func startAudioPlayback(audioTrack *webrtc.TrackLocalStaticSample) {
 	}()
 }
 
-func startVideoPlayback(videoTrack *webrtc.TrackLocalStaticSample) {
+func startVideoPlayback(videoTrack *webrtc.TrackLocalStaticSample, videoFileName string) {
 	// Open a IVF file and start reading using our IVFReader
 	logger.Info("Openning video file " + videoFileName)
 	file, ivfErr := os.Open(videoFileName)
@@ -109,7 +110,7 @@ func startVideoPlayback(videoTrack *webrtc.TrackLocalStaticSample) {
 	for ; true; <-ticker.C {
 		frame, _, ivfErr := ivf.ParseNextFrame()
 		if errors.Is(ivfErr, io.EOF) {
-			fmt.Printf("All video frames parsed and sent")
+			logger.Info("All video frames parsed and sent")
 			break
 		}
 
@@ -124,9 +125,6 @@ func startVideoPlayback(videoTrack *webrtc.TrackLocalStaticSample) {
 }
 
 func startVideoRender(videoTrack *webrtc.TrackLocalStaticSample) {
-	// Open a IVF file and start reading using our IVFReader
-	logger.Info("Openning video file " + videoFileName)
-
 	fps := 30
 	videoDurationBetweenFrames := float32(1000) / float32(fps)
 	logger.Info("Generating test video. Between frames: ",
@@ -154,7 +152,10 @@ func startVideoRender(videoTrack *webrtc.TrackLocalStaticSample) {
 
 
 // nolint:gocognit
-func connectFromOffer(offerStr string) string {
+func connectFromOffer(offerStr string, files PlayFromDiskConfig) string {
+	audioFileName := files.AudioFile
+	videoFileName := files.VideoFile
+
 	// Assert that we have an audio or video file
 	_, err := os.Stat(videoFileName)
 	haveVideoFile := !os.IsNotExist(err)
@@ -265,7 +266,7 @@ func connectFromOffer(offerStr string) string {
 		// Wait for connection established
 		<-iceConnectedCtx.Done()
 
-		go startVideoPlayback(videoTrack)
+		go startVideoPlayback(videoTrack, videoFileName)
 	}
 
 	if haveAudioFile {
@@ -295,13 +296,13 @@ func connectFromOffer(offerStr string) string {
 		// Wait for connection established
 		<-iceConnectedCtx.Done()
 
-		go startAudioPlayback(audioTrack)
+		go startAudioPlayback(audioTrack, audioFileName)
 	}
 
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		logger.Infof("Connection State has changed %s", connectionState.String())
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			//sleep for 1 sec to wait for the connection to be established
 			time.Sleep(time.Second * time.Duration(2))
@@ -312,18 +313,18 @@ func connectFromOffer(offerStr string) string {
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		fmt.Printf("Peer Connection State has changed: %s\n", s.String())
+		logger.Infof("Peer Connection State has changed: %s", s.String())
 
 		if s == webrtc.PeerConnectionStateFailed {
 			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
 			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
 			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			fmt.Println("Peer Connection has gone to failed exiting")
+			logger.Warn("Peer Connection has gone to failed exiting")
 		}
 
 		if s == webrtc.PeerConnectionStateClosed {
 			// PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
-			fmt.Println("Peer Connection has gone to closed")
+			logger.Info("Peer Connection has gone to closed")
 		}
 	})
 
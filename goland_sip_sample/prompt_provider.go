@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// names of the prompts every menu has, resources.prompts adds more
+const (
+	greetingPromptName     = "greeting"
+	dtmfPromptName         = "dtmf"
+	durationWarnPromptName = "durationWarn"
+	goodbyePromptName      = "goodbye"
+)
+
+var builtinPromptNames = []string{greetingPromptName, dtmfPromptName, durationWarnPromptName, goodbyePromptName}
+
+// PromptProvider turns what a menu says into audio: filePromptProvider by the name of a recorded prompt,
+// ttsPromptProvider by speaking any text, see tts_prompts.go. Prompts are shared between calls and must not
+// be modified
+type PromptProvider interface {
+	// Prompt is the audio for text in voice, an empty voice is the default one. Recorded prompts have no voice
+	Prompt(ctx context.Context, text string, voice string) (*audioPrompt, error)
+}
+
+// filePromptProvider has the prompts read from Ogg/Opus files when the resources are loaded
+type filePromptProvider struct {
+	prompts map[string]*audioPrompt
+}
+
+func (p *filePromptProvider) Prompt(ctx context.Context, name string, voice string) (*audioPrompt, error) {
+	prompt, known := p.prompts[name]
+	if !known {
+		return nil, fmt.Errorf("unknown prompt %q", name)
+	}
+	return prompt, nil
+}
+
+// readPromptFiles reads the prompts of resources.prompts next to the built in ones
+func readPromptFiles(files map[string]string, builtin map[string]*audioPrompt, decode bool) (*filePromptProvider, error) {
+	p := &filePromptProvider{prompts: make(map[string]*audioPrompt)}
+	for name, prompt := range builtin {
+		if prompt != nil {
+			p.prompts[name] = prompt
+		}
+	}
+	for name, path := range files {
+		prompt, err := readAudioPrompt(path, decode)
+		if err != nil {
+			return nil, err
+		}
+		p.prompts[name] = prompt
+	}
+	return p, nil
+}
+
+// playProvided plays what provider has for text. It returns once it is played or ctx is done
+func (vmi *VoiceMenuInstance) playProvided(ctx context.Context, provider PromptProvider, text string, voice string) error {
+	if vmi._audioTrack == nil {
+		return errors.New("the call has no audio")
+	}
+	prompt, err := provider.Prompt(ctx, text, voice)
+	if err != nil {
+		return err
+	}
+	vmi.playPrompt(ctx, prompt)
+	return nil
+}
+
+// PlayPrompt plays the recorded prompt name. It returns once it is played or ctx is done
+func (vmi *VoiceMenuInstance) PlayPrompt(ctx context.Context, name string) error {
+	return vmi.playProvided(ctx, vmi._vmr.recordedPrompts, name, "")
+}
+
+// Say speaks text in voice, the one of tts.voice if empty. Digits, amounts and dates are read as the engine reads
+// them, spokenDigits has digits said one by one. It returns once text is said or ctx is done
+func (vmi *VoiceMenuInstance) Say(ctx context.Context, text string, voice string) error {
+	if vmi._vmr.tts == nil {
+		return errors.New("speaking text needs tts.command and audio.mix")
+	}
+	return vmi.playProvided(ctx, vmi._vmr.tts, text, voice)
+}
+
+// sayDigits says back digits the caller entered
+func (vmi *VoiceMenuInstance) sayDigits(digits string) {
+	if err := vmi.Say(vmi._voiceMenuInstanceContext, "You entered "+spokenDigits(digits), ""); err != nil {
+		vmi._log.Warnf("Failed to say back the digits: %s", err)
+	}
+}
+
+// spokenDigits separates the digits so that they are not read as a number
+func spokenDigits(digits string) string {
+	words := make([]string, 0, len(digits))
+	for _, digit := range digits {
+		switch digit {
+		case '*':
+			words = append(words, "star")
+		case '#':
+			words = append(words, "hash")
+		default:
+			words = append(words, string(digit))
+		}
+	}
+	return strings.Join(words, ", ")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"sync"
+	"time"
+)
+
+// seconds between the NTP epoch 1900 and the unix epoch
+const ntpEpochOffset = 2208988800
+
+// MediaStats is what the caller reports about one stream we send
+type MediaStats struct {
+	PacketsLost     int32   `json:"packetsLost"`
+	FractionLost    float64 `json:"fractionLost"`
+	JitterSeconds   float64 `json:"jitterSeconds"`
+	RTTSeconds      float64 `json:"rttSeconds"`
+	ReceiverReports int     `json:"receiverReports"`
+	NACKs           int     `json:"nacks"`
+	PLIs            int     `json:"plis"`
+	FIRs            int     `json:"firs"`
+}
+
+// CallStats is the RTCP view of one call
+type CallStats struct {
+	ID         string      `json:"id"`
+	RemoteAddr string      `json:"remoteAddr"`
+	StartedAt  time.Time   `json:"startedAt"`
+	Audio      *MediaStats `json:"audio,omitempty"`
+	Video      *MediaStats `json:"video,omitempty"`
+	// REMB from the caller, 0 if it sends none
+	EstimatedBitrate int `json:"estimatedBitrate"`
+	TargetBitrate    int `json:"targetBitrate"`
+}
+
+type rtpStreamStats struct {
+	mutex sync.Mutex
+	stats MediaStats
+}
+
+func (s *rtpStreamStats) snapshot() *MediaStats {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	return &stats
+}
+
+func (s *rtpStreamStats) update(f func(stats *MediaStats)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(&s.stats)
+}
+
+// ntpCompact is the middle 32 bits of the NTP timestamp, the format of LSR and DLSR in reception reports
+func ntpCompact(t time.Time) uint32 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32((seconds<<32 | fraction) >> 16)
+}
+
+// rttFromReport is the round trip time from a sender report we sent to this report (RFC 3550 6.4.1).
+// false if the caller has not seen a sender report from us yet
+func rttFromReport(report rtcp.ReceptionReport, receivedAt time.Time) (time.Duration, bool) {
+	if report.LastSenderReport == 0 {
+		return 0, false
+	}
+	rtt := ntpCompact(receivedAt) - report.LastSenderReport - report.Delay
+	// clock skew or a bogus report would wrap around
+	if rtt > 1<<31 {
+		return 0, false
+	}
+	return time.Duration(float64(rtt) / 65536 * float64(time.Second)), true
+}
+
+func (s *rtpStreamStats) onReceptionReport(report rtcp.ReceptionReport, kind string, clockRate uint32, receivedAt time.Time) {
+	fractionLost := float64(report.FractionLost) / 256
+	jitterSeconds := float64(report.Jitter) / float64(clockRate)
+	rtt, rttKnown := rttFromReport(report, receivedAt)
+
+	s.update(func(stats *MediaStats) {
+		stats.ReceiverReports++
+		stats.PacketsLost = int32(report.TotalLost)
+		stats.FractionLost = fractionLost
+		stats.JitterSeconds = jitterSeconds
+		if rttKnown {
+			stats.RTTSeconds = rtt.Seconds()
+		}
+	})
+	observeReceptionReport(kind, fractionLost, jitterSeconds)
+}
+
+// consumeRTCP reads what the caller sends about the stream of sender until the peer connection is closed
+func (vmi *VoiceMenuInstance) consumeRTCP(sender *webrtc.RTPSender, stats *rtpStreamStats) {
+	kind := sender.Track().Kind()
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		receivedAt := time.Now()
+
+		// parameters are only known once the answer is set, which is long done when the first report arrives
+		parameters := sender.GetParameters()
+		if len(parameters.Encodings) == 0 || len(parameters.Codecs) == 0 {
+			continue
+		}
+		ssrc := uint32(parameters.Encodings[0].SSRC)
+		clockRate := parameters.Codecs[0].ClockRate
+		if clockRate == 0 {
+			continue
+		}
+
+		vmi.onRTCP(packets, ssrc, kind.String(), clockRate, stats, receivedAt)
+	}
+}
+
+// onRTCP takes what the caller sends about the stream with ssrc
+func (vmi *VoiceMenuInstance) onRTCP(packets []rtcp.Packet, ssrc uint32, kind string, clockRate uint32, stats *rtpStreamStats, receivedAt time.Time) {
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.ReceiverReport:
+			for _, report := range p.Reports {
+				if report.SSRC == ssrc {
+					stats.onReceptionReport(report, kind, clockRate, receivedAt)
+				}
+			}
+		case *rtcp.SenderReport:
+			for _, report := range p.Reports {
+				if report.SSRC == ssrc {
+					stats.onReceptionReport(report, kind, clockRate, receivedAt)
+				}
+			}
+		case *rtcp.TransportLayerNack:
+			stats.update(func(stats *MediaStats) { stats.NACKs++ })
+		case *rtcp.PictureLossIndication:
+			stats.update(func(stats *MediaStats) { stats.PLIs++ })
+			vmi.requestKeyframe("PLI")
+		case *rtcp.FullIntraRequest:
+			stats.update(func(stats *MediaStats) { stats.FIRs++ })
+			vmi.requestKeyframe("FIR")
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			vmi._bitrateController.onEstimate(int(p.Bitrate))
+		}
+	}
+}
+
+func (vmi *VoiceMenuInstance) requestKeyframe(reason string) {
+	if vmi._videoTrack == nil {
+		return
+	}
+	vmi._log.Debugf("Keyframe requested by %s", reason)
+	// the encoder is replaced when the video quality changes
+	vmi._connectionReInitMutex.RLock()
+	defer vmi._connectionReInitMutex.RUnlock()
+	if vmi._broadcastSubscriber != nil {
+		vmi._broadcastSubscriber.requestKeyframe()
+	} else if vmi._encoder != nil {
+		vmi._encoder.RequestKeyframe()
+	}
+}
+
+// Stats reports RTCP statistics, without the identity of the call
+func (vmi *VoiceMenuInstance) Stats() CallStats {
+	estimated, target := vmi._bitrateController.bitrates()
+	return CallStats{
+		Audio:            vmi._audioStats.snapshot(),
+		Video:            vmi._videoStats.snapshot(),
+		EstimatedBitrate: estimated,
+		TargetBitrate:    target,
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/pion/rtcp"
+	"testing"
+	"time"
+)
+
+// keyframeCountingEncoder counts RequestKeyframe
+type keyframeCountingEncoder struct {
+	failingEncoder
+	keyframes int
+}
+
+func (e *keyframeCountingEncoder) RequestKeyframe() { e.keyframes++ }
+
+func TestRTTFromReport(t *testing.T) {
+	sentAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// the caller held our sender report for 500 ms before it answered, 800 ms after we sent it
+	report := rtcp.ReceptionReport{LastSenderReport: ntpCompact(sentAt), Delay: 65536 / 2}
+	rtt, known := rttFromReport(report, sentAt.Add(800*time.Millisecond))
+	if !known || rtt < 299*time.Millisecond || rtt > 301*time.Millisecond {
+		t.Errorf("rtt %s, known %t, want 300ms", rtt, known)
+	}
+
+	if _, known := rttFromReport(rtcp.ReceptionReport{}, sentAt); known {
+		t.Error("rtt known without a sender report")
+	}
+	// a delay longer than the time since our sender report would wrap around
+	report.Delay = 65536 * 2
+	if _, known := rttFromReport(report, sentAt.Add(800*time.Millisecond)); known {
+		t.Error("rtt known from a bogus delay")
+	}
+}
+
+// roundTripRTCP marshals packets and parses them back like they arrive from the caller
+func roundTripRTCP(t *testing.T, packets ...rtcp.Packet) []rtcp.Packet {
+	t.Helper()
+	raw, err := rtcp.Marshal(packets)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	parsed, err := rtcp.Unmarshal(raw)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %s", err)
+	}
+	return parsed
+}
+
+func TestOnRTCP(t *testing.T) {
+	const ssrc = 0x1234
+	encoder := &keyframeCountingEncoder{}
+	vmi := &VoiceMenuInstance{
+		_log:               logger,
+		_videoTrack:        &clockedTrack{},
+		_encoder:           encoder,
+		_bitrateController: newBitrateController(VideoConfig{Width: 640, Height: 360, FPS: 10}, 1000000, 2000000, 0, func(int) {}, func(int) {}),
+	}
+	stats := &rtpStreamStats{}
+
+	vmi.onRTCP(roundTripRTCP(t,
+		&rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{
+			// of another stream
+			{SSRC: ssrc + 1, FractionLost: 255, TotalLost: 1000, Jitter: 48000},
+			{SSRC: ssrc, FractionLost: 64, TotalLost: 10, Jitter: 900},
+		}},
+		&rtcp.TransportLayerNack{SenderSSRC: 1, MediaSSRC: ssrc, Nacks: []rtcp.NackPair{{PacketID: 5}}},
+		&rtcp.PictureLossIndication{SenderSSRC: 1, MediaSSRC: ssrc},
+		&rtcp.FullIntraRequest{SenderSSRC: 1, MediaSSRC: ssrc, FIR: []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: 1}}},
+		&rtcp.ReceiverEstimatedMaximumBitrate{SenderSSRC: 1, Bitrate: 400000, SSRCs: []uint32{ssrc}},
+	), ssrc, "video", videoClockRate, stats, time.Now())
+
+	got := stats.snapshot()
+	if got.ReceiverReports != 1 || got.PacketsLost != 10 || got.FractionLost != 0.25 {
+		t.Errorf("%d reports, %d lost, fraction %v, want 1, 10 and 0.25", got.ReceiverReports, got.PacketsLost, got.FractionLost)
+	}
+	// 900 at the 90 kHz video clock
+	if got.JitterSeconds != 0.01 {
+		t.Errorf("jitter %v s, want 0.01", got.JitterSeconds)
+	}
+	if got.RTTSeconds != 0 {
+		t.Errorf("rtt %v s without a sender report", got.RTTSeconds)
+	}
+	if got.NACKs != 1 || got.PLIs != 1 || got.FIRs != 1 {
+		t.Errorf("%d NACKs, %d PLIs, %d FIRs, want one each", got.NACKs, got.PLIs, got.FIRs)
+	}
+	if encoder.keyframes != 2 {
+		t.Errorf("%d keyframes requested, want one for the PLI and one for the FIR", encoder.keyframes)
+	}
+	if estimated, target := vmi._bitrateController.bitrates(); estimated != 400000 || target != 400000 {
+		t.Errorf("REMB gave estimated %d and target %d, want 400000", estimated, target)
+	}
+
+	// reports also come within sender reports
+	vmi.onRTCP(roundTripRTCP(t,
+		&rtcp.SenderReport{SSRC: 1, Reports: []rtcp.ReceptionReport{{SSRC: ssrc, FractionLost: 128, TotalLost: 20}}},
+	), ssrc, "video", videoClockRate, stats, time.Now())
+	if got := stats.snapshot(); got.ReceiverReports != 2 || got.PacketsLost != 20 || got.FractionLost != 0.5 {
+		t.Errorf("%d reports, %d lost, fraction %v after a sender report", got.ReceiverReports, got.PacketsLost, got.FractionLost)
+	}
+}
+
+func TestRequestKeyframeWithoutVideo(t *testing.T) {
+	encoder := &keyframeCountingEncoder{}
+	vmi := &VoiceMenuInstance{_log: logger, _encoder: encoder}
+	vmi.requestKeyframe("PLI")
+	if encoder.keyframes != 0 {
+		t.Error("keyframe requested for a call without video")
+	}
+}
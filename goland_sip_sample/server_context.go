@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ghettovoice/gosip"
+	"github.com/pion/ice/v3"
+	"github.com/pion/webrtc/v4"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerContext holds everything that is built once on startup and shared by all calls.
+// The configuration, the loaded prompts and fonts and the WebRTC API built from them form a serverState
+// that is replaced as a whole on reload. A call takes the current state once when it starts and keeps it until it ends
+type ServerContext struct {
+	// command line the configuration is reloaded from
+	args          []string
+	state         atomic.Pointer[serverState]
+	reloadMutex   sync.Mutex
+	callAdmission *CallAdmission
+	// the mux is bound once, so ICE settings are not reloadable
+	iceSettings ICETransportSettings
+	// nil when ICE uses a port range instead of the mux
+	iceUDPMux ice.UDPMux
+	calls     *CallRegistry
+	// one for the server, so that spoken text stays cached across reloads
+	tts *ttsPromptProvider
+	// set up by main, nil until then
+	sipServer   gosip.Server
+	httpServer  *http.Server
+	adminServer *http.Server
+}
+
+// serverState is never modified once built, so it is safe to use from concurrent calls
+type serverState struct {
+	config    *Config
+	vmr       *VoiceMenuResources
+	webrtcAPI *webrtc.API
+	// the congestion controllers of peer connections created by webrtcAPI
+	bandwidthEstimators *bandwidthEstimators
+	// nil unless video.broadcast is set
+	videoBroadcasts *videoBroadcasts
+	loadedAt        time.Time
+}
+
+func NewServerContext(config *Config, args []string) (*ServerContext, error) {
+	iceSettings := iceTransportSettingsFromConfig(config.ICE)
+	udpMux, err := newICEUDPMux(iceSettings, pionLoggerFactory(config.Logging))
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &ServerContext{
+		args:          args,
+		callAdmission: NewCallAdmission(callAdmissionLimitsFromConfig(config.Admission)),
+		iceSettings:   iceSettings,
+		iceUDPMux:     udpMux,
+		calls:         NewCallRegistry(),
+		tts:           newTTSPromptProvider(config.TTS),
+	}
+
+	state, err := sc.newServerState(config)
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	sc.state.Store(state)
+
+	return sc, nil
+}
+
+func (sc *ServerContext) newServerState(config *Config) (*serverState, error) {
+	vmr := &VoiceMenuResources{}
+	if err := vmr.init(config.Resources, config.Audio, config.TTS, sc.tts, config.ICE.StunServer); err != nil {
+		return nil, err
+	}
+
+	settingEngine := prepareSettingsEngine(pionLoggerFactory(config.Logging), sc.iceSettings, sc.iceUDPMux)
+	mediaEngine := prepareMediaEngine()
+	interceptors, estimators := prepareWebRTCInterceptors(mediaEngine)
+	var broadcasts *videoBroadcasts
+	if config.Video.Broadcast {
+		broadcasts = newVideoBroadcasts(vmr)
+	}
+
+	return &serverState{
+		config: config,
+		vmr:    vmr,
+		webrtcAPI: webrtc.NewAPI(
+			webrtc.WithSettingEngine(settingEngine),
+			webrtc.WithMediaEngine(mediaEngine),
+			webrtc.WithInterceptorRegistry(interceptors),
+		),
+		bandwidthEstimators: estimators,
+		videoBroadcasts:     broadcasts,
+		loadedAt:            time.Now(),
+	}, nil
+}
+
+// currentState is what new calls should be started with
+func (sc *ServerContext) currentState() *serverState {
+	return sc.state.Load()
+}
+
+// settings that are only applied on startup. a change is reported and otherwise ignored on reload
+func restartRequiredChanges(old *Config, new *Config) []string {
+	var changes []string
+	if old.SIP != new.SIP {
+		changes = append(changes, "sip")
+	}
+	if old.HTTP != new.HTTP {
+		changes = append(changes, "http")
+	}
+	if old.Admin != new.Admin {
+		changes = append(changes, "admin")
+	}
+	if old.ICE.UDPMuxPort != new.ICE.UDPMuxPort || old.ICE.UDPPortMin != new.ICE.UDPPortMin || old.ICE.UDPPortMax != new.ICE.UDPPortMax {
+		changes = append(changes, "ice ports")
+	}
+	return changes
+}
+
+// Reload re-reads the configuration and the resources it points to. Nothing is replaced unless everything loads,
+// calls in progress keep the state they were started with
+func (sc *ServerContext) Reload() error {
+	sc.reloadMutex.Lock()
+	defer sc.reloadMutex.Unlock()
+
+	config, _, err := LoadConfig(sc.args)
+	if err != nil {
+		return fmt.Errorf("failed to reload configuration: %w", err)
+	}
+	state, err := sc.newServerState(config)
+	if err != nil {
+		return fmt.Errorf("failed to reload resources: %w", err)
+	}
+
+	oldState := sc.state.Swap(state)
+	if changes := restartRequiredChanges(oldState.config, config); len(changes) > 0 {
+		logger.Warnf("Reloaded configuration changes %v, which only take effect after a restart", changes)
+	}
+	sc.callAdmission.SetLimits(callAdmissionLimitsFromConfig(config.Admission))
+	sc.tts.update(config.TTS)
+	configureLogging(config.Logging)
+
+	logger.Infof("Configuration and resources reloaded, previous version loaded at %s", oldState.loadedAt.Format(time.RFC3339))
+	return nil
+}
+
+func (sc *ServerContext) Close() {
+	if sc.iceUDPMux == nil {
+		return
+	}
+	if err := sc.iceUDPMux.Close(); err != nil {
+		logger.Errorf("Failed to close ICE UDP mux: %s", err)
+	}
+}
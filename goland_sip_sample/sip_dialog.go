@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/util"
+	"sync/atomic"
+)
+
+// sipDialog is the UAS side of a call established by an INVITE. It holds just enough to send requests
+// within the dialog (RFC 3261 12.1.1, 12.2.1.1), which for us means the BYE on hangup
+type sipDialog struct {
+	callID sip.CallID
+	// our side, the To of the INVITE with the tag we added in the 200 OK
+	local *sip.Address
+	// the caller, the From of the INVITE
+	remote       *sip.Address
+	remoteTarget sip.Uri
+	routeSet     []sip.Uri
+	// where the INVITE came from. requests are sent back there, usually that is the proxy
+	destination string
+	transport   string
+	localSeqNo  atomic.Uint32
+}
+
+// addToTag adds the local tag that identifies our side of the dialog to a response to the INVITE
+func addToTag(response sip.Response) {
+	to, present := response.To()
+	if !present {
+		return
+	}
+	if to.Params == nil {
+		to.Params = sip.NewParams()
+	}
+	if _, tagged := to.Params.Get("tag"); !tagged {
+		to.Params.Add("tag", sip.String{Str: util.RandString(10)})
+	}
+}
+
+func newSIPDialog(invite sip.Request, response sip.Response) (*sipDialog, error) {
+	callID, present := invite.CallID()
+	if !present {
+		return nil, errors.New("INVITE has no Call-ID")
+	}
+	from, present := invite.From()
+	if !present {
+		return nil, errors.New("INVITE has no From")
+	}
+	to, present := response.To()
+	if !present {
+		return nil, errors.New("response to INVITE has no To")
+	}
+
+	remoteTarget := from.Address
+	if contact, present := invite.Contact(); present {
+		remoteTarget = contact.Address
+	}
+
+	// UAS keeps the Record-Route order
+	var routeSet []sip.Uri
+	for _, header := range invite.GetHeaders("Record-Route") {
+		if recordRoute, ok := header.(*sip.RecordRouteHeader); ok {
+			for _, address := range recordRoute.Addresses {
+				routeSet = append(routeSet, address.Clone())
+			}
+		}
+	}
+
+	return &sipDialog{
+		callID:       *callID,
+		local:        sip.NewAddressFromToHeader(to),
+		remote:       sip.NewAddressFromFromHeader(from),
+		remoteTarget: remoteTarget.Clone(),
+		routeSet:     routeSet,
+		destination:  invite.Source(),
+		transport:    invite.Transport(),
+	}, nil
+}
+
+func (d *sipDialog) newRequest(method sip.RequestMethod) (sip.Request, error) {
+	callID := d.callID
+	request, err := sip.NewRequestBuilder().
+		SetMethod(method).
+		SetTransport(d.transport).
+		SetRecipient(d.remoteTarget.Clone()).
+		SetFrom(d.local.Clone()).
+		SetTo(d.remote.Clone()).
+		SetCallID(&callID).
+		SetSeqNo(uint(d.localSeqNo.Add(1))).
+		SetRoutes(d.routeSet).
+		// the transport layer fills in the sent-by host and port
+		AddVia(&sip.ViaHop{
+			Params: sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		}).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	request.SetDestination(d.destination)
+	return request, nil
+}
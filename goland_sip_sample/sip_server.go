@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ghettovoice/gosip"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/pion/sdp"
@@ -11,19 +13,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // examples https://medium.com/ringcentral-developers/create-a-ringcentral-softphone-in-golang-7c4b7b079ed
 // https://github.com/ringcentral/ringcentral-softphone-go
 
-var (
-	logger log.Logger
-)
-
-func init() {
-	logger = log.NewDefaultLogrusLogger().WithPrefix("Server")
-}
-
 func getMidValue(media *sdp.MediaDescription) string {
 	for _, attr := range media.Attributes {
 		if attr.Key == "mid" {
@@ -33,10 +28,10 @@ func getMidValue(media *sdp.MediaDescription) string {
 	return ""
 }
 
-func mungleOffer(offer string) string {
+func mungleOffer(offer string) (string, error) {
 	var sd sdp.SessionDescription
 	if err := sd.Unmarshal(offer); err != nil {
-		panic("failed to unmarshal offer " + offer)
+		return "", fmt.Errorf("failed to parse the offer: %w", err)
 	}
 	midValueCounter := 100
 	for _, media := range sd.MediaDescriptions {
@@ -52,13 +47,16 @@ func mungleOffer(offer string) string {
 	sd.Attributes = append(sd.Attributes, sdp.Attribute{Key: "fingerprint", Value: "fingerprint:sha-256 5D:8F:6B:D0:15:11:95:06:2E:AE:2B:C3:32:99:06:7C:2D:EA:D1:D1:AA:BF:07:D4:D3:16:32:61:53:30:EB:01"})
 	mungledOffer := sd.Marshal()
 
-	return mungledOffer
+	return mungledOffer, nil
 }
 
-func mungleAnswer(answer string) string {
+func mungleAnswer(answer string) (string, error) {
 	var sd sdp.SessionDescription
 	if err := sd.Unmarshal(answer); err != nil {
-		panic("failed to unmarshal offer " + answer)
+		return "", fmt.Errorf("failed to parse the answer: %w", err)
+	}
+	if len(sd.MediaDescriptions) == 0 {
+		return "", errors.New("the answer has no media")
 	}
 	for _, media := range sd.MediaDescriptions {
 		newAttrs := make([]sdp.Attribute, 0)
@@ -74,13 +72,56 @@ func mungleAnswer(answer string) string {
 	//some dummy fingerprint. validation will be disabled
 	mungledAnswer := sd.Marshal()
 
-	return mungledAnswer
+	return mungledAnswer, nil
+}
+
+// sipCallID is empty if the request has no Call-ID
+func sipCallID(req sip.Request) string {
+	if callID, present := req.CallID(); present {
+		return string(*callID)
+	}
+	return ""
+}
+
+func respondServiceUnavailable(req sip.Request, tx sip.ServerTransaction, rejection *AdmissionRejection, callLogger log.Logger) {
+	response := sip.NewResponseFromRequest(req.MessageID(), req, 503, "Service Unavailable", "")
+	response.AppendHeader(&sip.GenericHeader{
+		HeaderName: "Retry-After",
+		Contents:   strconv.Itoa(rejection.RetryAfterSeconds()),
+	})
+	if err := tx.Respond(response); err != nil {
+		callLogger.Errorf("Failed to respond with 503: %s", err)
+	}
+}
+
+// respondRejected answers an INVITE that cannot be taken with code
+func respondRejected(req sip.Request, tx sip.ServerTransaction, code sip.StatusCode, reason string, callLogger log.Logger) {
+	response := sip.NewResponseFromRequest(req.MessageID(), req, code, reason, "")
+	if err := tx.Respond(response); err != nil {
+		callLogger.Errorf("Failed to respond with %d: %s", code, err)
+	}
+	countInviteResponse(int(code))
 }
 
-func onInvite(req sip.Request, tx sip.ServerTransaction) {
+func (sc *ServerContext) onInvite(req sip.Request, tx sip.ServerTransaction) {
+	callID := sipCallID(req)
+	callLogger := newCallLogger(callID, req.Source())
+
+	releaseAdmission, err := sc.callAdmission.Admit(req.Source())
+	var rejection *AdmissionRejection
+	if errors.As(err, &rejection) {
+		callLogger.Warnf("Rejecting INVITE: %s", rejection)
+		respondServiceUnavailable(req, tx, rejection, callLogger)
+		countInviteResponse(503)
+		return
+	}
+
 	toHeader, present := req.To()
 	if !present {
-		panic("to not present in request")
+		releaseAdmission()
+		callLogger.Warn("Rejecting INVITE without To")
+		respondRejected(req, tx, 400, "Bad Request", callLogger)
+		return
 	}
 	newCnt := &sip.ContactHeader{
 		DisplayName: sip.String{Str: "the dude"},
@@ -92,33 +133,100 @@ func onInvite(req sip.Request, tx sip.ServerTransaction) {
 	//	Address: sip.ContactUri{ContoHeader.Address()),
 	//	Params: sip.NewParams()
 	//}
-	mungledOffer := mungleOffer(req.Body())
-	logger.Info("Mungled offer ", mungledOffer)
+	mungledOffer, err := mungleOffer(req.Body())
+	if err != nil {
+		releaseAdmission()
+		callLogger.Warnf("Rejecting INVITE: %s", err)
+		respondRejected(req, tx, 400, "Bad Request", callLogger)
+		return
+	}
+	callLogger.Info("Mungled offer ", mungledOffer)
 	//in SIP candidates are supposed to be embedded into sdp
-	answer := answerToOffer(mungledOffer, []webrtc.ICECandidateInit{})
-
-	answer = mungleAnswer(answer)
-	logger.Info("Mungled answer ", answer)
+	answer, vmi, err := sc.answerToOffer(mungledOffer, []webrtc.ICECandidateInit{}, releaseAdmission, callLogger)
+	if err == nil {
+		answer, err = mungleAnswer(answer)
+		if err != nil {
+			vmi.Close()
+		}
+	}
+	if err != nil {
+		callLogger.Warnf("Rejecting INVITE: %s", err)
+		respondRejected(req, tx, 488, "Not Acceptable Here", callLogger)
+		return
+	}
+	callLogger.Info("Mungled answer ", answer)
 
 	response := sip.NewResponseFromRequest(req.MessageID(), req, 200, "I said so", answer)
 	response.AppendHeader(newCnt)
-	response.Contact()
-	err := tx.Respond(response)
+	addToTag(response)
+
+	dialog, err := newSIPDialog(req, response)
 	if err != nil {
-		panic(err)
+		callLogger.Errorf("Unable to track dialog of INVITE, the call cannot be hung up by us: %s", err)
 	}
+	sc.registerCall(callID, req.Source(), vmi, dialog, callLogger)
+
+	if err = tx.Respond(response); err != nil {
+		callLogger.Errorf("Failed to respond with 200, ending the call: %s", err)
+		vmi.Close()
+		return
+	}
+	countInviteResponse(200)
 }
 
-func answerToOffer(offerSDP string, candidates []webrtc.ICECandidateInit) string {
+func (sc *ServerContext) onBye(req sip.Request, tx sip.ServerTransaction) {
+	callID := sipCallID(req)
+	call := sc.calls.Get(callID)
+	if call == nil {
+		requestLogger := logger.WithFields(log.Fields{logFieldCallID: callID, logFieldRemoteAddr: req.Source()})
+		requestLogger.Warn("BYE for unknown call")
+		response := sip.NewResponseFromRequest(req.MessageID(), req, 481, "Call/Transaction Does Not Exist", "")
+		if err := tx.Respond(response); err != nil {
+			requestLogger.Errorf("Failed to respond to BYE: %s", err)
+		}
+		return
+	}
+
+	call.log.Infof("Call hung up by %s", req.Source())
+	response := sip.NewResponseFromRequest(req.MessageID(), req, 200, "OK", "")
+	if err := tx.Respond(response); err != nil {
+		call.log.Errorf("Failed to respond to BYE: %s", err)
+	}
+	call.vmi.Close()
+}
+
+// ACK to our 200 OK needs no handling, registered only so that it is not reported as unhandled
+func (sc *ServerContext) onAck(req sip.Request, tx sip.ServerTransaction) {
+}
+
+// dialog is nil for calls from the web client
+func (sc *ServerContext) registerCall(id string, remoteAddr string, vmi *VoiceMenuInstance, dialog *sipDialog, callLogger log.Logger) {
+	sc.calls.Add(&ActiveCall{
+		id:         id,
+		remoteAddr: remoteAddr,
+		startedAt:  time.Now(),
+		vmi:        vmi,
+		dialog:     dialog,
+		log:        callLogger,
+	})
+}
 
-	vmr := &VoiceMenuResources{}
-	vmr.init()
-	var vmi = NewVoiceMenuInstance(vmr, 10)
-	answer := vmi.connect(offerSDP, candidates, true, true)
+// releaseAdmission is called once the call is over to free its slot in callAdmission. If the offer cannot be
+// answered the call is over already
+func (sc *ServerContext) answerToOffer(offerSDP string, candidates []webrtc.ICECandidateInit, releaseAdmission func(), callLogger log.Logger) (string, *VoiceMenuInstance, error) {
+	state := sc.currentState()
+
+	var vmi = NewVoiceMenuInstance(state.vmr, state.webrtcAPI, state.bandwidthEstimators, state.videoBroadcasts, state.config.Video, state.config.Session.Timeout, callLogger)
+	vmi.OnClose(releaseAdmission)
+	answer, err := vmi.connect(offerSDP, candidates, true, true)
+	if err != nil {
+		vmi.Close()
+		return "", nil, err
+	}
 
 	go vmi.StartPlayback()
 
-	return answer
+	return answer, vmi, nil
 }
 
 type WebOffer struct {
@@ -126,33 +234,53 @@ type WebOffer struct {
 	Candidates []webrtc.ICECandidateInit
 }
 
-func getHttpAnswer(w http.ResponseWriter, r *http.Request) {
+func (sc *ServerContext) getHttpAnswer(w http.ResponseWriter, r *http.Request) {
+	callID := sc.calls.newWebCallID()
+	callLogger := newCallLogger(callID, r.RemoteAddr)
+
+	releaseAdmission, err := sc.callAdmission.Admit(r.RemoteAddr)
+	var rejection *AdmissionRejection
+	if errors.As(err, &rejection) {
+		callLogger.Warnf("Rejecting offer: %s", rejection)
+		w.Header().Set("Retry-After", strconv.Itoa(rejection.RetryAfterSeconds()))
+		http.Error(w, rejection.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		fmt.Printf("could not read body: %s\n", err)
-		panic(err)
+		releaseAdmission()
+		callLogger.Errorf("could not read body: %s", err)
+		http.Error(w, "could not read the offer", http.StatusBadRequest)
+		return
 	}
 
 	var webOffer WebOffer
 	if err = json.Unmarshal(body, &webOffer); err != nil {
-		panic(err)
+		releaseAdmission()
+		callLogger.Warnf("Rejecting offer: %s", err)
+		http.Error(w, "the offer is no JSON", http.StatusBadRequest)
+		return
 	}
 
-	fmt.Printf("got request %s with candidates %s\n", webOffer.Offer, webOffer.Candidates)
-
-	answer := answerToOffer(webOffer.Offer, webOffer.Candidates)
+	callLogger.Infof("got request %s with candidates %v", webOffer.Offer, webOffer.Candidates)
 
-	_, err = io.WriteString(w, answer)
+	answer, vmi, err := sc.answerToOffer(webOffer.Offer, webOffer.Candidates, releaseAdmission, callLogger)
 	if err != nil {
-		panic(err)
+		callLogger.Warnf("Rejecting offer: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-}
+	sc.registerCall(callID, r.RemoteAddr, vmi, nil, callLogger)
 
-func getStunServers(w http.ResponseWriter, r *http.Request) {
-	vmr := &VoiceMenuResources{}
-	vmr.init()
+	if _, err = io.WriteString(w, answer); err != nil {
+		callLogger.Errorf("Failed to send the answer, ending the call: %s", err)
+		vmi.Close()
+	}
+}
 
-	candidates := vmr.getStunServers()
+func (sc *ServerContext) getStunServers(w http.ResponseWriter, r *http.Request) {
+	candidates := sc.currentState().vmr.getStunServers()
 	response, err := json.Marshal(candidates)
 	if err != nil {
 		panic(err)
@@ -164,15 +292,35 @@ func getStunServers(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func setupHttpServer() {
-	initH264Encoder()
-
-	http.HandleFunc("/offer", getHttpAnswer)
-	http.HandleFunc("/stunServers", getStunServers)
-	fs := http.FileServer(http.Dir("./httpStatic"))
+func (sc *ServerContext) setupHttpServer(httpConfig HTTPConfig) {
+	http.HandleFunc("/offer", sc.getHttpAnswer)
+	http.HandleFunc("/stunServers", sc.getStunServers)
+	fs := http.FileServer(http.Dir(httpConfig.StaticDir))
 	http.Handle("/", fs)
 
-	if err := http.ListenAndServe(":8885", nil); err != nil {
-		panic(err)
+	sc.httpServer = &http.Server{Addr: httpConfig.ListenAddress}
+	go func() {
+		if err := sc.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+}
+
+func (sc *ServerContext) setupSIPServer(sipConfig SIPConfig) error {
+	srvConf := gosip.ServerConfig{}
+	sc.sipServer = gosip.NewServer(srvConf, nil, nil, logger)
+
+	if sc.sipServer.OnRequest(sip.INVITE, sc.onInvite) != nil {
+		panic("Failed to register invite handler")
+	}
+	if sc.sipServer.OnRequest(sip.ACK, sc.onAck) != nil {
+		panic("Failed to register ack handler")
+	}
+	if sc.sipServer.OnRequest(sip.BYE, sc.onBye) != nil {
+		panic("Failed to register bye handler")
 	}
+	//err = srv.Listen("ws", "0.0.0.0:5080", nil)
+	//if err != nil { panic(err) }
+	//srv.Listen("wss", "0.0.0.0:5081", &transport.TLSConfig{Cert: "certs/cert.pem", Key: "certs/key.pem"})
+	return sc.sipServer.Listen(sipConfig.Transport, sipConfig.ListenAddress, nil)
 }
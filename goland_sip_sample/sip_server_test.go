@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMungleOfferRejectsBrokenSDP(t *testing.T) {
+	if _, err := mungleOffer("no sdp"); err == nil {
+		t.Error("broken offer accepted")
+	}
+}
+
+func TestMungleAnswerRejectsAnswerWithoutMedia(t *testing.T) {
+	answer := "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"
+	if _, err := mungleAnswer(answer); err == nil {
+		t.Error("answer without media accepted")
+	}
+}
+
+func TestMungleOfferAddsMissingMid(t *testing.T) {
+	offer := "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 5004 RTP/AVP 111\r\nc=IN IP4 127.0.0.1\r\na=rtpmap:111 opus/48000/2\r\n"
+	mungled, err := mungleOffer(offer)
+	if err != nil {
+		t.Fatalf("offer rejected: %s", err)
+	}
+	if !strings.Contains(mungled, "a=mid:101\r\n") {
+		t.Errorf("no mid added to\n%s", mungled)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/bidi"
+	"image"
+	"image/color"
+	"strings"
+	"unicode"
+)
+
+// a textRenderer wraps text within a box, aligns and spaces its lines, joins arabic letters and puts right to left
+// text in display order. Characters the font lacks are taken from the other fonts of the resources. truetype can not
+// apply the shaping tables of a font: arabic is joined with the presentation forms of unicode, and scripts that need
+// more than that, like the indic ones, are drawn letter by letter
+const (
+	// faces one renderer keeps, the cache starts over beyond that
+	textRendererMaxFaces = 32
+	// the distance between baselines, in font sizes
+	defaultLineSpacing = 1.2
+)
+
+type textAlignment int
+
+const (
+	alignLeft textAlignment = iota
+	alignCenter
+	alignRight
+	// the start and the end of a line are left and right for left to right text, the other way around otherwise
+	alignStart
+	alignEnd
+)
+
+// textStyle is how drawText draws text
+type textStyle struct {
+	// registered in resources.fonts, empty for resources.font
+	font  string
+	size  float64
+	color color.Color
+	align textAlignment
+	// 0 for defaultLineSpacing
+	lineSpacing float64
+}
+
+type faceKey struct {
+	font *truetype.Font
+	size float64
+}
+
+// textRenderer caches faces, which are not safe for concurrent use, so each goroutine that draws needs its own
+type textRenderer struct {
+	vmr   *VoiceMenuResources
+	faces map[faceKey]font.Face
+}
+
+func newTextRenderer(vmr *VoiceMenuResources) *textRenderer {
+	return &textRenderer{vmr: vmr, faces: make(map[faceKey]font.Face)}
+}
+
+func (r *textRenderer) face(ttf *truetype.Font, size float64) font.Face {
+	key := faceKey{font: ttf, size: size}
+	if face, cached := r.faces[key]; cached {
+		return face
+	}
+	if len(r.faces) >= textRendererMaxFaces {
+		r.faces = make(map[faceKey]font.Face)
+	}
+	face := truetype.NewFace(ttf, &truetype.Options{
+		Size:    size,
+		DPI:     72.0,
+		Hinting: font.HintingNone,
+	})
+	r.faces[key] = face
+	return face
+}
+
+// glyphFace is the face that draws ch: the one of ttf if it has the glyph, else the one of the first font of the
+// resources that has it, else the one of ttf which draws a box
+func (r *textRenderer) glyphFace(ttf *truetype.Font, size float64, ch rune) font.Face {
+	if ttf.Index(ch) == 0 {
+		for _, fallback := range r.vmr.fallbackFonts {
+			if fallback.Index(ch) != 0 {
+				return r.face(fallback, size)
+			}
+		}
+	}
+	return r.face(ttf, size)
+}
+
+// measure is the advance of line, drawn in ttf
+func (r *textRenderer) measure(ttf *truetype.Font, size float64, line []rune) fixed.Int26_6 {
+	var width fixed.Int26_6
+	var previous font.Face
+	prevCh := rune(-1)
+	for _, ch := range line {
+		face := r.glyphFace(ttf, size, ch)
+		if face == previous && prevCh >= 0 {
+			width += face.Kern(prevCh, ch)
+		}
+		advance, _ := face.GlyphAdvance(ch)
+		width += advance
+		previous, prevCh = face, ch
+	}
+	return width
+}
+
+// drawText draws text wrapped within rect, breaking lines between words and at line feeds.
+// lines that do not fit in rect are left out, and nothing is painted outside it
+func (r *textRenderer) drawText(p *framePainter, rect image.Rectangle, text string, style textStyle) {
+	if text == "" || style.size <= 0 {
+		return
+	}
+	p = p.clipped(rect)
+	ttf := r.vmr.font(style.font)
+	metrics := r.face(ttf, style.size).Metrics()
+	lineSpacing := style.lineSpacing
+	if lineSpacing <= 0 {
+		lineSpacing = defaultLineSpacing
+	}
+	lineHeight := fixed.Int26_6(float64(fixed.I(1)) * style.size * lineSpacing)
+
+	baseline := fixed.I(rect.Min.Y) + metrics.Ascent
+	for _, paragraph := range strings.Split(text, "\n") {
+		shaped := joinArabicLetters([]rune(paragraph))
+		rtl := isRightToLeft(shaped)
+		for _, line := range r.wrap(ttf, style.size, shaped, fixed.I(rect.Dx())) {
+			if (baseline + metrics.Descent).Ceil() > rect.Max.Y {
+				return
+			}
+			visual := displayOrder(line, rtl)
+			x := fixed.I(rect.Min.X)
+			switch free := fixed.I(rect.Dx()) - r.measure(ttf, style.size, visual); {
+			case style.align == alignCenter:
+				x += free / 2
+			case style.align == alignRight, style.align == alignStart && rtl, style.align == alignEnd && !rtl:
+				x += free
+			}
+			r.drawLine(p, style.color, ttf, style.size, visual, fixed.Point26_6{X: x, Y: baseline})
+			baseline += lineHeight
+		}
+	}
+}
+
+// drawLine draws runes from left to right, starting at dot on the baseline
+func (r *textRenderer) drawLine(p *framePainter, col color.Color, ttf *truetype.Font, size float64, line []rune, dot fixed.Point26_6) {
+	var previous font.Face
+	prevCh := rune(-1)
+	for _, ch := range line {
+		face := r.glyphFace(ttf, size, ch)
+		if face == previous && prevCh >= 0 {
+			dot.X += face.Kern(prevCh, ch)
+		}
+		dr, mask, maskp, advance, ok := face.Glyph(dot, ch)
+		if ok {
+			p.fillMask(dr, col, mask, maskp)
+		}
+		dot.X += advance
+		previous, prevCh = face, ch
+	}
+}
+
+// wrap breaks paragraph into lines no wider than width, between words where it can, within them where a word is
+// wider than that. the spaces lines are broken at are dropped
+func (r *textRenderer) wrap(ttf *truetype.Font, size float64, paragraph []rune, width fixed.Int26_6) [][]rune {
+	var lines [][]rune
+	var line []rune
+	for _, word := range splitWords(paragraph) {
+		candidate := word
+		if len(line) > 0 {
+			candidate = append(append(append([]rune{}, line...), ' '), word...)
+		}
+		if r.measure(ttf, size, candidate) <= width {
+			line = candidate
+			continue
+		}
+		if len(line) > 0 {
+			lines = append(lines, line)
+			line = nil
+		}
+		// a word wider than the box is broken where it has to
+		for len(word) > 0 && r.measure(ttf, size, word) > width {
+			n := 1
+			for n < len(word) && r.measure(ttf, size, word[:n+1]) <= width {
+				n++
+			}
+			lines = append(lines, word[:n])
+			word = word[n:]
+		}
+		line = word
+	}
+	if len(line) > 0 || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func splitWords(paragraph []rune) [][]rune {
+	var words [][]rune
+	start := -1
+	for i, ch := range paragraph {
+		if unicode.IsSpace(ch) {
+			if start >= 0 {
+				words = append(words, paragraph[start:i])
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, paragraph[start:])
+	}
+	return words
+}
+
+// isRightToLeft tells the direction of a paragraph from its first strong character, as the unicode bidi algorithm does
+func isRightToLeft(paragraph []rune) bool {
+	for _, ch := range paragraph {
+		properties, _ := bidi.LookupRune(ch)
+		switch properties.Class() {
+		case bidi.L:
+			return false
+		case bidi.R, bidi.AL:
+			return true
+		}
+	}
+	return false
+}
+
+// displayOrder puts line from reading order into the order it is drawn from left to right. bidi resolves the
+// direction of every character, runs of one direction are reversed here. This is right for text with one level of
+// embedding, like numbers and latin words within arabic or hebrew, and for everything without explicit embeddings
+func displayOrder(line []rune, rtl bool) []rune {
+	direction := bidi.LeftToRight
+	if rtl {
+		direction = bidi.RightToLeft
+	}
+	var paragraph bidi.Paragraph
+	if _, err := paragraph.SetString(string(line), bidi.DefaultDirection(direction)); err != nil {
+		return line
+	}
+	ordering, err := paragraph.Order()
+	if err != nil {
+		return line
+	}
+
+	runs := make([][]rune, ordering.NumRuns())
+	for i := range runs {
+		run := ordering.Run(i)
+		runs[i] = []rune(run.String())
+		if run.Direction() == bidi.RightToLeft {
+			reverseRunes(runs[i])
+			for j, ch := range runs[i] {
+				if mirrored, ok := mirroredRunes[ch]; ok {
+					runs[i][j] = mirrored
+				}
+			}
+		}
+	}
+	result := make([]rune, 0, len(line))
+	for i := range runs {
+		if rtl {
+			result = append(result, runs[len(runs)-1-i]...)
+		} else {
+			result = append(result, runs[i]...)
+		}
+	}
+	return result
+}
+
+func reverseRunes(runes []rune) {
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+}
+
+// right to left text draws the mirror image of these
+var mirroredRunes = map[rune]rune{
+	'(': ')', ')': '(', '[': ']', ']': '[', '{': '}', '}': '{', '<': '>', '>': '<', '«': '»', '»': '«',
+}
+
+const (
+	arabicFormIsolated = iota
+	arabicFormFinal
+	arabicFormInitial
+	arabicFormMedial
+)
+
+const (
+	arabicTatweel = 0x0640
+	arabicLam     = 0x0644
+	// isolated, the final form follows
+	arabicLamAlefMadda      = 0xFEF5
+	arabicLamAlefHamzaAbove = 0xFEF7
+	arabicLamAlefHamzaBelow = 0xFEF9
+	arabicLamAlef           = 0xFEFB
+)
+
+// arabicLetter is where the presentation forms of a letter start, and whether it joins the letter after it too
+type arabicLetter struct {
+	forms       rune
+	dualJoining bool
+}
+
+// arabicLetters are the letters U+0621 to U+064A that have presentation forms. Their forms follow one another from
+// U+FE80 in the order of the letters: the isolated and the final one, then the initial and the medial one for letters
+// that join on both sides
+var arabicLetters = func() map[rune]arabicLetter {
+	letters := make(map[rune]arabicLetter)
+	forms := rune(0xFE80)
+	add := func(letter rune, count int) {
+		letters[letter] = arabicLetter{forms: forms, dualJoining: count == 4}
+		forms += rune(count)
+	}
+	// hamza joins neither side
+	add(0x0621, 1)
+	for letter, count := range []int{2, 2, 2, 2, 4, 2, 4, 2, 4, 4, 4, 4, 4, 2, 2, 2, 2, 4, 4, 4, 4, 4, 4, 4, 4} {
+		add(0x0622+rune(letter), count)
+	}
+	for letter, count := range []int{4, 4, 4, 4, 4, 4, 4, 2, 2, 4} {
+		add(0x0641+rune(letter), count)
+	}
+	return letters
+}()
+
+var arabicLamAlefLigatures = map[rune]rune{
+	0x0622: arabicLamAlefMadda,
+	0x0623: arabicLamAlefHamzaAbove,
+	0x0625: arabicLamAlefHamzaBelow,
+	0x0627: arabicLamAlef,
+}
+
+// isArabicTransparent is true for the marks above and below letters, which letters join across
+func isArabicTransparent(ch rune) bool {
+	return ch >= 0x064B && ch <= 0x065F || ch == 0x0670
+}
+
+// joinsNext is true if ch joins the letter after it
+func joinsNext(ch rune) bool {
+	return ch == arabicTatweel || arabicLetters[ch].dualJoining
+}
+
+// joinsPrevious is true if ch joins the letter before it
+func joinsPrevious(ch rune) bool {
+	_, isLetter := arabicLetters[ch]
+	return ch == arabicTatweel || isLetter && ch != 0x0621
+}
+
+// joinArabicLetters replaces arabic letters with the presentation form for their place in the word, and lam followed
+// by alef with their ligature. text is in reading order
+func joinArabicLetters(text []rune) []rune {
+	neighbour := func(from int, step int) rune {
+		for i := from + step; i >= 0 && i < len(text); i += step {
+			if !isArabicTransparent(text[i]) {
+				return text[i]
+			}
+		}
+		return 0
+	}
+
+	result := make([]rune, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		letter, isLetter := arabicLetters[ch]
+		if !isLetter {
+			result = append(result, ch)
+			continue
+		}
+		joinedBefore := joinsPrevious(ch) && joinsNext(neighbour(i, -1))
+		if ch == arabicLam && i+1 < len(text) {
+			if ligature, ok := arabicLamAlefLigatures[text[i+1]]; ok {
+				if joinedBefore {
+					ligature++
+				}
+				result = append(result, ligature)
+				i++
+				continue
+			}
+		}
+		joinedAfter := letter.dualJoining && joinsPrevious(neighbour(i, 1))
+
+		form := arabicFormIsolated
+		switch {
+		case joinedBefore && joinedAfter:
+			form = arabicFormMedial
+		case joinedBefore:
+			form = arabicFormFinal
+		case joinedAfter:
+			form = arabicFormInitial
+		}
+		result = append(result, letter.forms+rune(form))
+	}
+	return result
+}
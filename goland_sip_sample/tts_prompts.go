@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// text is spoken by a local engine like espeak-ng or piper, run once for every text and voice that is not cached.
+// tts.command names the engine and its arguments, in which {text}, {voice} and {output} are replaced. Without
+// {text} the text is written to its standard input. The engine writes a 16 bit WAV file to {output}, which is
+// resampled to 48 kHz stereo for the mixer, so speaking needs audio.mix
+const (
+	ttsTextPlaceholder   = "{text}"
+	ttsVoicePlaceholder  = "{voice}"
+	ttsOutputPlaceholder = "{output}"
+	ttsOutputFileName    = "prompt.wav"
+	// that much stderr of the engine goes into the error when it fails
+	ttsMaxErrorOutput = 200
+)
+
+// ttsPromptProvider is the PromptProvider that speaks text. There is one for the server, shared by all calls and
+// kept across reloads so that its cache survives them
+type ttsPromptProvider struct {
+	engine atomic.Pointer[ttsEngine]
+	cache  *ttsCache
+}
+
+// ttsEngine is how text is spoken, replaced as a whole when tts.* changes
+type ttsEngine struct {
+	settings TTSConfig
+	command  []string
+}
+
+func newTTSPromptProvider(settings TTSConfig) *ttsPromptProvider {
+	p := &ttsPromptProvider{cache: newTTSCache(settings.CacheSize << 20)}
+	p.engine.Store(&ttsEngine{settings: settings, command: strings.Fields(settings.Command)})
+	return p
+}
+
+// update applies reloaded settings. Prompts of another engine sound different, so the cache is dropped when the
+// command changes
+func (p *ttsPromptProvider) update(settings TTSConfig) {
+	previous := p.engine.Load()
+	if previous.settings == settings {
+		return
+	}
+	p.engine.Store(&ttsEngine{settings: settings, command: strings.Fields(settings.Command)})
+	p.cache.resize(settings.CacheSize<<20, previous.settings.Command != settings.Command)
+}
+
+func (p *ttsPromptProvider) Prompt(ctx context.Context, text string, voice string) (*audioPrompt, error) {
+	engine := p.engine.Load()
+	if voice == "" {
+		voice = engine.settings.Voice
+	}
+	return p.cache.prompt(ctx, ttsKey{text: text, voice: voice}, engine.synthesize)
+}
+
+// synthesize runs the engine for key and decodes what it wrote
+func (p *ttsEngine) synthesize(key ttsKey) (*audioPrompt, error) {
+	dir, err := os.MkdirTemp("", "tts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, ttsOutputFileName)
+
+	args := make([]string, len(p.command))
+	textInArgs := false
+	for i, arg := range p.command {
+		textInArgs = textInArgs || strings.Contains(arg, ttsTextPlaceholder)
+		arg = strings.ReplaceAll(arg, ttsTextPlaceholder, key.text)
+		arg = strings.ReplaceAll(arg, ttsVoicePlaceholder, key.voice)
+		args[i] = strings.ReplaceAll(arg, ttsOutputPlaceholder, output)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.settings.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if !textInArgs {
+		cmd.Stdin = strings.NewReader(key.text)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > ttsMaxErrorOutput {
+			message = message[:ttsMaxErrorOutput]
+		}
+		return nil, fmt.Errorf("failed to run %s: %w %s", args[0], err, message)
+	}
+
+	wav, err := ioutil.ReadFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read what %s wrote: %w", args[0], err)
+	}
+	samples, channels, rate, err := parseWAV(wav)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read what %s wrote: %w", args[0], err)
+	}
+	ttsPromptsSynthesizedTotal.Inc()
+	return &audioPrompt{pcm: resampleToMix(samples, channels, rate)}, nil
+}
+
+// parseWAV reads the interleaved samples of a 16 bit PCM WAV file. Engines that write to a pipe leave the size of
+// the data unknown, it then goes to the end of the file
+func parseWAV(data []byte) (samples []int16, channels int, rate int, err error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, 0, errors.New("no WAV file")
+	}
+	for chunks := data[12:]; len(chunks) >= 8; {
+		id, size := string(chunks[0:4]), int(binary.LittleEndian.Uint32(chunks[4:8]))
+		chunks = chunks[8:]
+		switch id {
+		case "fmt ":
+			if size < 16 || len(chunks) < 16 {
+				return nil, 0, 0, errors.New("truncated WAV format")
+			}
+			format, bits := binary.LittleEndian.Uint16(chunks[0:2]), binary.LittleEndian.Uint16(chunks[14:16])
+			// 0xfffe is WAVE_FORMAT_EXTENSIBLE
+			if (format != 1 && format != 0xfffe) || bits != 16 {
+				return nil, 0, 0, fmt.Errorf("WAV format %d with %d bits, expected 16 bit PCM", format, bits)
+			}
+			channels = int(binary.LittleEndian.Uint16(chunks[2:4]))
+			rate = int(binary.LittleEndian.Uint32(chunks[4:8]))
+			if channels < 1 || rate < 1 {
+				return nil, 0, 0, fmt.Errorf("WAV with %d channels at %d Hz", channels, rate)
+			}
+		case "data":
+			if channels == 0 {
+				return nil, 0, 0, errors.New("WAV data before its format")
+			}
+			if size == 0 || size > len(chunks) {
+				size = len(chunks)
+			}
+			samples = make([]int16, size/2)
+			for i := range samples {
+				samples[i] = int16(binary.LittleEndian.Uint16(chunks[2*i:]))
+			}
+			return samples, channels, rate, nil
+		}
+		// chunks are padded to an even size
+		size += size & 1
+		if size > len(chunks) {
+			break
+		}
+		chunks = chunks[size:]
+	}
+	return nil, 0, 0, errors.New("WAV without data")
+}
+
+// resampleToMix converts interleaved samples to stereo at the rate of the mixer. Speech engines write 16 or 22 kHz,
+// linear interpolation is good enough to bring that up
+func resampleToMix(samples []int16, channels int, rate int) []int16 {
+	frames := len(samples) / channels
+	if frames == 0 {
+		return nil
+	}
+	length := int(int64(frames) * audioClockRate / int64(rate))
+	pcm := make([]int16, 0, length*audioChannels)
+	for i := 0; i < length; i++ {
+		position := float64(i) * float64(rate) / audioClockRate
+		frame := int(position)
+		next := min(frame+1, frames-1)
+		fraction := position - float64(frame)
+		for channel := 0; channel < audioChannels; channel++ {
+			source := min(channel, channels-1)
+			a, b := float64(samples[frame*channels+source]), float64(samples[next*channels+source])
+			pcm = append(pcm, int16(a+(b-a)*fraction))
+		}
+	}
+	return pcm
+}
+
+type ttsKey struct {
+	text  string
+	voice string
+}
+
+// ttsEntry is a prompt that is synthesized, or being synthesized while ready is open. size counts once it is kept,
+// used orders the entries by when they were last asked for
+type ttsEntry struct {
+	ready  chan struct{}
+	prompt *audioPrompt
+	err    error
+	size   int
+	used   uint64
+}
+
+// ttsCache keeps synthesized prompts up to maxBytes, dropping the least recently used ones to make room. A text
+// asked for while it is synthesized waits for it instead of running the engine again, and is never dropped to make
+// room. Failures are not kept, and nothing is kept with a maxBytes of 0
+type ttsCache struct {
+	mutex    sync.Mutex
+	entries  map[ttsKey]*ttsEntry
+	bytes    int
+	maxBytes int
+	uses     uint64
+}
+
+func newTTSCache(maxBytes int) *ttsCache {
+	return &ttsCache{entries: make(map[ttsKey]*ttsEntry), maxBytes: maxBytes}
+}
+
+// prompt is the cached prompt for key, synthesized if there is none. Synthesizing goes on when ctx is done, others
+// may wait for it as well
+func (c *ttsCache) prompt(ctx context.Context, key ttsKey, synthesize func(ttsKey) (*audioPrompt, error)) (*audioPrompt, error) {
+	c.mutex.Lock()
+	entry, found := c.entries[key]
+	if !found {
+		entry = &ttsEntry{ready: make(chan struct{})}
+		c.entries[key] = entry
+		go c.fill(key, entry, synthesize)
+	}
+	c.uses++
+	entry.used = c.uses
+	c.mutex.Unlock()
+
+	select {
+	case <-entry.ready:
+		return entry.prompt, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *ttsCache) fill(key ttsKey, entry *ttsEntry, synthesize func(ttsKey) (*audioPrompt, error)) {
+	entry.prompt, entry.err = synthesize(key)
+	close(entry.ready)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// the cache may have been dropped meanwhile
+	if c.entries[key] != entry {
+		return
+	}
+	// neither is a prompt larger than the whole cache, which covers a maxBytes of 0
+	if entry.err != nil || len(entry.prompt.pcm)*2 > c.maxBytes {
+		delete(c.entries, key)
+		return
+	}
+	size := len(entry.prompt.pcm) * 2
+	c.evict(c.maxBytes - size)
+	entry.size = size
+	c.bytes += size
+}
+
+// evict drops the least recently used prompts kept until no more than maxBytes are. Prompts being synthesized are
+// not counted yet, so they stay. The mutex is held
+func (c *ttsCache) evict(maxBytes int) {
+	for c.bytes > maxBytes {
+		var oldestKey ttsKey
+		var oldest *ttsEntry
+		for key, entry := range c.entries {
+			if entry.size > 0 && (oldest == nil || entry.used < oldest.used) {
+				oldestKey, oldest = key, entry
+			}
+		}
+		delete(c.entries, oldestKey)
+		c.bytes -= oldest.size
+	}
+}
+
+// resize changes maxBytes, dropping the least recently used prompts that no longer fit. All of them are dropped,
+// including those being synthesized, if drop is set or nothing is kept anymore
+func (c *ttsCache) resize(maxBytes int, drop bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxBytes = maxBytes
+	if drop || maxBytes == 0 {
+		c.entries = make(map[ttsKey]*ttsEntry)
+		c.bytes = 0
+		return
+	}
+	c.evict(maxBytes)
+}
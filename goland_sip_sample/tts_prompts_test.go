@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSynthesizer makes prompts of samples samples and counts how often it ran
+type countingSynthesizer struct {
+	runs    atomic.Int32
+	samples int
+}
+
+func (s *countingSynthesizer) synthesize(key ttsKey) (*audioPrompt, error) {
+	s.runs.Add(1)
+	return &audioPrompt{pcm: make([]int16, s.samples)}, nil
+}
+
+// held returns the prompts and bytes cached, fill runs after prompt returned so it takes the lock
+func (c *ttsCache) held() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries), c.bytes
+}
+
+func promptTwice(t *testing.T, cache *ttsCache, synthesizer *countingSynthesizer) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		if _, err := cache.prompt(context.Background(), ttsKey{text: "hello", voice: "en"}, synthesizer.synthesize); err != nil {
+			t.Fatalf("failed to get the prompt: %s", err)
+		}
+	}
+}
+
+func TestTTSCacheKeepsPrompts(t *testing.T) {
+	cache := newTTSCache(1 << 20)
+	synthesizer := &countingSynthesizer{samples: 100}
+	promptTwice(t, cache, synthesizer)
+	if runs := synthesizer.runs.Load(); runs != 1 {
+		t.Errorf("engine ran %d times, want once", runs)
+	}
+	if _, bytes := cache.held(); bytes != 200 {
+		t.Errorf("cache holds %d bytes, want 200", bytes)
+	}
+}
+
+func TestTTSCacheOfZeroKeepsNothing(t *testing.T) {
+	cache := newTTSCache(0)
+	synthesizer := &countingSynthesizer{samples: 100}
+	promptTwice(t, cache, synthesizer)
+	if runs := synthesizer.runs.Load(); runs != 2 {
+		t.Errorf("engine ran %d times, want twice", runs)
+	}
+	if prompts, bytes := cache.held(); prompts != 0 || bytes != 0 {
+		t.Errorf("cache holds %d prompts of %d bytes", prompts, bytes)
+	}
+}
+
+// cached tells whether text is kept or being synthesized
+func (c *ttsCache) cached(text string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, found := c.entries[ttsKey{text: text}]
+	return found
+}
+
+// promptKept gets the prompt for text and waits until fill counted it
+func promptKept(t *testing.T, cache *ttsCache, text string, synthesize func(ttsKey) (*audioPrompt, error)) {
+	t.Helper()
+	if _, err := cache.prompt(context.Background(), ttsKey{text: text}, synthesize); err != nil {
+		t.Fatalf("failed to get the prompt: %s", err)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		cache.mutex.Lock()
+		entry, found := cache.entries[ttsKey{text: text}]
+		kept := !found || entry.size > 0
+		cache.mutex.Unlock()
+		if kept {
+			return
+		}
+	}
+	t.Fatalf("%q not kept", text)
+}
+
+func TestTTSCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newTTSCache(600)
+	synthesizer := &countingSynthesizer{samples: 100}
+	for _, text := range []string{"one", "two", "three", "one", "four"} {
+		promptKept(t, cache, text, synthesizer.synthesize)
+	}
+	if prompts, bytes := cache.held(); prompts != 3 || bytes != 600 {
+		t.Errorf("cache holds %d prompts of %d bytes, want 3 of 600", prompts, bytes)
+	}
+	if runs := synthesizer.runs.Load(); runs != 4 {
+		t.Errorf("engine ran %d times, want once for every text", runs)
+	}
+	if cache.cached("two") || !cache.cached("one") || !cache.cached("three") || !cache.cached("four") {
+		t.Error("evicted another prompt than the least recently used")
+	}
+
+	cache.resize(200, false)
+	if prompts, bytes := cache.held(); prompts != 1 || bytes != 200 || !cache.cached("four") {
+		t.Errorf("cache holds %d prompts of %d bytes after shrinking, want only the last one", prompts, bytes)
+	}
+}
+
+func TestTTSCacheKeepsPromptsInFlight(t *testing.T) {
+	cache := newTTSCache(400)
+	synthesizer := &countingSynthesizer{samples: 100}
+	release := make(chan struct{})
+	var slowRuns atomic.Int32
+	slow := func(key ttsKey) (*audioPrompt, error) {
+		slowRuns.Add(1)
+		<-release
+		return synthesizer.synthesize(key)
+	}
+	done := make(chan struct{})
+	go func() {
+		cache.prompt(context.Background(), ttsKey{text: "slow"}, slow)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); !cache.cached("slow"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("slow prompt never started")
+		}
+	}
+
+	// the cache overflows while the slow prompt is synthesized
+	for _, text := range []string{"one", "two", "three"} {
+		promptKept(t, cache, text, synthesizer.synthesize)
+	}
+	if !cache.cached("slow") {
+		t.Fatal("evicted a prompt being synthesized")
+	}
+	close(release)
+	<-done
+
+	promptKept(t, cache, "slow", slow)
+	if runs := slowRuns.Load(); runs != 1 {
+		t.Errorf("engine ran %d times for the slow prompt, want once", runs)
+	}
+	if prompts, bytes := cache.held(); prompts != 2 || bytes != 400 || !cache.cached("three") {
+		t.Errorf("cache holds %d prompts of %d bytes, want the slow and the last one", prompts, bytes)
+	}
+}
+
+func TestTTSCacheDeduplicatesInFlight(t *testing.T) {
+	cache := newTTSCache(1 << 20)
+	release := make(chan struct{})
+	var runs atomic.Int32
+	synthesize := func(key ttsKey) (*audioPrompt, error) {
+		runs.Add(1)
+		<-release
+		return &audioPrompt{}, nil
+	}
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			cache.prompt(context.Background(), ttsKey{text: "hello"}, synthesize)
+			done <- struct{}{}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	if runs.Load() != 1 {
+		t.Errorf("engine ran %d times for one text", runs.Load())
+	}
+}
+
+func TestTTSProviderKeepsCacheAcrossUpdates(t *testing.T) {
+	settings := TTSConfig{Command: "espeak-ng -w {output}", Voice: "en-us", Timeout: time.Second, CacheSize: 1}
+	provider := newTTSPromptProvider(settings)
+	synthesizer := &countingSynthesizer{samples: 100}
+	promptTwice(t, provider.cache, synthesizer)
+	cache := provider.cache
+
+	provider.update(settings)
+	settings.Timeout = 2 * time.Second
+	settings.Voice = "de"
+	provider.update(settings)
+	if prompts, _ := cache.held(); provider.cache != cache || prompts != 1 {
+		t.Fatalf("cache lost on an update of the timeout and the voice")
+	}
+	if engine := provider.engine.Load(); engine.settings.Timeout != 2*time.Second || engine.settings.Voice != "de" {
+		t.Errorf("settings not updated: %+v", engine.settings)
+	}
+
+	settings.Command = "piper --output_file {output}"
+	provider.update(settings)
+	if prompts, _ := cache.held(); prompts != 0 {
+		t.Error("prompts of the previous engine kept")
+	}
+	if command := provider.engine.Load().command; len(command) != 3 || command[0] != "piper" {
+		t.Errorf("command is %q", command)
+	}
+
+	promptTwice(t, provider.cache, synthesizer)
+	settings.CacheSize = 0
+	provider.update(settings)
+	if prompts, _ := cache.held(); prompts != 0 || cache.maxBytes != 0 {
+		t.Error("prompts kept after the cache was turned off")
+	}
+}
+
+func testWAV(channels int, rate int, samples []int16) []byte {
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt ")
+	wav = binary.LittleEndian.AppendUint32(wav, 16)
+	wav = binary.LittleEndian.AppendUint16(wav, 1)
+	wav = binary.LittleEndian.AppendUint16(wav, uint16(channels))
+	wav = binary.LittleEndian.AppendUint32(wav, uint32(rate))
+	wav = binary.LittleEndian.AppendUint32(wav, uint32(rate*channels*2))
+	wav = binary.LittleEndian.AppendUint16(wav, uint16(channels*2))
+	wav = binary.LittleEndian.AppendUint16(wav, 16)
+	wav = append(wav, "data"...)
+	// the size of the data is unknown when the engine wrote to a pipe
+	wav = binary.LittleEndian.AppendUint32(wav, 0xffffffff)
+	for _, sample := range samples {
+		wav = binary.LittleEndian.AppendUint16(wav, uint16(sample))
+	}
+	return wav
+}
+
+func TestParseWAV(t *testing.T) {
+	samples, channels, rate, err := parseWAV(testWAV(1, 16000, []int16{1, -2, 3}))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if channels != 1 || rate != 16000 || len(samples) != 3 || samples[1] != -2 {
+		t.Errorf("parsed %d channels at %d Hz: %v", channels, rate, samples)
+	}
+	if _, _, _, err := parseWAV([]byte("RIFF\x00\x00\x00\x00WAVE")); err == nil {
+		t.Error("WAV without data parsed")
+	}
+}
+
+func TestResampleToMix(t *testing.T) {
+	// 16 kHz mono to 48 kHz stereo, three times as many frames, each on both channels
+	pcm := resampleToMix([]int16{0, 300}, 1, 16000)
+	want := []int16{0, 0, 100, 100, 200, 200, 300, 300, 300, 300, 300, 300}
+	if len(pcm) != len(want) {
+		t.Fatalf("resampled to %v, want %v", pcm, want)
+	}
+	for i := range want {
+		if pcm[i] != want[i] {
+			t.Fatalf("resampled to %v, want %v", pcm, want)
+		}
+	}
+}
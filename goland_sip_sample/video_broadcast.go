@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ghettovoice/gosip/log"
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// with video.broadcast calls that negotiated the same codec and encoder settings share one videoBroadcast, which
+// renders and encodes once and hands every frame to the tracks of its subscribers. Each track still packetizes with
+// its own payload type, sequence numbers and timestamps. A subscriber starts with the next keyframe, and starts over
+// with one when it falls behind. Nothing per call is drawn, the scene is the menu one without the countdown, and there
+// is no quality ladder: the stream keeps the negotiated size and frame rate, at the lowest bitrate one of its
+// subscribers asks for
+const (
+	// PLIs of many callers are answered with one keyframe for all of them, no more often than this
+	broadcastKeyframeMinInterval = time.Millisecond * 500
+	// encoded frames waiting to be sent to one subscriber
+	broadcastSubscriberQueueLength = 2
+)
+
+// videoBroadcastKey tells which calls can share a broadcast. settings are without the bitrate,
+// that follows the subscribers
+type videoBroadcastKey struct {
+	codec    *videoCodec
+	settings EncoderSettings
+}
+
+// videoBroadcasts are the broadcasts calls of one server state share
+type videoBroadcasts struct {
+	mutex   sync.Mutex
+	vmr     *VoiceMenuResources
+	running map[videoBroadcastKey]*videoBroadcast
+}
+
+func newVideoBroadcasts(vmr *VoiceMenuResources) *videoBroadcasts {
+	return &videoBroadcasts{vmr: vmr, running: make(map[videoBroadcastKey]*videoBroadcast)}
+}
+
+type videoBroadcast struct {
+	key videoBroadcastKey
+	// the broadcasts it is running in
+	broadcasts *videoBroadcasts
+	encoder    VideoEncoder
+	stop       context.CancelFunc
+	// guards subscribers and their fields
+	mutex       sync.Mutex
+	subscribers map[*broadcastSubscriber]struct{}
+	// applied by the encoding goroutine, see broadcastKeyframeMinInterval
+	keyframeRequested atomic.Bool
+	_log              log.Logger
+}
+
+type broadcastSubscriber struct {
+	broadcast *videoBroadcast
+	// closed by unsubscribe
+	frames chan encodedFrame
+	// what the bitrate controller of the call asks for
+	bitrate int
+	// frames are left out until the next keyframe, they would not decode
+	waitingForKeyframe bool
+}
+
+// subscribe joins the broadcast for codec and settings, which is started if there is none. The call gets frames
+// from the frames of the subscriber until unsubscribe
+func (b *videoBroadcasts) subscribe(codec *videoCodec, settings EncoderSettings) (*broadcastSubscriber, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := videoBroadcastKey{codec: codec, settings: settings}
+	key.settings.Bitrate = 0
+	broadcast, running := b.running[key]
+	if !running {
+		var err error
+		if broadcast, err = b.start(key, settings.Bitrate); err != nil {
+			return nil, err
+		}
+		b.running[key] = broadcast
+	}
+
+	subscriber := &broadcastSubscriber{
+		broadcast:          broadcast,
+		frames:             make(chan encodedFrame, broadcastSubscriberQueueLength),
+		bitrate:            settings.Bitrate,
+		waitingForKeyframe: true,
+	}
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+	broadcast.subscribers[subscriber] = struct{}{}
+	broadcast.updateBitrate()
+	broadcast.keyframeRequested.Store(true)
+	broadcast._log.Infof("Call joined, %d subscribers", len(broadcast.subscribers))
+	return subscriber, nil
+}
+
+// unsubscribe leaves the broadcast, which stops when nobody is left
+func (b *videoBroadcasts) unsubscribe(subscriber *broadcastSubscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	broadcast := subscriber.broadcast
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+	if _, subscribed := broadcast.subscribers[subscriber]; !subscribed {
+		return
+	}
+	delete(broadcast.subscribers, subscriber)
+	close(subscriber.frames)
+	broadcast._log.Infof("Call left, %d subscribers", len(broadcast.subscribers))
+	if len(broadcast.subscribers) > 0 {
+		broadcast.updateBitrate()
+		return
+	}
+	delete(b.running, broadcast.key)
+	broadcast.stop()
+}
+
+// end stops broadcast and takes all subscribers off it. Their calls go on without video
+func (b *videoBroadcasts) end(broadcast *videoBroadcast) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.running[broadcast.key] == broadcast {
+		delete(b.running, broadcast.key)
+	}
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+	for subscriber := range broadcast.subscribers {
+		close(subscriber.frames)
+	}
+	broadcast.subscribers = make(map[*broadcastSubscriber]struct{})
+	broadcast.stop()
+}
+
+// start renders and encodes until the last subscriber leaves. must be called under the mutex
+func (b *videoBroadcasts) start(key videoBroadcastKey, bitrate int) (*videoBroadcast, error) {
+	broadcastLogger := logger.WithFields(log.Fields{logFieldBroadcast: fmt.Sprintf("%s %dx%d@%d",
+		key.codec.mimeType, key.settings.Width, key.settings.Height, key.settings.FPS)})
+	settings := key.settings
+	settings.Bitrate = bitrate
+	encoder, err := NewVideoEncoder(
+		key.codec.codecID,
+		image.NewRGBA(image.Rect(0, 0, settings.Width, settings.Height)),
+		settings,
+		broadcastLogger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	broadcast := &videoBroadcast{
+		key:         key,
+		broadcasts:  b,
+		encoder:     encoder,
+		stop:        stop,
+		subscribers: make(map[*broadcastSubscriber]struct{}),
+		_log:        broadcastLogger,
+	}
+	broadcastLogger.Info("Broadcast started")
+
+	frameSize := image.Pt(settings.Width, settings.Height)
+	free := make(chan *image.YCbCr, videoRenderBuffers)
+	for i := 0; i < videoRenderBuffers; i++ {
+		free <- newVideoFrame(frameSize)
+	}
+	rendered := make(chan renderedFrame, videoRenderBuffers)
+	frameInterval := time.Second / time.Duration(settings.FPS)
+	scene := menuVideoScene(time.Time{})
+	renderer := newSceneRenderer(b.vmr)
+	go renderVideoFrames(
+		ctx,
+		func() time.Duration { return frameInterval },
+		func() image.Point { return frameSize },
+		func(frame *image.YCbCr, i int) { renderer.draw(scene, frame, time.Now()) },
+		rendered,
+		free,
+	)
+	go broadcast.encodeFrames(rendered, free)
+	return broadcast, nil
+}
+
+// encodeFrames is the only goroutine that uses the encoder, it closes it when rendered is closed. A frame that
+// cannot be encoded ends the broadcast, the frames left are taken until rendering stopped
+func (b *videoBroadcast) encodeFrames(rendered <-chan renderedFrame, free chan<- *image.YCbCr) {
+	defer b._log.Info("Broadcast stopped")
+	defer b.encoder.Close()
+
+	var keyframeAt time.Time
+	ended := false
+	for frame := range rendered {
+		if ended {
+			free <- frame.image
+			continue
+		}
+		if time.Since(keyframeAt) >= broadcastKeyframeMinInterval && b.keyframeRequested.Swap(false) {
+			b.encoder.RequestKeyframe()
+		}
+		data, err := b.encoder.EncodeYCbCr(frame.index, frame.image)
+		free <- frame.image
+		if err != nil {
+			b._log.Errorf("Failed to encode video, ending the broadcast: %s", err)
+			b.broadcasts.end(b)
+			ended = true
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		keyframe := b.key.codec.isKeyframe(data)
+		if keyframe {
+			keyframeAt = time.Now()
+		}
+		b.fanOut(encodedFrame{data: data, tick: frame.tick}, keyframe)
+	}
+}
+
+// fanOut never blocks, a subscriber that does not take frames fast enough misses them until the next keyframe.
+// the subscribers share the data, it must not be modified
+func (b *videoBroadcast) fanOut(frame encodedFrame, keyframe bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for subscriber := range b.subscribers {
+		if subscriber.waitingForKeyframe && !keyframe {
+			continue
+		}
+		select {
+		case subscriber.frames <- frame:
+			subscriber.waitingForKeyframe = false
+		default:
+			videoFramesDroppedTotal.Inc()
+			subscriber.waitingForKeyframe = true
+			b.keyframeRequested.Store(true)
+		}
+	}
+}
+
+// updateBitrate runs the encoder at the lowest bitrate of the subscribers. An encoder that can not change it on the
+// fly keeps the one it was started with. must be called under the mutex
+func (b *videoBroadcast) updateBitrate() {
+	lowest := 0
+	for subscriber := range b.subscribers {
+		if lowest == 0 || subscriber.bitrate < lowest {
+			lowest = subscriber.bitrate
+		}
+	}
+	if lowest > 0 && b.encoder.ReconfiguresBitrate() {
+		b.encoder.SetBitrate(lowest)
+	}
+}
+
+// setBitrate takes the bitrate the bitrate controller of the call asks for
+func (s *broadcastSubscriber) setBitrate(bitrate int) {
+	s.broadcast.mutex.Lock()
+	defer s.broadcast.mutex.Unlock()
+	if _, subscribed := s.broadcast.subscribers[s]; !subscribed {
+		return
+	}
+	s.bitrate = bitrate
+	s.broadcast.updateBitrate()
+}
+
+// requestKeyframe asks for a keyframe for the call, which all subscribers get
+func (s *broadcastSubscriber) requestKeyframe() {
+	s.broadcast.keyframeRequested.Store(true)
+}
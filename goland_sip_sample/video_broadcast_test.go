@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"testing"
+	"time"
+)
+
+// failingEncoder fails every frame
+type failingEncoder struct {
+	closed bool
+}
+
+func (e *failingEncoder) InputImage() *image.RGBA                       { return nil }
+func (e *failingEncoder) FPS() int                                      { return 30 }
+func (e *failingEncoder) EncodeFrame(frameNum int) ([]byte, error)      { return nil, errors.New("broken") }
+func (e *failingEncoder) Flush() ([][]byte, error)                      { return nil, nil }
+func (e *failingEncoder) RequestKeyframe()                              {}
+func (e *failingEncoder) SetBitrate(bitrate int)                        {}
+func (e *failingEncoder) ReconfiguresBitrate() bool                     { return true }
+func (e *failingEncoder) Close()                                        { e.closed = true }
+func (e *failingEncoder) EncodeYCbCr(int, *image.YCbCr) ([]byte, error) { return e.EncodeFrame(0) }
+
+func TestBroadcastEndsWhenEncodingFails(t *testing.T) {
+	broadcasts := newVideoBroadcasts(nil)
+	encoder := &failingEncoder{}
+	ctx, stop := context.WithCancel(context.Background())
+	key := videoBroadcastKey{codec: videoCodecH264, settings: EncoderSettings{Width: 64, Height: 48, FPS: 30}}
+	broadcast := &videoBroadcast{
+		key:         key,
+		broadcasts:  broadcasts,
+		encoder:     encoder,
+		stop:        stop,
+		subscribers: make(map[*broadcastSubscriber]struct{}),
+		_log:        logger,
+	}
+	broadcasts.running[key] = broadcast
+	subscriber := &broadcastSubscriber{broadcast: broadcast, frames: make(chan encodedFrame, broadcastSubscriberQueueLength)}
+	broadcast.subscribers[subscriber] = struct{}{}
+
+	rendered := make(chan renderedFrame)
+	free := make(chan *image.YCbCr, 1)
+	done := make(chan struct{})
+	go func() {
+		broadcast.encodeFrames(rendered, free)
+		close(done)
+	}()
+	rendered <- renderedFrame{image: newVideoFrame(image.Pt(64, 48)), tick: time.Now()}
+	<-free
+
+	select {
+	case _, open := <-subscriber.frames:
+		if open {
+			t.Fatal("subscriber got a frame")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber frames not closed")
+	}
+	if ctx.Err() == nil {
+		t.Error("rendering not stopped")
+	}
+	if _, running := broadcasts.running[key]; running {
+		t.Error("broadcast still running")
+	}
+	// the call leaving later does nothing
+	broadcasts.unsubscribe(subscriber)
+
+	// frames rendered meanwhile are handed back until rendering stopped
+	rendered <- renderedFrame{image: newVideoFrame(image.Pt(64, 48)), tick: time.Now()}
+	<-free
+	close(rendered)
+	<-done
+	if !encoder.closed {
+		t.Error("encoder not closed")
+	}
+}
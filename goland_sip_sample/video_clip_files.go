@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// video clips are read from IVF files with VP8, VP9 or AV1, H.264 Annex B streams and MP4 files with H.264. Frames
+// keep the bitstream the track sends: temporal units for VP8, VP9 and AV1, access units with start codes for H.264
+const (
+	ivfSignature = "DKIF"
+	// frames per second of an Annex B stream whose SPS has no timing info
+	h264DefaultClipFPS = 25
+)
+
+var h264StartCode = []byte{0, 0, 0, 1}
+
+// h264 profiles whose SPS has chroma_format_idc and the scaling matrices, 7.3.2.1.1 of ITU-T H.264
+var h264HighProfileIDCs = []int{100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135}
+
+func readVideoClipFile(path string) (*videoClip, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var clip *videoClip
+	switch {
+	case bytes.HasPrefix(data, []byte(ivfSignature)):
+		clip, err = readIVFClip(data)
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		clip, err = readMP4Clip(data)
+	case bytes.HasPrefix(data, h264StartCode) || bytes.HasPrefix(data, h264StartCode[1:]):
+		clip, err = readH264Clip(data)
+	default:
+		err = errors.New("neither IVF, MP4 nor H.264 Annex B")
+	}
+	if err == nil {
+		err = clip.validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read video clip %s: %w", path, err)
+	}
+	return clip, nil
+}
+
+func readIVFClip(data []byte) (*videoClip, error) {
+	reader, header, err := ivfreader.NewWith(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	clip := &videoClip{}
+	switch header.FourCC {
+	case "VP80":
+		clip.codec = videoCodecVP8
+	case "VP90":
+		clip.codec = videoCodecVP9
+	case "AV01":
+		clip.codec = videoCodecAV1
+	default:
+		return nil, fmt.Errorf("unknown FourCC %q", header.FourCC)
+	}
+	if header.TimebaseNumerator == 0 || header.TimebaseDenominator == 0 {
+		return nil, errors.New("no timebase")
+	}
+
+	var first uint64
+	for {
+		frame, frameHeader, err := reader.ParseNextFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(clip.frames) == 0 {
+			first = frameHeader.Timestamp
+		}
+		if frameHeader.Timestamp < first {
+			return nil, errors.New("timestamps go back")
+		}
+		ticks := frameHeader.Timestamp - first
+		clip.frames = append(clip.frames, videoClipFrame{
+			data: frame,
+			at:   time.Duration(ticks * uint64(header.TimebaseNumerator) * uint64(time.Second) / uint64(header.TimebaseDenominator)),
+		})
+	}
+	clip.setDuration()
+	return clip, nil
+}
+
+// splitAnnexB returns the NAL units of an Annex B stream without their start codes
+func splitAnnexB(data []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			// the zero in front of a four byte start code, and trailing zeros, belong to no unit
+			units = append(units, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+// readH264Clip groups the NAL units into access units, 7.4.1.2.3 of ITU-T H.264: one begins with an access unit
+// delimiter, SPS, PPS or SEI after a slice, or with a slice that starts at the first macroblock
+func readH264Clip(data []byte) (*videoClip, error) {
+	fps := float64(h264DefaultClipFPS)
+	var frames [][]byte
+	var frame []byte
+	hasSlice := false
+	for _, unit := range splitAnnexB(data) {
+		if len(unit) == 0 {
+			continue
+		}
+		unitType := int(unit[0] & 0x1f)
+		isSlice := unitType == h264NALUnitTypeSlice || unitType == h264NALUnitTypeIDR
+		startsFrame := unitType >= h264NALUnitTypeSEI && unitType <= h264NALUnitTypeAUD
+		// first_mb_in_slice is ue(v), 0 is the single bit 1
+		firstMB := isSlice && len(unit) > 1 && unit[1]&0x80 != 0
+		if hasSlice && (startsFrame || firstMB) {
+			frames = append(frames, frame)
+			frame, hasSlice = nil, false
+		}
+		if unitType == h264NALUnitTypeSPS && len(frames) == 0 {
+			if rate, ok := h264FrameRate(unit); ok {
+				fps = rate
+			}
+		}
+		frame = append(append(frame, h264StartCode...), unit...)
+		hasSlice = hasSlice || isSlice
+	}
+	if hasSlice {
+		frames = append(frames, frame)
+	}
+
+	clip := &videoClip{codec: videoCodecH264}
+	for i, frame := range frames {
+		clip.frames = append(clip.frames, videoClipFrame{data: frame, at: time.Duration(float64(i) * float64(time.Second) / fps)})
+	}
+	clip.setDuration()
+	return clip, nil
+}
+
+// bitReader reads the RBSP of a NAL unit, with the emulation prevention bytes taken out
+type bitReader struct {
+	data []byte
+	bit  int
+	// set when reading past the end, everything read then is 0
+	overrun bool
+}
+
+func newRBSPReader(unit []byte) *bitReader {
+	rbsp := make([]byte, 0, len(unit))
+	zeros := 0
+	for _, b := range unit {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return &bitReader{data: rbsp}
+}
+
+func (r *bitReader) u(bits int) uint32 {
+	var value uint32
+	for ; bits > 0; bits-- {
+		if r.bit >= len(r.data)*8 {
+			r.overrun = true
+			return 0
+		}
+		value = value<<1 | uint32(r.data[r.bit/8]>>(7-r.bit%8))&1
+		r.bit++
+	}
+	return value
+}
+
+// ue is an Exp-Golomb code, 9.1 of ITU-T H.264
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 && !r.overrun {
+		zeros++
+		if zeros > 31 {
+			r.overrun = true
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.u(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	value := r.ue()
+	if value&1 == 1 {
+		return int32(value/2 + 1)
+	}
+	return -int32(value / 2)
+}
+
+// h264FrameRate reads the timing info of the VUI of an SPS, 7.3.2.1.1 and E.1.1 of ITU-T H.264.
+// false if there is none
+func h264FrameRate(sps []byte) (float64, bool) {
+	r := newRBSPReader(sps[1:])
+	profileIDC := int(r.u(8))
+	r.u(16) // constraint flags and level_idc
+	r.ue()  // seq_parameter_set_id
+	if containsInt(h264HighProfileIDCs, profileIDC) {
+		chromaFormatIDC := r.ue()
+		if chromaFormatIDC == 3 {
+			r.u(1) // separate_colour_plane_flag
+		}
+		r.ue()           // bit_depth_luma_minus8
+		r.ue()           // bit_depth_chroma_minus8
+		r.u(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.u(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.u(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					next = (last + r.se() + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.u(1) // delta_pic_order_always_zero_flag
+		r.se() // offset_for_non_ref_pic
+		r.se() // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		for i := uint32(0); i < cycle && !r.overrun; i++ {
+			r.se()
+		}
+	}
+	r.ue()           // max_num_ref_frames
+	r.u(1)           // gaps_in_frame_num_value_allowed_flag
+	r.ue()           // pic_width_in_mbs_minus1
+	r.ue()           // pic_height_in_map_units_minus1
+	if r.u(1) == 0 { // frame_mbs_only_flag
+		r.u(1) // mb_adaptive_frame_field_flag
+	}
+	r.u(1)           // direct_8x8_inference_flag
+	if r.u(1) == 1 { // frame_cropping_flag
+		r.ue()
+		r.ue()
+		r.ue()
+		r.ue()
+	}
+	if r.u(1) == 0 { // vui_parameters_present_flag
+		return 0, false
+	}
+
+	if r.u(1) == 1 { // aspect_ratio_info_present_flag
+		if r.u(8) == 255 { // Extended_SAR
+			r.u(32)
+		}
+	}
+	if r.u(1) == 1 { // overscan_info_present_flag
+		r.u(1)
+	}
+	if r.u(1) == 1 { // video_signal_type_present_flag
+		r.u(4)
+		if r.u(1) == 1 { // colour_description_present_flag
+			r.u(24)
+		}
+	}
+	if r.u(1) == 1 { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+	if r.u(1) == 0 { // timing_info_present_flag
+		return 0, false
+	}
+	numUnitsInTick, timeScale := r.u(32), r.u(32)
+	if r.overrun || numUnitsInTick == 0 || timeScale == 0 {
+		return 0, false
+	}
+	// a frame is two ticks, one per field
+	return float64(timeScale) / float64(2*numUnitsInTick), true
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+type mp4Box struct {
+	boxType string
+	data    []byte
+}
+
+// readMP4Boxes splits data into the boxes of ISO/IEC 14496-12 4.2
+func readMP4Boxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated MP4 box")
+		}
+		size, headerSize := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("truncated MP4 box")
+			}
+			size, headerSize = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, errors.New("truncated MP4 box")
+		}
+		boxes = append(boxes, mp4Box{boxType: string(data[4:8]), data: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// findMP4Box is the first box of the path, like "moov", "trak", each level is a box in the one before
+func findMP4Box(data []byte, path ...string) ([]byte, bool) {
+	for _, boxType := range path {
+		boxes, err := readMP4Boxes(data)
+		if err != nil {
+			return nil, false
+		}
+		found := false
+		for _, box := range boxes {
+			if box.boxType == boxType {
+				data, found = box.data, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// mp4Table reads the entries of a full box that has a version and flags, an entry count and entries of
+// fields 4 byte fields each after skip bytes
+func mp4Table(box []byte, skip int, fields int) ([][]uint32, error) {
+	if len(box) < 8+skip {
+		return nil, errors.New("truncated MP4 table")
+	}
+	count := int(binary.BigEndian.Uint32(box[4+skip:]))
+	entries := box[8+skip:]
+	if count > len(entries)/(4*fields) {
+		return nil, errors.New("truncated MP4 table")
+	}
+	table := make([][]uint32, count)
+	for i := range table {
+		table[i] = make([]uint32, fields)
+		for j := range table[i] {
+			table[i][j] = binary.BigEndian.Uint32(entries[(i*fields+j)*4:])
+		}
+	}
+	return table, nil
+}
+
+// readMP4Clip takes the first video track, which has to be H.264 in an avc1 or avc3 sample entry. Fragmented files
+// are not read. Frames are sent in decoding order, so there must be no B-frames
+func readMP4Clip(data []byte) (*videoClip, error) {
+	boxes, err := readMP4Boxes(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range boxes {
+		if box.boxType != "moov" {
+			continue
+		}
+		traks, err := readMP4Boxes(box.data)
+		if err != nil {
+			return nil, err
+		}
+		for _, trak := range traks {
+			if hdlr, ok := findMP4Box(trak.data, "mdia", "hdlr"); trak.boxType == "trak" && ok && len(hdlr) >= 12 && string(hdlr[8:12]) == "vide" {
+				return readMP4Track(data, trak.data)
+			}
+		}
+	}
+	return nil, errors.New("no video track")
+}
+
+func readMP4Track(file []byte, trak []byte) (*videoClip, error) {
+	// version 1 has 64 bit creation and modification times in front of the timescale
+	mdhd, ok := findMP4Box(trak, "mdia", "mdhd")
+	if !ok || len(mdhd) < 24 {
+		return nil, errors.New("no media header")
+	}
+	timescale := binary.BigEndian.Uint32(mdhd[12:])
+	if mdhd[0] == 1 {
+		timescale = binary.BigEndian.Uint32(mdhd[20:])
+	}
+	if timescale == 0 {
+		return nil, errors.New("no timescale")
+	}
+	stbl, ok := findMP4Box(trak, "mdia", "minf", "stbl")
+	if !ok {
+		return nil, errors.New("no sample table")
+	}
+
+	// the visual sample entry has 78 bytes before its boxes, ISO/IEC 14496-12 12.1.3
+	stsd, ok := findMP4Box(stbl, "stsd")
+	if !ok || len(stsd) < 8+8+78 {
+		return nil, errors.New("no sample description")
+	}
+	entries, err := readMP4Boxes(stsd[8:])
+	if err != nil || len(entries) == 0 {
+		return nil, errors.New("no sample description")
+	}
+	if entries[0].boxType != "avc1" && entries[0].boxType != "avc3" {
+		return nil, fmt.Errorf("the video is %s, only H.264 is read from MP4", entries[0].boxType)
+	}
+	avcC, ok := findMP4Box(entries[0].data[78:], "avcC")
+	if !ok {
+		return nil, errors.New("no avcC")
+	}
+	lengthSize, parameterSets, err := parseAVCDecoderConfiguration(avcC)
+	if err != nil {
+		return nil, err
+	}
+
+	stts, err := mp4TableOf(stbl, "stts", 2)
+	if err != nil {
+		return nil, err
+	}
+	stsc, err := mp4TableOf(stbl, "stsc", 3)
+	if err != nil {
+		return nil, err
+	}
+	// ctts is there for B-frames, or with the same offset for all samples
+	if ctts, present := findMP4Box(stbl, "ctts"); present {
+		offsets, err := mp4Table(ctts, 0, 2)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range offsets {
+			if entry[1] != offsets[0][1] {
+				return nil, errors.New("the video has B-frames")
+			}
+		}
+	}
+	sizes, err := mp4SampleSizes(stbl)
+	if err != nil {
+		return nil, err
+	}
+	chunkOffsets, err := mp4ChunkOffsets(stbl)
+	if err != nil {
+		return nil, err
+	}
+	if len(sizes) == 0 {
+		return nil, errors.New("no samples, fragmented MP4 is not read")
+	}
+
+	// decoding times from stts
+	var times []uint64
+	var t uint64
+	for _, entry := range stts {
+		for i := uint32(0); i < entry[0] && len(times) < len(sizes); i++ {
+			times = append(times, t)
+			t += uint64(entry[1])
+		}
+	}
+	if len(times) < len(sizes) {
+		return nil, errors.New("stts is shorter than the samples")
+	}
+
+	clip := &videoClip{codec: videoCodecH264}
+	sample := 0
+	for i := range stsc {
+		firstChunk, samplesPerChunk := int(stsc[i][0]), int(stsc[i][1])
+		lastChunk := len(chunkOffsets)
+		if i+1 < len(stsc) {
+			lastChunk = int(stsc[i+1][0]) - 1
+		}
+		if firstChunk < 1 || lastChunk > len(chunkOffsets) {
+			return nil, errors.New("stsc refers to chunks that are not there")
+		}
+		for chunk := firstChunk; chunk <= lastChunk; chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for j := 0; j < samplesPerChunk && sample < len(sizes); j++ {
+				end := offset + uint64(sizes[sample])
+				if end > uint64(len(file)) {
+					return nil, errors.New("sample beyond the end of the file")
+				}
+				frame, err := avccToAnnexB(file[offset:end], lengthSize, parameterSets)
+				if err != nil {
+					return nil, err
+				}
+				clip.frames = append(clip.frames, videoClipFrame{
+					data: frame,
+					at:   time.Duration(times[sample] * uint64(time.Second) / uint64(timescale)),
+				})
+				offset = end
+				sample++
+			}
+		}
+	}
+	if sample < len(sizes) {
+		return nil, errors.New("stsc leaves samples out")
+	}
+	// stts has how long the last frame is shown as well
+	clip.setDuration()
+	if duration := time.Duration(t * uint64(time.Second) / uint64(timescale)); duration > clip.frames[len(clip.frames)-1].at {
+		clip.duration = duration
+	}
+	return clip, nil
+}
+
+func mp4TableOf(stbl []byte, boxType string, fields int) ([][]uint32, error) {
+	box, ok := findMP4Box(stbl, boxType)
+	if !ok {
+		return nil, fmt.Errorf("no %s", boxType)
+	}
+	return mp4Table(box, 0, fields)
+}
+
+func mp4SampleSizes(stbl []byte) ([]uint32, error) {
+	stsz, ok := findMP4Box(stbl, "stsz")
+	if !ok || len(stsz) < 12 {
+		return nil, errors.New("no stsz")
+	}
+	if size := binary.BigEndian.Uint32(stsz[4:]); size != 0 {
+		sizes := make([]uint32, binary.BigEndian.Uint32(stsz[8:]))
+		for i := range sizes {
+			sizes[i] = size
+		}
+		return sizes, nil
+	}
+	table, err := mp4Table(stsz, 4, 1)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]uint32, len(table))
+	for i, entry := range table {
+		sizes[i] = entry[0]
+	}
+	return sizes, nil
+}
+
+func mp4ChunkOffsets(stbl []byte) ([]uint64, error) {
+	if stco, ok := findMP4Box(stbl, "stco"); ok {
+		table, err := mp4Table(stco, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make([]uint64, len(table))
+		for i, entry := range table {
+			offsets[i] = uint64(entry[0])
+		}
+		return offsets, nil
+	}
+	co64, ok := findMP4Box(stbl, "co64")
+	if !ok {
+		return nil, errors.New("no chunk offsets")
+	}
+	table, err := mp4Table(co64, 0, 2)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, len(table))
+	for i, entry := range table {
+		offsets[i] = uint64(entry[0])<<32 | uint64(entry[1])
+	}
+	return offsets, nil
+}
+
+// parseAVCDecoderConfiguration returns the size of the NAL unit lengths, and SPS and PPS in Annex B,
+// ISO/IEC 14496-15 5.3.3.1
+func parseAVCDecoderConfiguration(avcC []byte) (int, []byte, error) {
+	if len(avcC) < 6 {
+		return 0, nil, errors.New("truncated avcC")
+	}
+	lengthSize := int(avcC[4]&0x03) + 1
+	var parameterSets []byte
+	rest := avcC[5:]
+	for _, countMask := range []byte{0x1f, 0xff} {
+		if len(rest) < 1 {
+			return 0, nil, errors.New("truncated avcC")
+		}
+		count := int(rest[0] & countMask)
+		rest = rest[1:]
+		for i := 0; i < count; i++ {
+			if len(rest) < 2 || int(binary.BigEndian.Uint16(rest)) > len(rest)-2 {
+				return 0, nil, errors.New("truncated avcC")
+			}
+			length := int(binary.BigEndian.Uint16(rest))
+			parameterSets = append(append(parameterSets, h264StartCode...), rest[2:2+length]...)
+			rest = rest[2+length:]
+		}
+	}
+	return lengthSize, parameterSets, nil
+}
+
+// avccToAnnexB replaces the lengths in front of the NAL units of a sample by start codes. Keyframes get the parameter
+// sets, which MP4 keeps out of the samples
+func avccToAnnexB(sample []byte, lengthSize int, parameterSets []byte) ([]byte, error) {
+	var frame []byte
+	for len(sample) > 0 {
+		if len(sample) < lengthSize {
+			return nil, errors.New("truncated NAL unit length")
+		}
+		length := 0
+		for _, b := range sample[:lengthSize] {
+			length = length<<8 | int(b)
+		}
+		if length > len(sample)-lengthSize {
+			return nil, errors.New("truncated NAL unit")
+		}
+		frame = append(append(frame, h264StartCode...), sample[lengthSize:lengthSize+length]...)
+		sample = sample[lengthSize+length:]
+	}
+	if h264IsKeyframe(frame) {
+		frame = append(append([]byte{}, parameterSets...), frame...)
+	}
+	return frame, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		want   [][]byte
+	}{
+		{
+			name:   "four and three byte start codes",
+			stream: []byte{0, 0, 0, 1, 0x67, 1, 2, 0, 0, 1, 0x68, 3, 0, 0, 0, 1, 0x65, 4},
+			want:   [][]byte{{0x67, 1, 2}, {0x68, 3}, {0x65, 4}},
+		},
+		{
+			name:   "trailing zeros",
+			stream: []byte{0, 0, 1, 0x09, 0xf0, 0, 0, 0, 0, 0, 1, 0x65, 4},
+			want:   [][]byte{{0x09, 0xf0}, {0x65, 4}},
+		},
+		{
+			name:   "garbage before the first start code",
+			stream: []byte{7, 7, 0, 0, 1, 0x65, 4},
+			want:   [][]byte{{0x65, 4}},
+		},
+		{
+			name:   "no start code",
+			stream: []byte{0x65, 4, 0, 0},
+		},
+		{
+			name:   "start code at the end",
+			stream: []byte{0, 0, 1, 0x65, 4, 0, 0, 1},
+			want:   [][]byte{{0x65, 4}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			units := splitAnnexB(test.stream)
+			if len(units) != len(test.want) {
+				t.Fatalf("got units % x, want % x", units, test.want)
+			}
+			for i := range units {
+				if !bytes.Equal(units[i], test.want[i]) {
+					t.Errorf("unit %d is % x, want % x", i, units[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// testBits writes an RBSP bit by bit
+type testBits struct {
+	bits []byte
+}
+
+func (w *testBits) u(bits int, value uint32) *testBits {
+	for i := bits - 1; i >= 0; i-- {
+		w.bits = append(w.bits, byte(value>>i)&1)
+	}
+	return w
+}
+
+func (w *testBits) ue(value uint32) *testBits {
+	value++
+	length := 0
+	for v := value; v > 1; v >>= 1 {
+		length++
+	}
+	return w.u(length, 0).u(length+1, value)
+}
+
+// nalUnit ends the RBSP with the stop bit and adds the header and the emulation prevention bytes
+func (w *testBits) nalUnit(header byte) []byte {
+	w.u(1, 1)
+	for len(w.bits)%8 != 0 {
+		w.u(1, 0)
+	}
+	unit := []byte{header}
+	zeros := 0
+	for i := 0; i < len(w.bits); i += 8 {
+		var b byte
+		for _, bit := range w.bits[i : i+8] {
+			b = b<<1 | bit
+		}
+		if zeros == 2 && b <= 3 {
+			unit = append(unit, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		unit = append(unit, b)
+	}
+	return unit
+}
+
+// testSPS is a 320x240 SPS of profile, with a VUI of the timing info if timeScale is not 0
+func testSPS(profileIDC uint32, numUnitsInTick uint32, timeScale uint32) []byte {
+	w := &testBits{}
+	w.u(8, profileIDC).u(8, 0).u(8, 30).ue(0)
+	if containsInt(h264HighProfileIDCs, int(profileIDC)) {
+		// chroma_format_idc, bit depths, transform bypass, and a scaling matrix with one list of all 16: a delta
+		// of 8, se(v) 8 is ue(v) 15, and 15 deltas of 0
+		w.ue(1).ue(0).ue(0).u(1, 0).u(1, 1)
+		w.u(1, 1).ue(15)
+		for i := 1; i < 16; i++ {
+			w.ue(0)
+		}
+		for i := 1; i < 8; i++ {
+			w.u(1, 0)
+		}
+	}
+	// frame_num, pic_order_cnt_type 2, reference frames, gaps, 20x15 macroblocks, frame_mbs_only, direct_8x8,
+	// no cropping
+	w.ue(0).ue(2).ue(1).u(1, 0).ue(19).ue(14).u(1, 1).u(1, 1).u(1, 0)
+	if timeScale == 0 {
+		w.u(1, 0)
+		return w.nalUnit(0x67)
+	}
+	// a VUI with only the timing info and fixed_frame_rate_flag
+	w.u(1, 1).u(1, 0).u(1, 0).u(1, 0).u(1, 0)
+	w.u(1, 1).u(32, numUnitsInTick).u(32, timeScale).u(1, 1)
+	// no HRD, no bitstream restriction
+	w.u(1, 0).u(1, 0).u(1, 0).u(1, 0)
+	return w.nalUnit(0x67)
+}
+
+func TestH264FrameRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		sps   []byte
+		fps   float64
+		timed bool
+	}{
+		// 1 written in 32 bits is 00 00 00 01, which needs an emulation prevention byte
+		{name: "baseline", sps: testSPS(66, 1, 60), fps: 30, timed: true},
+		{name: "high with a scaling matrix", sps: testSPS(100, 1001, 60000), fps: 60000.0 / 2002, timed: true},
+		{name: "no VUI", sps: testSPS(66, 0, 0)},
+		{name: "no ticks", sps: testSPS(66, 0, 50)},
+		{name: "truncated", sps: testSPS(66, 1, 60)[:12]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fps, timed := h264FrameRate(test.sps)
+			if timed != test.timed || fps != test.fps {
+				t.Errorf("%v fps, timing %t, want %v and %t", fps, timed, test.fps, test.timed)
+			}
+		})
+	}
+}
+
+func annexB(units ...[]byte) []byte {
+	var stream []byte
+	for _, unit := range units {
+		stream = append(append(stream, h264StartCode...), unit...)
+	}
+	return stream
+}
+
+var (
+	testPPS = []byte{0x68, 0xce, 0x38, 0x80}
+	// the first bit after the header is first_mb_in_slice, 1 is macroblock 0
+	testIDRSlice    = []byte{0x65, 0x88, 0x84}
+	testSlice       = []byte{0x41, 0x9a, 0x21}
+	testSecondSlice = []byte{0x41, 0x40, 0x21}
+	testAUD         = []byte{0x09, 0xf0}
+)
+
+func TestReadH264Clip(t *testing.T) {
+	sps := testSPS(66, 1, 60)
+	stream := annexB(sps, testPPS, testIDRSlice, testSlice, testSecondSlice, testAUD, testSlice)
+	// zeros between the units belong to none of them
+	stream = append(append(stream, 0, 0, 0), annexB(testAUD, testSlice)...)
+
+	clip, err := readH264Clip(stream)
+	if err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	want := [][]byte{
+		annexB(sps, testPPS, testIDRSlice),
+		annexB(testSlice, testSecondSlice),
+		annexB(testAUD, testSlice),
+		annexB(testAUD, testSlice),
+	}
+	if len(clip.frames) != len(want) {
+		t.Fatalf("%d access units, want %d", len(clip.frames), len(want))
+	}
+	for i, frame := range clip.frames {
+		if !bytes.Equal(frame.data, want[i]) {
+			t.Errorf("access unit %d is % x, want % x", i, frame.data, want[i])
+		}
+		// 30 fps from the SPS
+		if at := time.Duration(i) * time.Second / 30; frame.at < at-time.Microsecond || frame.at > at+time.Microsecond {
+			t.Errorf("access unit %d at %s, want %s", i, frame.at, at)
+		}
+	}
+	if !h264IsKeyframe(clip.frames[0].data) || h264IsKeyframe(clip.frames[1].data) {
+		t.Error("only the first access unit is a keyframe")
+	}
+}
+
+func TestReadH264ClipDefaultFrameRate(t *testing.T) {
+	clip, err := readH264Clip(annexB(testSPS(66, 0, 0), testPPS, testIDRSlice, testSlice))
+	if err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	if len(clip.frames) != 2 || clip.frames[1].at != time.Second/h264DefaultClipFPS {
+		t.Errorf("frames %+v, want the second one after %s", clip.frames, time.Second/h264DefaultClipFPS)
+	}
+}
+
+// testIVF is an IVF file of fourCC with a timebase of 1/1000 and a frame at each of the timestamps
+func testIVF(fourCC string, timestamps ...uint64) []byte {
+	file := []byte(ivfSignature)
+	file = binary.LittleEndian.AppendUint16(file, 0)
+	file = binary.LittleEndian.AppendUint16(file, 32)
+	file = append(file, fourCC...)
+	file = binary.LittleEndian.AppendUint16(file, 320)
+	file = binary.LittleEndian.AppendUint16(file, 240)
+	file = binary.LittleEndian.AppendUint32(file, 1000)
+	file = binary.LittleEndian.AppendUint32(file, 1)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(timestamps)))
+	file = binary.LittleEndian.AppendUint32(file, 0)
+	for i, timestamp := range timestamps {
+		// a VP8 frame tag, the first one is a keyframe
+		frame := []byte{0x01, 0x02, 0x03}
+		if i == 0 {
+			frame[0] = 0x00
+		}
+		file = binary.LittleEndian.AppendUint32(file, uint32(len(frame)))
+		file = binary.LittleEndian.AppendUint64(file, timestamp)
+		file = append(file, frame...)
+	}
+	return file
+}
+
+func TestReadIVFClip(t *testing.T) {
+	clip, err := readIVFClip(testIVF("VP80", 1000, 1033, 1066, 1066))
+	if err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	if clip.codec != videoCodecVP8 {
+		t.Errorf("codec %s, want VP8", clip.codec.mimeType)
+	}
+	// from the first timestamp on
+	want := []time.Duration{0, 33 * time.Millisecond, 66 * time.Millisecond, 66 * time.Millisecond}
+	if len(clip.frames) != len(want) {
+		t.Fatalf("%d frames, want %d", len(clip.frames), len(want))
+	}
+	for i, frame := range clip.frames {
+		if frame.at != want[i] {
+			t.Errorf("frame %d at %s, want %s", i, frame.at, want[i])
+		}
+	}
+}
+
+func TestReadIVFClipErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{name: "timestamps going back", file: testIVF("VP80", 100, 133, 50), want: "timestamps go back"},
+		{name: "unknown codec", file: testIVF("H264", 0), want: "unknown FourCC"},
+		{name: "no timebase", file: func() []byte {
+			file := testIVF("VP90", 0)
+			binary.LittleEndian.PutUint32(file[16:], 0)
+			return file
+		}(), want: "no timebase"},
+		// any error of the reader
+		{name: "truncated frame", file: testIVF("VP80", 0, 33)[:50], want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readIVFClip(test.file)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error with %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReadVideoClipFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+		return path
+	}
+
+	clip, err := readVideoClipFile(write("clip.h264", annexB(testSPS(66, 1, 60), testPPS, testIDRSlice, testSlice)))
+	if err != nil {
+		t.Fatalf("failed to read the H.264 clip: %s", err)
+	}
+	// the last frame is shown as long as the one before it
+	if clip.codec != videoCodecH264 || clip.duration < 66*time.Millisecond || clip.duration > 67*time.Millisecond {
+		t.Errorf("%s clip of %s", clip.codec.mimeType, clip.duration)
+	}
+
+	if _, err := readVideoClipFile(write("delta.h264", annexB(testSlice, testSlice))); err == nil || !strings.Contains(err.Error(), "no keyframe") {
+		t.Errorf("got %v for a clip starting without a keyframe", err)
+	}
+	if _, err := readVideoClipFile(write("clip.txt", []byte("hello"))); err == nil || !strings.Contains(err.Error(), "neither IVF") {
+		t.Errorf("got %v for a text file", err)
+	}
+	if _, err := readVideoClipFile(filepath.Join(dir, "missing.ivf")); err == nil {
+		t.Error("missing file read")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// video clips are prompts encoded beforehand, listed by name in resources.videoClips with a file for each codec
+// calls may negotiate. They are sent as they are on the video track of the call in place of the scene, paced by
+// their own timestamps, which are taken to the media clock of the call. The encoder rests meanwhile. After the clips
+// the scene is sent again from a keyframe on, which is requested when they end
+const (
+	// how long a clip of a single frame shows it
+	videoClipStillDuration = time.Second
+)
+
+type videoClipFrame struct {
+	data []byte
+	// from the start of the clip
+	at time.Duration
+}
+
+type videoClip struct {
+	codec  *videoCodec
+	frames []videoClipFrame
+	// the last frame is shown until then
+	duration time.Duration
+}
+
+// setDuration shows the last frame as long as the one before it
+func (c *videoClip) setDuration() {
+	switch n := len(c.frames); {
+	case n == 1:
+		c.duration = videoClipStillDuration
+	case n > 1:
+		c.duration = 2*c.frames[n-1].at - c.frames[n-2].at
+	}
+}
+
+// validate checks that the clip can be sent on its own: it starts with a keyframe and its time goes on
+func (c *videoClip) validate() error {
+	if len(c.frames) == 0 {
+		return errors.New("no frames")
+	}
+	if !c.codec.isKeyframe(c.frames[0].data) {
+		return errors.New("the first frame is no keyframe")
+	}
+	for i := 1; i < len(c.frames); i++ {
+		if c.frames[i].at < c.frames[i-1].at {
+			return errors.New("timestamps go back")
+		}
+	}
+	if c.duration <= c.frames[len(c.frames)-1].at {
+		c.duration = c.frames[len(c.frames)-1].at + videoClipStillDuration
+	}
+	return nil
+}
+
+// readVideoClips reads the files of each name, at most one per codec
+func readVideoClips(files map[string][]string) (map[string][]*videoClip, error) {
+	clips := make(map[string][]*videoClip)
+	for name, paths := range files {
+		for _, path := range paths {
+			clip, err := readVideoClipFile(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range clips[name] {
+				if other.codec == clip.codec {
+					return nil, fmt.Errorf("video clip %s has more than one %s file", name, clip.codec.mimeType)
+				}
+			}
+			clips[name] = append(clips[name], clip)
+		}
+	}
+	return clips, nil
+}
+
+// videoClip is the clip name for codec
+func (vmr *VoiceMenuResources) videoClip(name string, codec *videoCodec) (*videoClip, error) {
+	clips, known := vmr.videoClips[name]
+	if !known {
+		return nil, fmt.Errorf("unknown video clip %q", name)
+	}
+	for _, clip := range clips {
+		if clip.codec == codec {
+			return clip, nil
+		}
+	}
+	return nil, fmt.Errorf("video clip %q has no %s file", name, codec.mimeType)
+}
+
+// videoClipPlayback is what PlayVideoClips asked for
+type videoClipPlayback struct {
+	clips []*videoClip
+	loop  bool
+}
+
+// PlayVideoClips sends the clips one after another in place of the scene, over and over if loop, then the scene
+// again. Clips that are playing stop. Every clip needs a file for the codec of the call
+func (vmi *VoiceMenuInstance) PlayVideoClips(loop bool, names ...string) error {
+	if vmi._videoTrack == nil {
+		return errors.New("the call has no video")
+	}
+	if len(names) == 0 {
+		return errors.New("no video clips to play")
+	}
+	playback := &videoClipPlayback{loop: loop}
+	for _, name := range names {
+		clip, err := vmi._vmr.videoClip(name, vmi.videoCodec())
+		if err != nil {
+			return err
+		}
+		playback.clips = append(playback.clips, clip)
+	}
+	vmi._videoClipPlayback.Store(playback)
+	vmi.videoClipsChanged()
+	return nil
+}
+
+// StopVideoClips goes back to the scene
+func (vmi *VoiceMenuInstance) StopVideoClips() {
+	vmi._videoClipPlayback.Store(nil)
+	vmi.videoClipsChanged()
+}
+
+func (vmi *VoiceMenuInstance) videoClipsChanged() {
+	select {
+	case vmi._videoClipsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// videoClipPlayer sends clips for sendVideoFrames, from its goroutine
+type videoClipPlayer struct {
+	vmi *VoiceMenuInstance
+	// nil when the scene is sent
+	playback  *videoClipPlayback
+	clip      int
+	frame     int
+	clipStart time.Time
+	// fires when the next frame is due, or the clip ends
+	timer *time.Timer
+	// encoded frames are left out until a keyframe rendered after liveFrom
+	waitingForKeyframe bool
+	liveFrom           time.Time
+}
+
+func newVideoClipPlayer(vmi *VoiceMenuInstance) *videoClipPlayer {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &videoClipPlayer{vmi: vmi, timer: timer}
+}
+
+// start plays what PlayVideoClips asked for last, unless it already plays
+func (p *videoClipPlayer) start(now time.Time) {
+	playback := p.vmi._videoClipPlayback.Load()
+	if playback == p.playback {
+		return
+	}
+	if playback == nil {
+		p.end(now)
+		return
+	}
+	p.vmi._log.Infof("Playing %d video clips", len(playback.clips))
+	p.playback, p.clip, p.frame, p.clipStart = playback, 0, 0, now
+	p.vmi._videoClipPlaying.Store(true)
+	p.timer.Reset(0)
+}
+
+// sendDue sends the frames due at now, and waits for the next one
+func (p *videoClipPlayer) sendDue(now time.Time) {
+	for p.playback != nil {
+		clip := p.playback.clips[p.clip]
+		if p.frame < len(clip.frames) {
+			frame := clip.frames[p.frame]
+			at := p.clipStart.Add(frame.at)
+			if at.After(now) {
+				p.timer.Reset(at.Sub(now))
+				return
+			}
+			p.vmi.sendVideoFrame(encodedFrame{data: frame.data, tick: at})
+			p.frame++
+			continue
+		}
+
+		end := p.clipStart.Add(clip.duration)
+		if end.After(now) {
+			p.timer.Reset(end.Sub(now))
+			return
+		}
+		p.clip, p.frame, p.clipStart = p.clip+1, 0, end
+		if p.clip == len(p.playback.clips) {
+			if !p.playback.loop {
+				p.vmi._videoClipPlayback.CompareAndSwap(p.playback, nil)
+				p.end(end)
+				return
+			}
+			p.clip = 0
+		}
+	}
+}
+
+// end goes back to the scene from at on
+func (p *videoClipPlayer) end(at time.Time) {
+	if p.playback == nil {
+		return
+	}
+	p.vmi._log.Info("Video clips ended")
+	p.playback = nil
+	p.timer.Stop()
+	p.waitingForKeyframe, p.liveFrom = true, at
+	p.vmi._videoClipPlaying.Store(false)
+	p.vmi.requestKeyframe("end of video clips")
+}
+
+// sendsEncoded tells whether an encoded frame is sent: not while clips play, and after them from a keyframe on
+func (p *videoClipPlayer) sendsEncoded(frame encodedFrame) bool {
+	if p.playback != nil {
+		return false
+	}
+	if p.waitingForKeyframe {
+		keyframe := p.vmi.videoCodec().isKeyframe(frame.data)
+		if !frame.tick.After(p.liveFrom) {
+			// rendered while the clips played, the keyframe requested when they ended went into it
+			if keyframe {
+				p.vmi.requestKeyframe("end of video clips")
+			}
+			return false
+		}
+		if !keyframe {
+			return false
+		}
+		p.waitingForKeyframe = false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image"
+	"math"
+	"time"
+)
+
+// VideoCodecID names a codec independent of the encoder backend
+type VideoCodecID int
+
+const (
+	CODEC_ID_H264 VideoCodecID = iota + 1
+	CODEC_ID_VP8
+	CODEC_ID_VP9
+	CODEC_ID_AV1
+)
+
+// VideoEncoder turns what is drawn into its input image into frames of a bitstream. The backend is chosen at build
+// time: libavcodec by default (encode_ffmpeg.go), or with -tags stubencoder a pure Go encoder that needs neither cgo
+// nor the ffmpeg headers (encode_stub.go). Each backend provides NewVideoEncoder, videoEncoderSupports and
+// initVideoEncoder.
+//
+// EncodeFrame, Flush and Close must be called from one goroutine at a time, the other methods from any goroutine
+type VideoEncoder interface {
+	// InputImage is what the next frame is drawn into, its size is fixed for the life of the encoder
+	InputImage() *image.RGBA
+	FPS() int
+	// EncodeFrame encodes the input image as frame number frameNum. frame is nil when the encoder held the frame
+	// back. It belongs to the caller and stays valid after the encoder is closed
+	EncodeFrame(frameNum int) (frame []byte, err error)
+	// EncodeYCbCr is EncodeFrame for a 4:2:0 image in limited range BT.601, see video_yuv.go. An image of the size
+	// of the encoder is taken as it is, without the conversion EncodeFrame does, others are scaled
+	EncodeYCbCr(frameNum int, image *image.YCbCr) (frame []byte, err error)
+	// Flush ends the stream and returns the frames the encoder held back. Nothing can be encoded after it
+	Flush() (frames [][]byte, err error)
+	// RequestKeyframe makes the next frame encoded a keyframe the receiver can start decoding from.
+	// requests until then are coalesced, so a burst of PLIs costs a single keyframe
+	RequestKeyframe()
+	// SetBitrate changes the target bitrate starting with the next frame, see ReconfiguresBitrate
+	SetBitrate(bitrate int)
+	// ReconfiguresBitrate tells whether SetBitrate takes effect, an encoder that can not has to be created anew
+	// for another bitrate
+	ReconfiguresBitrate() bool
+	// Close flushes the encoder if that was not done, dropping what it held back, and releases all it allocated.
+	// closing twice does nothing
+	Close()
+}
+
+// EncoderSettings is what an encoder is created with. Width and Height may be smaller than the input image,
+// which is scaled down to them
+type EncoderSettings struct {
+	Width   int
+	Height  int
+	FPS     int
+	Bitrate int
+	// frames between periodic keyframes, see keyframeIntervalFrames
+	GOPSize int
+	// x264 profile and level_idc the receiver can decode, empty and 0 let the encoder choose
+	Profile string
+	Level   int
+}
+
+// keyframeIntervalFrames converts the configured keyframe interval to a GOP length at fps, at least one frame
+func keyframeIntervalFrames(interval time.Duration, fps int) int {
+	frames := int(math.Round(interval.Seconds() * float64(fps)))
+	if frames < 1 {
+		return 1
+	}
+	return frames
+}
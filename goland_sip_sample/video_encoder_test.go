@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"image"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// these run against the backend the test is built with, libavcodec by default or the stub with -tags stubencoder.
+// What the cgo backend allocates in C is checked by running them with go test -asan, which reports every block
+// still allocated when the test binary exits
+const encoderLifecycleRounds = 100
+
+func testEncoderSettings() EncoderSettings {
+	return EncoderSettings{Width: 320, Height: 240, FPS: 30, Bitrate: 300000, GOPSize: keyframeIntervalFrames(2*time.Second, 30)}
+}
+
+func newTestVideoEncoder(t *testing.T) VideoEncoder {
+	t.Helper()
+	initVideoEncoder()
+	settings := testEncoderSettings()
+	encoder, err := NewVideoEncoder(CODEC_ID_H264, image.NewRGBA(image.Rect(0, 0, settings.Width, settings.Height)), settings, logger)
+	if err != nil {
+		t.Fatalf("failed to create the encoder: %s", err)
+	}
+	return encoder
+}
+
+func TestVideoEncoderContract(t *testing.T) {
+	encoder := newTestVideoEncoder(t)
+	defer encoder.Close()
+
+	if size := encoder.InputImage().Bounds().Size(); size != (image.Point{X: 320, Y: 240}) {
+		t.Errorf("input image of %v, want 320x240", size)
+	}
+	if fps := encoder.FPS(); fps != 30 {
+		t.Errorf("%d fps, want 30", fps)
+	}
+
+	frame, err := encoder.EncodeFrame(0)
+	if err != nil {
+		t.Fatalf("failed to encode the first frame: %s", err)
+	}
+	if frame != nil && !h264IsKeyframe(frame) {
+		t.Error("first frame is no keyframe")
+	}
+
+	var frames int
+	for frameNum := 1; frameNum < 10; frameNum++ {
+		if frameNum == 5 {
+			encoder.RequestKeyframe()
+		}
+		frame, err := encoder.EncodeFrame(frameNum)
+		if err != nil {
+			t.Fatalf("failed to encode frame %d: %s", frameNum, err)
+		}
+		if frame != nil {
+			frames++
+		}
+		if frameNum == 5 && frame != nil && !h264IsKeyframe(frame) {
+			t.Error("no keyframe after RequestKeyframe")
+		}
+	}
+
+	yuv := image.NewYCbCr(image.Rect(0, 0, 320, 240), image.YCbCrSubsampleRatio420)
+	if _, err := encoder.EncodeYCbCr(10, yuv); err != nil {
+		t.Errorf("failed to encode a 4:2:0 frame of the encoder size: %s", err)
+	}
+	scaled := image.NewYCbCr(image.Rect(0, 0, 640, 480), image.YCbCrSubsampleRatio420)
+	if _, err := encoder.EncodeYCbCr(11, scaled); err != nil {
+		t.Errorf("failed to encode a 4:2:0 frame to be scaled: %s", err)
+	}
+
+	encoder.SetBitrate(200000)
+	if _, err := encoder.EncodeFrame(12); err != nil {
+		t.Errorf("failed to encode after SetBitrate: %s", err)
+	}
+
+	held, err := encoder.Flush()
+	if err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	if frames+len(held) == 0 {
+		t.Error("no frames came out of the encoder")
+	}
+	if again, err := encoder.Flush(); err != nil || len(again) != 0 {
+		t.Errorf("second Flush gave %d frames and %v", len(again), err)
+	}
+	encoder.Close()
+	encoder.Close()
+}
+
+func TestVideoEncoderCloseWithoutFlush(t *testing.T) {
+	encoder := newTestVideoEncoder(t)
+	for frameNum := 0; frameNum < 3; frameNum++ {
+		if _, err := encoder.EncodeFrame(frameNum); err != nil {
+			t.Fatalf("failed to encode frame %d: %s", frameNum, err)
+		}
+	}
+	encoder.Close()
+	encoder.Close()
+}
+
+func encodersOpen(t *testing.T) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather the metrics: %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "voice_menu_video_encoders_open" {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatal("voice_menu_video_encoders_open is not registered")
+	return 0
+}
+
+// encodeRound creates an encoder, encodes a few frames, flushes and closes it
+func encodeRound(t *testing.T, flush bool) {
+	t.Helper()
+	encoder := newTestVideoEncoder(t)
+	for frameNum := 0; frameNum < 5; frameNum++ {
+		if _, err := encoder.EncodeFrame(frameNum); err != nil {
+			t.Fatalf("failed to encode frame %d: %s", frameNum, err)
+		}
+	}
+	// scaling allocates a second context and its own planes
+	scaled := image.NewYCbCr(image.Rect(0, 0, 160, 120), image.YCbCrSubsampleRatio420)
+	if _, err := encoder.EncodeYCbCr(5, scaled); err != nil {
+		t.Fatalf("failed to encode a 4:2:0 frame to be scaled: %s", err)
+	}
+	if flush {
+		if _, err := encoder.Flush(); err != nil {
+			t.Fatalf("failed to flush: %s", err)
+		}
+	}
+	encoder.Close()
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestVideoEncoderLifecycleReleasesEverything(t *testing.T) {
+	// the first round may set up what lives as long as the process
+	encodeRound(t, true)
+	open, goroutines, heap := encodersOpen(t), runtime.NumGoroutine(), heapInUse()
+
+	for round := 0; round < encoderLifecycleRounds; round++ {
+		encodeRound(t, round%2 == 0)
+	}
+
+	if now := encodersOpen(t); now != open {
+		t.Errorf("%v encoders open after %d rounds, %v before", now, encoderLifecycleRounds, open)
+	}
+	if now := runtime.NumGoroutine(); now > goroutines {
+		t.Errorf("%d goroutines after %d rounds, %d before", now, encoderLifecycleRounds, goroutines)
+	}
+	// an encoder holds at least its 300 kB input image, every leaked one would show
+	if now := heapInUse(); now > heap+1<<20 {
+		t.Errorf("Go heap grew from %d to %d bytes in %d rounds", heap, now, encoderLifecycleRounds)
+	}
+}
+
+func TestVideoEncoderFramesAreGoOwned(t *testing.T) {
+	encoder := newTestVideoEncoder(t)
+	var frames, copies [][]byte
+	for frameNum := 0; frameNum < 5; frameNum++ {
+		frame, err := encoder.EncodeFrame(frameNum)
+		if err != nil {
+			t.Fatalf("failed to encode frame %d: %s", frameNum, err)
+		}
+		if frame == nil {
+			continue
+		}
+		frames = append(frames, frame)
+		copies = append(copies, append([]byte(nil), frame...))
+	}
+	held, err := encoder.Flush()
+	if err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+	for _, frame := range held {
+		frames = append(frames, frame)
+		copies = append(copies, append([]byte(nil), frame...))
+	}
+	encoder.Close()
+
+	// whatever the encoder freed or reused is overwritten by the next allocations
+	for i := 0; i < 10; i++ {
+		encodeRound(t, true)
+	}
+	runtime.GC()
+	for i, frame := range frames {
+		if !bytes.Equal(frame, copies[i]) {
+			t.Errorf("frame %d changed after the encoder went on and was closed", i)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp"
+	"github.com/pion/webrtc/v4"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The caller tells what it can decode in the offer: the level of profile-level-id, max-fs and max-mbps in the
+// fmtp of H.264 (RFC 6184 8.1), max-fs and max-fr of VP8 (RFC 7741 6.1) and VP9 (RFC 9628 6), profile of AV1,
+// imageattr (RFC 6236) and framerate (RFC 4566). The configured video is fitted into that
+const (
+	h264MacroblockSize = 16
+
+	h264ProfileIDCBaseline = 0x42
+	h264ProfileIDCMain     = 0x4d
+	h264ProfileIDCHigh     = 0x64
+	// constraint_set3_flag, with level_idc 11 it means level 1b for baseline and main
+	h264ConstraintSet3 = 0x10
+	h264LevelIDC1b     = 9
+	// nal_unit_type values, Table 7-1 of ITU-T H.264. IDR is a slice of an IDR picture
+	h264NALUnitTypeSlice = 1
+	h264NALUnitTypeIDR   = 5
+	h264NALUnitTypeSEI   = 6
+	h264NALUnitTypeSPS   = 7
+	h264NALUnitTypePPS   = 8
+	h264NALUnitTypeAUD   = 9
+
+	fmtpProfileLevelID    = "profile-level-id"
+	fmtpPacketizationMode = "packetization-mode"
+	fmtpMaxFS             = "max-fs"
+	fmtpMaxMBPS           = "max-mbps"
+	fmtpMaxBR             = "max-br"
+	fmtpMaxFR             = "max-fr"
+	fmtpProfileID         = "profile-id"
+	fmtpAV1Profile        = "profile"
+)
+
+// profile and constraint bytes of profile-level-id that pion registers by default, only those can be answered
+var supportedH264Profiles = []string{"4200", "42e0", "4d00", "6400"}
+
+// h264Level are the limits of a level, Table A-1 of ITU-T H.264
+type h264Level struct {
+	// macroblocks per second
+	maxMBPS int
+	// macroblocks per frame
+	maxFS int
+	// kbit/s for baseline and main
+	maxBR int
+}
+
+var h264Levels = map[int]h264Level{
+	10:             {maxMBPS: 1485, maxFS: 99, maxBR: 64},
+	h264LevelIDC1b: {maxMBPS: 1485, maxFS: 99, maxBR: 128},
+	11:             {maxMBPS: 3000, maxFS: 396, maxBR: 192},
+	12:             {maxMBPS: 6000, maxFS: 396, maxBR: 384},
+	13:             {maxMBPS: 11880, maxFS: 396, maxBR: 768},
+	20:             {maxMBPS: 11880, maxFS: 396, maxBR: 2000},
+	21:             {maxMBPS: 19800, maxFS: 792, maxBR: 4000},
+	22:             {maxMBPS: 20250, maxFS: 1620, maxBR: 4000},
+	30:             {maxMBPS: 40500, maxFS: 1620, maxBR: 10000},
+	31:             {maxMBPS: 108000, maxFS: 3600, maxBR: 14000},
+	32:             {maxMBPS: 216000, maxFS: 5120, maxBR: 20000},
+	40:             {maxMBPS: 245760, maxFS: 8192, maxBR: 20000},
+	41:             {maxMBPS: 245760, maxFS: 8192, maxBR: 50000},
+	42:             {maxMBPS: 522240, maxFS: 8704, maxBR: 50000},
+	50:             {maxMBPS: 589824, maxFS: 22080, maxBR: 135000},
+	51:             {maxMBPS: 983040, maxFS: 36864, maxBR: 240000},
+	52:             {maxMBPS: 2073600, maxFS: 36864, maxBR: 240000},
+}
+
+// imageAttrValue is the x or y of an imageattr set: a single value, a list [a,b,c] or a range [min:max] or [min:step:max]
+type imageAttrValue struct {
+	values []int
+	min    int
+	step   int
+	max    int
+}
+
+func parseImageAttrValue(s string) (imageAttrValue, bool) {
+	if !strings.HasPrefix(s, "[") {
+		value, err := strconv.Atoi(s)
+		return imageAttrValue{values: []int{value}}, err == nil
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	if strings.Contains(s, ":") {
+		var bounds []int
+		for _, part := range strings.Split(s, ":") {
+			bound, err := strconv.Atoi(part)
+			if err != nil {
+				return imageAttrValue{}, false
+			}
+			bounds = append(bounds, bound)
+		}
+		switch len(bounds) {
+		case 2:
+			return imageAttrValue{min: bounds[0], step: 1, max: bounds[1]}, true
+		case 3:
+			if bounds[1] < 1 {
+				return imageAttrValue{}, false
+			}
+			return imageAttrValue{min: bounds[0], step: bounds[1], max: bounds[2]}, true
+		}
+		return imageAttrValue{}, false
+	}
+
+	var values []int
+	for _, part := range strings.Split(s, ",") {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return imageAttrValue{}, false
+		}
+		values = append(values, value)
+	}
+	return imageAttrValue{values: values}, true
+}
+
+// closest is the largest allowed value not above limit. false if all are above
+func (v imageAttrValue) closest(limit int) (int, bool) {
+	if v.values == nil {
+		if limit < v.min || v.max < v.min {
+			return 0, false
+		}
+		if limit > v.max {
+			limit = v.max
+		}
+		return v.min + (limit-v.min)/v.step*v.step, true
+	}
+
+	best := -1
+	for _, value := range v.values {
+		if value <= limit && value > best {
+			best = value
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	return best, true
+}
+
+type imageAttrSet struct {
+	x imageAttrValue
+	y imageAttrValue
+}
+
+// parseImageAttrRecv returns the sets the caller is willing to receive from the value of an imageattr attribute,
+// "97 send [x=800,y=640] recv [x=330,y=250] [x=[320:16:640],y=[240:16:480]]". nil for "recv *" or no recv at all
+func parseImageAttrRecv(value string) []imageAttrSet {
+	fields := strings.Fields(value)
+	var sets []imageAttrSet
+	inRecv := false
+	// the first field is the payload type
+	for i, field := range fields {
+		if i == 0 {
+			continue
+		}
+		switch {
+		case field == "recv":
+			inRecv = true
+			continue
+		case field == "send":
+			inRecv = false
+			continue
+		case !inRecv || !strings.HasPrefix(field, "["):
+			continue
+		}
+
+		set := imageAttrSet{}
+		var hasX, hasY bool
+		// the brackets of ranges are within the set, split on the commas between parameters only
+		for _, parameter := range splitImageAttrSet(strings.TrimSuffix(strings.TrimPrefix(field, "["), "]")) {
+			name, spec, found := strings.Cut(parameter, "=")
+			if !found {
+				continue
+			}
+			switch name {
+			case "x":
+				set.x, hasX = parseImageAttrValue(spec)
+			case "y":
+				set.y, hasY = parseImageAttrValue(spec)
+			}
+		}
+		if hasX && hasY {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+func splitImageAttrSet(s string) []string {
+	var parameters []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				parameters = append(parameters, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parameters, s[start:])
+}
+
+// videoCodec is a codec we can packetize, and encode if the encoder backend supports it
+type videoCodec struct {
+	mimeType     string
+	codecID      VideoCodecID
+	newPayloader func() rtp.Payloader
+	// tells from an encoded frame whether it can be decoded without the frames before it
+	isKeyframe func(frame []byte) bool
+}
+
+var (
+	videoCodecH264 = &videoCodec{
+		mimeType:     webrtc.MimeTypeH264,
+		codecID:      CODEC_ID_H264,
+		newPayloader: func() rtp.Payloader { return &codecs.H264Payloader{} },
+		isKeyframe:   h264IsKeyframe,
+	}
+	videoCodecVP8 = &videoCodec{
+		mimeType:     webrtc.MimeTypeVP8,
+		codecID:      CODEC_ID_VP8,
+		newPayloader: func() rtp.Payloader { return &codecs.VP8Payloader{EnablePictureID: true} },
+		// the inverted key frame flag of the frame tag, RFC 6386 9.1
+		isKeyframe: func(frame []byte) bool { return len(frame) > 0 && frame[0]&0x01 == 0 },
+	}
+	videoCodecVP9 = &videoCodec{
+		mimeType:     webrtc.MimeTypeVP9,
+		codecID:      CODEC_ID_VP9,
+		newPayloader: func() rtp.Payloader { return &codecs.VP9Payloader{} },
+		isKeyframe:   vp9IsKeyframe,
+	}
+	// only offered if the encoder backend has an AV1 encoder. pion's payloader takes single OBUs, see av1Payloader
+	videoCodecAV1 = &videoCodec{
+		mimeType:     webrtc.MimeTypeAV1,
+		codecID:      CODEC_ID_AV1,
+		newPayloader: func() rtp.Payloader { return &av1Payloader{} },
+		isKeyframe:   av1IsKeyframe,
+	}
+	videoCodecs = []*videoCodec{videoCodecH264, videoCodecVP8, videoCodecVP9, videoCodecAV1}
+)
+
+// h264IsKeyframe looks for an IDR slice among the NAL units of an Annex B frame
+func h264IsKeyframe(frame []byte) bool {
+	for i := 0; i+3 < len(frame); i++ {
+		if frame[i] == 0 && frame[i+1] == 0 && frame[i+2] == 1 {
+			if frame[i+3]&0x1f == h264NALUnitTypeIDR {
+				return true
+			}
+			i += 2
+		}
+	}
+	return false
+}
+
+// vp9IsKeyframe reads frame_type from the uncompressed header of profiles 0 to 2: frame_marker, profile_low_bit,
+// profile_high_bit, show_existing_frame, frame_type
+func vp9IsKeyframe(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&0x0c == 0
+}
+
+// videoCodecByName finds the codec of an rtpmap encoding name like VP8/90000
+func videoCodecByName(encoding string) *videoCodec {
+	name, _, _ := strings.Cut(encoding, "/")
+	for _, codec := range videoCodecs {
+		if strings.EqualFold(strings.TrimPrefix(codec.mimeType, "video/"), name) {
+			return codec
+		}
+	}
+	return nil
+}
+
+// videoOffer is the payload type of the offer we send with and what it tells about the decoder of the caller
+type videoOffer struct {
+	codec       *videoCodec
+	payloadType uint8
+	fmtpLine    string
+	// H.264 only
+	profileIDC int
+	levelIDC   int
+	// from the fmtp, 0 if not there. for H.264 max-fs and max-mbps may only raise the limits of the level,
+	// for VP8 and VP9 max-fs and max-fr are the limits
+	maxFS   int
+	maxMBPS int
+	maxBR   int
+	maxFR   int
+	// what the caller wants to receive, nil if it does not say
+	imageAttrs []imageAttrSet
+	// 0 if not there
+	frameRate float64
+}
+
+// parseVideoOffer picks the first payload type in order of preference that pion can answer and we can encode:
+// H.264 with fragmented NAL units, which is what we send, VP8, VP9 profile 0 or AV1 main profile. false if there is none
+func parseVideoOffer(mediaDescription *sdp.MediaDescription) (*videoOffer, bool) {
+	fmtpLines := make(map[string]string)
+	imageAttrs := make(map[string]string)
+	payloadTypeCodecs := make(map[string]*videoCodec)
+	var frameRate float64
+	for _, attr := range mediaDescription.Attributes {
+		payloadType, value, _ := strings.Cut(attr.Value, " ")
+		switch attr.Key {
+		case "rtpmap":
+			if codec := videoCodecByName(value); codec != nil && videoEncoderSupports(codec.codecID) {
+				payloadTypeCodecs[payloadType] = codec
+			}
+		case "fmtp":
+			fmtpLines[payloadType] = value
+		case "imageattr":
+			imageAttrs[payloadType] = attr.Value
+		case "framerate":
+			frameRate, _ = strconv.ParseFloat(attr.Value, 64)
+		}
+	}
+
+	// formats are listed in order of preference
+	for _, format := range mediaDescription.MediaName.Formats {
+		codec, known := payloadTypeCodecs[format]
+		if !known {
+			continue
+		}
+		payloadType, err := strconv.ParseUint(format, 10, 8)
+		if err != nil {
+			continue
+		}
+		offer := &videoOffer{
+			codec:       codec,
+			payloadType: uint8(payloadType),
+			fmtpLine:    fmtpLines[format],
+			frameRate:   frameRate,
+		}
+
+		parameters := parseFmtp(fmtpLines[format])
+		switch codec {
+		case videoCodecH264:
+			if !offer.parseH264Profile(parameters) {
+				continue
+			}
+			offer.maxMBPS, _ = strconv.Atoi(parameters[fmtpMaxMBPS])
+			offer.maxBR, _ = strconv.Atoi(parameters[fmtpMaxBR])
+		case videoCodecVP9:
+			// we encode 8 bit 4:2:0
+			if profileID, present := parameters[fmtpProfileID]; present && profileID != "0" {
+				continue
+			}
+			offer.maxFR, _ = strconv.Atoi(parameters[fmtpMaxFR])
+		case videoCodecVP8:
+			offer.maxFR, _ = strconv.Atoi(parameters[fmtpMaxFR])
+		case videoCodecAV1:
+			// main profile is 4:2:0
+			if profile, present := parameters[fmtpAV1Profile]; present && profile != "0" {
+				continue
+			}
+		}
+		offer.maxFS, _ = strconv.Atoi(parameters[fmtpMaxFS])
+
+		if imageAttr, present := imageAttrs[format]; present {
+			offer.imageAttrs = parseImageAttrRecv(imageAttr)
+		} else if imageAttr, present := imageAttrs["*"]; present {
+			offer.imageAttrs = parseImageAttrRecv(imageAttr)
+		}
+		return offer, true
+	}
+	return nil, false
+}
+
+// parseH264Profile takes profile and level from profile-level-id. false unless packetization mode is 1
+// and pion knows the profile
+func (o *videoOffer) parseH264Profile(parameters map[string]string) bool {
+	if parameters[fmtpPacketizationMode] != "1" {
+		return false
+	}
+	profileLevelID := strings.ToLower(parameters[fmtpProfileLevelID])
+	profile, err := hex.DecodeString(profileLevelID)
+	if err != nil || len(profile) != 3 || !containsString(supportedH264Profiles, profileLevelID[:4]) {
+		return false
+	}
+
+	o.profileIDC = int(profile[0])
+	o.levelIDC = int(profile[2])
+	if o.levelIDC == 11 && profile[1]&h264ConstraintSet3 != 0 && profile[0] != h264ProfileIDCHigh {
+		o.levelIDC = h264LevelIDC1b
+	}
+	return true
+}
+
+func parseFmtp(line string) map[string]string {
+	parameters := make(map[string]string)
+	for _, parameter := range strings.Split(line, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+		parameters[strings.ToLower(name)] = value
+	}
+	return parameters
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// profile is the x264 profile matching the offer, empty for other codecs
+func (o *videoOffer) profile() string {
+	if o.codec != videoCodecH264 {
+		return ""
+	}
+	switch o.profileIDC {
+	case h264ProfileIDCMain:
+		return "main"
+	case h264ProfileIDCHigh:
+		return "high"
+	}
+	return "baseline"
+}
+
+// limits of the H.264 level, raised by max-fs and max-mbps. an unknown level leaves the limits of the highest one.
+// VP8 and VP9 have no levels in SDP, only max-fs limits them. level-idx of AV1 is not looked at
+func (o *videoOffer) limits() h264Level {
+	if o.codec != videoCodecH264 {
+		level := h264Level{maxMBPS: math.MaxInt32, maxFS: math.MaxInt32, maxBR: math.MaxInt32}
+		if o.maxFS > 0 {
+			level.maxFS = o.maxFS
+		}
+		return level
+	}
+
+	level, known := h264Levels[o.levelIDC]
+	if !known {
+		level = h264Levels[52]
+	}
+	if o.maxFS > level.maxFS {
+		level.maxFS = o.maxFS
+	}
+	if o.maxMBPS > level.maxMBPS {
+		level.maxMBPS = o.maxMBPS
+	}
+	if o.maxBR > 0 {
+		level.maxBR = o.maxBR
+	}
+	return level
+}
+
+func macroblocks(width int, height int) int {
+	return ((width + h264MacroblockSize - 1) / h264MacroblockSize) * ((height + h264MacroblockSize - 1) / h264MacroblockSize)
+}
+
+// fitsLevel checks the frame size and, as A.3.1 of H.264 requires, that neither side is longer than sqrt(8 * MaxFS) macroblocks
+func fitsLevel(width int, height int, maxFS int) bool {
+	maxSide := int(math.Sqrt(float64(8*maxFS))) * h264MacroblockSize
+	return macroblocks(width, height) <= maxFS && width <= maxSide && height <= maxSide
+}
+
+// negotiateVideo fits the configured resolution, frame rate and bitrate into what the caller can decode.
+// the aspect ratio is kept unless imageattr asks for another one. imageattr never makes the video larger than
+// configured, sets that do not fit are ignored
+func negotiateVideo(videoConfig VideoConfig, offer *videoOffer) VideoConfig {
+	width, height := videoConfig.Width, videoConfig.Height
+
+	bestArea := 0
+	for _, set := range offer.imageAttrs {
+		x, fitsX := set.x.closest(videoConfig.Width)
+		y, fitsY := set.y.closest(videoConfig.Height)
+		if fitsX && fitsY && x*y > bestArea {
+			bestArea = x * y
+			width, height = x, y
+		}
+	}
+
+	limits := offer.limits()
+	for !fitsLevel(width, height, limits.maxFS) && width > h264MacroblockSize && height > h264MacroblockSize {
+		scale := math.Sqrt(float64(limits.maxFS) / float64(macroblocks(width, height)))
+		// rounding up to whole macroblocks may leave it just above, or only a side is too long
+		if scale > 0.95 {
+			scale = 0.95
+		}
+		width = int(float64(width) * scale)
+		height = int(float64(height) * scale)
+	}
+	width, height = width&^1, height&^1
+	if width < h264MacroblockSize {
+		width = h264MacroblockSize
+	}
+	if height < h264MacroblockSize {
+		height = h264MacroblockSize
+	}
+
+	fps := videoConfig.FPS
+	if levelFPS := limits.maxMBPS / macroblocks(width, height); levelFPS < fps {
+		fps = levelFPS
+	}
+	if offer.frameRate > 0 && int(offer.frameRate) < fps {
+		fps = int(offer.frameRate)
+	}
+	if offer.maxFR > 0 && offer.maxFR < fps {
+		fps = offer.maxFR
+	}
+	if fps < 1 {
+		fps = 1
+	}
+
+	bitrate := videoConfig.Bitrate
+	if levelBitrate := int64(limits.maxBR) * 1000; levelBitrate < int64(bitrate) {
+		bitrate = int(levelBitrate)
+	}
+
+	negotiated := videoConfig
+	negotiated.Width = width
+	negotiated.Height = height
+	negotiated.FPS = fps
+	negotiated.Bitrate = bitrate
+	if negotiated.InitialBitrate > bitrate {
+		negotiated.InitialBitrate = bitrate
+	}
+	return negotiated
+}
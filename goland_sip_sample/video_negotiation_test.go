@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/pion/sdp"
+	"reflect"
+	"testing"
+)
+
+func TestParseImageAttrValue(t *testing.T) {
+	tests := []struct {
+		spec string
+		want imageAttrValue
+		ok   bool
+	}{
+		{"640", imageAttrValue{values: []int{640}}, true},
+		{"[320,640,1280]", imageAttrValue{values: []int{320, 640, 1280}}, true},
+		{"[320:640]", imageAttrValue{min: 320, step: 1, max: 640}, true},
+		{"[320:16:640]", imageAttrValue{min: 320, step: 16, max: 640}, true},
+		{"[320:0:640]", imageAttrValue{}, false},
+		{"[320:16:32:640]", imageAttrValue{}, false},
+		{"[a,b]", imageAttrValue{}, false},
+		{"wide", imageAttrValue{values: []int{0}}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseImageAttrValue(test.spec)
+		if ok != test.ok || (ok && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("parseImageAttrValue(%q) = %+v, %t, want %+v, %t", test.spec, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestImageAttrValueClosest(t *testing.T) {
+	tests := []struct {
+		spec  string
+		limit int
+		want  int
+		ok    bool
+	}{
+		{"640", 1280, 640, true},
+		{"640", 320, 0, false},
+		{"[320,640,1920]", 1280, 640, true},
+		{"[1920,3840]", 1280, 0, false},
+		{"[320:16:640]", 1280, 640, true},
+		{"[320:16:640]", 500, 496, true},
+		{"[60000:1:65534]", 1280, 0, false},
+		{"[640:320]", 1280, 0, false},
+	}
+	for _, test := range tests {
+		value, _ := parseImageAttrValue(test.spec)
+		got, ok := value.closest(test.limit)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s closest to %d = %d, %t, want %d, %t", test.spec, test.limit, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseImageAttrRecv(t *testing.T) {
+	sets := parseImageAttrRecv("97 send [x=800,y=640] recv [x=330,y=250] [x=[320:16:640],y=[240:16:480],sar=1.1]")
+	want := []imageAttrSet{
+		{x: imageAttrValue{values: []int{330}}, y: imageAttrValue{values: []int{250}}},
+		{x: imageAttrValue{min: 320, step: 16, max: 640}, y: imageAttrValue{min: 240, step: 16, max: 480}},
+	}
+	if !reflect.DeepEqual(sets, want) {
+		t.Errorf("parseImageAttrRecv = %+v, want %+v", sets, want)
+	}
+	if sets := parseImageAttrRecv("97 recv *"); sets != nil {
+		t.Errorf("recv * gave %+v", sets)
+	}
+	if sets := parseImageAttrRecv("97 send [x=800,y=640]"); sets != nil {
+		t.Errorf("send only gave %+v", sets)
+	}
+}
+
+func TestParseVideoOfferImageAttr(t *testing.T) {
+	mediaDescription := &sdp.MediaDescription{
+		MediaName: sdp.MediaName{Media: "video", Formats: []string{"102"}},
+		Attributes: []sdp.Attribute{
+			{Key: "rtpmap", Value: "102 H264/90000"},
+			{Key: "fmtp", Value: "102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+			{Key: "imageattr", Value: "* recv [x=[60000:1:65534],y=[60000:1:65534]]"},
+		},
+	}
+	offer, ok := parseVideoOffer(mediaDescription)
+	if !ok {
+		t.Fatal("H.264 offer not taken")
+	}
+	if offer.levelIDC != 0x1f || offer.profile() != "baseline" || len(offer.imageAttrs) != 1 {
+		t.Errorf("offer parsed as %+v", offer)
+	}
+}
+
+func negotiationTestConfig() VideoConfig {
+	return VideoConfig{Width: 1280, Height: 720, FPS: 30, Bitrate: 2000000, InitialBitrate: 1000000}
+}
+
+func TestNegotiateVideoIgnoresImageAttrAboveConfigured(t *testing.T) {
+	// no level cap, only imageattr could make the canvas huge
+	offer := &videoOffer{
+		codec:      videoCodecVP8,
+		imageAttrs: parseImageAttrRecv("* recv [x=[60000:1:65534],y=[60000:1:65534]]"),
+	}
+	negotiated := negotiateVideo(negotiationTestConfig(), offer)
+	if negotiated.Width != 1280 || negotiated.Height != 720 {
+		t.Errorf("negotiated %dx%d, want the configured 1280x720", negotiated.Width, negotiated.Height)
+	}
+}
+
+func TestNegotiateVideoImageAttrClampedToConfigured(t *testing.T) {
+	offer := &videoOffer{
+		codec:      videoCodecVP8,
+		imageAttrs: parseImageAttrRecv("* recv [x=[320:16:1920],y=[240:16:1080]]"),
+	}
+	negotiated := negotiateVideo(negotiationTestConfig(), offer)
+	if negotiated.Width != 1280 || negotiated.Height != 720 {
+		t.Errorf("negotiated %dx%d, want 1280x720", negotiated.Width, negotiated.Height)
+	}
+}
+
+func TestNegotiateVideoPicksLargestFittingImageAttr(t *testing.T) {
+	offer := &videoOffer{
+		codec:      videoCodecVP8,
+		imageAttrs: parseImageAttrRecv("* recv [x=1920,y=1080] [x=640,y=480] [x=320,y=240]"),
+	}
+	negotiated := negotiateVideo(negotiationTestConfig(), offer)
+	if negotiated.Width != 640 || negotiated.Height != 480 {
+		t.Errorf("negotiated %dx%d, want 640x480", negotiated.Width, negotiated.Height)
+	}
+}
+
+func TestNegotiateVideoImageAttrFallsBackToLevel(t *testing.T) {
+	// level 3.0 takes 1620 macroblocks, 1280x720 has 3600
+	offer := &videoOffer{
+		codec:      videoCodecH264,
+		levelIDC:   30,
+		imageAttrs: parseImageAttrRecv("* recv [x=3840,y=2160]"),
+	}
+	negotiated := negotiateVideo(negotiationTestConfig(), offer)
+	if !fitsLevel(negotiated.Width, negotiated.Height, h264Levels[30].maxFS) {
+		t.Errorf("negotiated %dx%d does not fit level 3.0", negotiated.Width, negotiated.Height)
+	}
+	if negotiated.Width > 1280 || negotiated.Height > 720 || negotiated.Width < 640 {
+		t.Errorf("negotiated %dx%d, want it scaled down from 1280x720", negotiated.Width, negotiated.Height)
+	}
+}
+
+func TestNegotiateVideoLimitsFrameRateAndBitrate(t *testing.T) {
+	offer := &videoOffer{codec: videoCodecH264, levelIDC: 30, maxBR: 500}
+	negotiated := negotiateVideo(VideoConfig{Width: 640, Height: 480, FPS: 60, Bitrate: 2000000, InitialBitrate: 1000000}, offer)
+	// 40500 macroblocks per second of level 3.0 over 1200 of 640x480
+	if negotiated.FPS != 33 {
+		t.Errorf("negotiated %d fps, want 33", negotiated.FPS)
+	}
+	if negotiated.Bitrate != 500000 || negotiated.InitialBitrate != 500000 {
+		t.Errorf("negotiated %d bit/s starting at %d, want 500000", negotiated.Bitrate, negotiated.InitialBitrate)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"image"
+	"time"
+)
+
+// video is rendered, encoded and sent by goroutines of their own, connected by short queues. A slow encode delays
+// neither the next tick nor the timestamps, frames are stamped with the tick they were rendered for. When the encoder
+// falls behind, all images are taken and frames are dropped before they are rendered. Encoded frames are never
+// dropped, the frames after them would not decode
+const (
+	// images rendered into, one is drawn while another one is encoded
+	videoRenderBuffers = 2
+	// encoded frames waiting to be sent
+	videoSendQueueLength = 2
+)
+
+type renderedFrame struct {
+	image *image.YCbCr
+	index int
+	// what the RTP timestamp is taken from
+	tick time.Time
+}
+
+type encodedFrame struct {
+	data []byte
+	tick time.Time
+}
+
+// renderVideoFrames draws a frame on every tick until ctx is done. frameInterval is asked again after every tick,
+// the ticker follows when it changes. frames come from free and go to rendered, rendered is closed when done.
+// A frame from free that is not of frameSize is replaced by a new one that is
+func renderVideoFrames(
+	ctx context.Context,
+	frameInterval func() time.Duration,
+	frameSize func() image.Point,
+	draw func(frame *image.YCbCr, i int),
+	rendered chan<- renderedFrame,
+	free <-chan *image.YCbCr) {
+	defer close(rendered)
+
+	interval := frameInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; true; i++ {
+		var tick time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case tick = <-ticker.C:
+		}
+		if requested := frameInterval(); requested != interval {
+			interval = requested
+			ticker.Reset(interval)
+		}
+
+		var frame *image.YCbCr
+		select {
+		case frame = <-free:
+		default:
+			videoFramesDroppedTotal.Inc()
+			continue
+		}
+		if size := frameSize(); frame.Rect.Size() != size {
+			frame = newVideoFrame(size)
+		}
+		start := time.Now()
+		draw(frame, i)
+		videoRenderSeconds.Observe(time.Since(start).Seconds())
+		rendered <- renderedFrame{image: frame, index: i, tick: tick}
+	}
+}
+
+// videoFrameInterval is the time between frames at the quality the bitrate controller asks for
+func (vmi *VoiceMenuInstance) videoFrameInterval() time.Duration {
+	quality := int(vmi._videoQuality.Load())
+	return time.Second / time.Duration(videoQualityLevels[quality].fps(vmi._videoConfig))
+}
+
+// videoFrameSize is the size of the frames at the quality the bitrate controller asks for, the size of the encoder
+func (vmi *VoiceMenuInstance) videoFrameSize() image.Point {
+	quality := int(vmi._videoQuality.Load())
+	width, height := videoQualityLevels[quality].size(vmi._videoConfig)
+	return image.Pt(width, height)
+}
+
+// encodeVideoFrames is the only goroutine that encodes, and recreates the encoder when the quality or the bitrate
+// asks for it. encoded is closed once rendered is
+func (vmi *VoiceMenuInstance) encodeVideoFrames(rendered <-chan renderedFrame, free chan<- *image.YCbCr, encoded chan<- encodedFrame) {
+	defer close(encoded)
+
+	quality := int(vmi._videoQuality.Load())
+	encoderCreatedAt := time.Now()
+	for frame := range rendered {
+		// clips are sent instead, see videoClipPlayer
+		if vmi._videoClipPlaying.Load() {
+			free <- frame.image
+			continue
+		}
+		requested := int(vmi._videoQuality.Load())
+		// a new encoder starts with a keyframe, so it is not recreated for every change of the bitrate
+		bitrateOutdated := vmi._bitrateOutdated.Load() && time.Since(encoderCreatedAt) >= bitrateRecreateInterval
+		if requested != quality || bitrateOutdated {
+			quality = requested
+			if err := vmi.recreateEncoder(); err != nil {
+				vmi._log.Errorf("Failed to recreate the encoder, ending the call: %s", err)
+				vmi.Close()
+			}
+			encoderCreatedAt = time.Now()
+		}
+
+		// once the call is closed nothing is encoded anymore, the frames left are taken until rendering stopped
+		data, err := vmi.encodeVideoFrame(frame)
+		free <- frame.image
+		if err != nil {
+			vmi._log.Errorf("Failed to encode video, ending the call: %s", err)
+			vmi.Close()
+			continue
+		}
+		//keep feeding frames to the encoder, but don't send blanks
+		if data == nil {
+			continue
+		}
+		encoded <- encodedFrame{data: data, tick: frame.tick}
+	}
+}
+
+// separate function to defer mutex unlock
+func (vmi *VoiceMenuInstance) encodeVideoFrame(frame renderedFrame) ([]byte, error) {
+	vmi._connectionReInitMutex.RLock()
+	defer vmi._connectionReInitMutex.RUnlock()
+	if vmi._closed {
+		return nil, nil
+	}
+	return vmi._encoder.EncodeYCbCr(frame.index, frame.image)
+}
+
+// sendVideoFrames writes frames to the track as soon as they are encoded, until encoded is closed. While video clips
+// play their frames are written instead, see PlayVideoClips
+func (vmi *VoiceMenuInstance) sendVideoFrames(encoded <-chan encodedFrame) {
+	player := newVideoClipPlayer(vmi)
+	defer player.timer.Stop()
+	for {
+		select {
+		case frame, ok := <-encoded:
+			if !ok {
+				return
+			}
+			if player.sendsEncoded(frame) {
+				vmi.sendVideoFrame(frame)
+			}
+		case <-vmi._videoClipsChanged:
+			player.start(time.Now())
+		case <-player.timer.C:
+			player.sendDue(time.Now())
+		}
+	}
+}
+
+// sendVideoFrame ends the call if the frame cannot be written, frames after that are dropped
+func (vmi *VoiceMenuInstance) sendVideoFrame(frame encodedFrame) {
+	if err := vmi.writeVideoFrame(frame); err != nil {
+		vmi._log.Errorf("Failed to send video, ending the call: %s", err)
+		vmi.Close()
+	}
+}
+
+// separate function to defer mutex unlock
+func (vmi *VoiceMenuInstance) writeVideoFrame(frame encodedFrame) error {
+	vmi._connectionReInitMutex.RLock()
+	defer vmi._connectionReInitMutex.RUnlock()
+	if vmi._closed {
+		return nil
+	}
+	if err := vmi._videoTrack.writeFrame(frame.data, vmi._videoTrack.timestampAt(frame.tick)); err != nil {
+		return err
+	}
+	videoFrameDelaySeconds.Observe(time.Since(frame.tick).Seconds())
+	return nil
+}
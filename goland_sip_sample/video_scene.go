@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+)
+
+// a videoScene is what a menu screen shows. The IVR sets one per menu node with SetVideoScene, every frame draws the
+// latest one. Positions and sizes are fractions of the frame and font sizes are pixels of a frame sceneReferenceHeight
+// lines high, so a scene looks the same at every quality level. Scenes are not modified once set, changes copy them
+const (
+	sceneReferenceHeight = 720
+	// the height of a menu option line, in font sizes
+	sceneOptionLineHeight = 1.5
+)
+
+// sceneRect is a rectangle in fractions of the frame width and height
+type sceneRect struct {
+	X, Y, W, H float64
+}
+
+func (r sceneRect) in(bounds image.Rectangle) image.Rectangle {
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	return image.Rect(
+		bounds.Min.X+int(r.X*width),
+		bounds.Min.Y+int(r.Y*height),
+		bounds.Min.X+int((r.X+r.W)*width),
+		bounds.Min.Y+int((r.Y+r.H)*height),
+	)
+}
+
+// sceneImage is scaled to fit rect, keeping its aspect ratio. animations play from when the scene was set
+type sceneImage struct {
+	// registered in resources.images
+	asset string
+	rect  sceneRect
+}
+
+// sceneText is wrapped within rect, see textRenderer
+type sceneText struct {
+	text string
+	// registered in resources.fonts, empty for resources.font
+	font  string
+	size  float64
+	color color.Color
+	align textAlignment
+	// in font sizes, 0 for defaultLineSpacing
+	lineSpacing float64
+	rect        sceneRect
+}
+
+// sceneOption is one line of the menu, chosen with digit
+type sceneOption struct {
+	digit string
+	label string
+	// registered in resources.images, drawn before the label. empty for none
+	icon string
+}
+
+type videoScene struct {
+	// opaque, every frame is painted over it
+	background color.Color
+	// drawn in this order, texts on top of images
+	images []sceneImage
+	texts  []sceneText
+	// one line each from the top of optionsStyle.rect, in the font, size and alignment of optionsStyle
+	options      []sceneOption
+	optionsStyle sceneText
+	// index into options, -1 for none. the highlighted option is drawn in highlightTextColor on highlightColor
+	highlighted        int
+	highlightColor     color.Color
+	highlightTextColor color.Color
+	// the time left until countdownDeadline follows the text of countdownStyle, nothing is shown for a zero deadline
+	countdownDeadline time.Time
+	countdownStyle    sceneText
+	// what the caller entered so far, follows the text of digitsStyle
+	digits      string
+	digitsStyle sceneText
+	// when the scene was set, animations start there
+	shownAt time.Time
+}
+
+// menuVideoScene is shown until the IVR sets another one. deadline is when the call ends, zero when unknown
+func menuVideoScene(deadline time.Time) *videoScene {
+	return &videoScene{
+		background: RGBA_COLOR_GRAD_LIGHT,
+		texts: []sceneText{
+			{text: "Voice menu", size: 48, color: RGBA_COLOR_ORANGE, align: alignCenter, rect: sceneRect{0, 0.1, 1, 0.1}},
+			{text: "Press the keys of your phone", size: 24, color: RGBA_COLOR_BLACK, align: alignCenter, rect: sceneRect{0, 0.3, 1, 0.1}},
+		},
+		optionsStyle:       sceneText{size: 28, color: RGBA_COLOR_BLACK, align: alignLeft, rect: sceneRect{0.3, 0.4, 0.4, 0.3}},
+		highlighted:        -1,
+		highlightColor:     RGBA_COLOR_ORANGE,
+		highlightTextColor: RGBA_COLOR_WHITE,
+		countdownDeadline:  deadline,
+		countdownStyle:     sceneText{text: "Call ends in ", size: 24, color: RGBA_COLOR_ORANGE, align: alignRight, rect: sceneRect{0, 0.9, 0.95, 0.1}},
+		digitsStyle:        sceneText{text: "Entered: ", size: 40, color: RGBA_COLOR_BLACK, align: alignCenter, rect: sceneRect{0, 0.75, 1, 0.1}},
+		shownAt:            time.Now(),
+	}
+}
+
+// shown is a copy of the scene with its animations starting at now
+func (s *videoScene) shown(now time.Time) *videoScene {
+	scene := *s
+	scene.shownAt = now
+	return &scene
+}
+
+// withDigit is a copy of the scene with digit entered, and the option it chooses highlighted
+func (s *videoScene) withDigit(digit string) *videoScene {
+	scene := *s
+	scene.digits += digit
+	for i, option := range scene.options {
+		if option.digit == digit {
+			scene.highlighted = i
+		}
+	}
+	return &scene
+}
+
+// sceneRenderer draws scenes for one goroutine, see textRenderer. A scene is turned into a list of what to paint,
+// every frame buffer remembers the list it shows, and only where the lists differ is painted again. The countdown
+// repaints a few blocks once a second, a scene that does not change nothing at all
+const (
+	// frame buffers a sceneRenderer remembers, it forgets all of them beyond that and paints them anew
+	sceneRendererMaxFrames = 8
+	// more areas to paint than this are joined into the one rectangle around them
+	sceneMaxDirtyRects = 4
+)
+
+type sceneOpKind int
+
+const (
+	sceneOpFill sceneOpKind = iota
+	sceneOpText
+	sceneOpImage
+)
+
+// sceneOp paints nothing outside rect. ops are compared to find what changed, so they only hold comparable values
+type sceneOp struct {
+	kind  sceneOpKind
+	rect  image.Rectangle
+	color color.Color
+	text  string
+	style textStyle
+	// scaled to the size of rect, see scaledImageCache
+	image *image.RGBA
+}
+
+type sceneRenderer struct {
+	vmr  *VoiceMenuResources
+	text *textRenderer
+	// the ops each frame buffer shows
+	painted map[*image.YCbCr][]sceneOp
+}
+
+func newSceneRenderer(vmr *VoiceMenuResources) *sceneRenderer {
+	return &sceneRenderer{vmr: vmr, text: newTextRenderer(vmr), painted: make(map[*image.YCbCr][]sceneOp)}
+}
+
+// draw paints the scene as it is at now into frame, where it differs from what frame shows
+func (r *sceneRenderer) draw(scene *videoScene, frame *image.YCbCr, now time.Time) {
+	ops := r.sceneOps(scene, frame.Rect, now)
+	dirty := []image.Rectangle{frame.Rect}
+	if previous, known := r.painted[frame]; known {
+		dirty = changedRects(previous, ops)
+	}
+
+	repainted := 0
+	for _, rect := range dirty {
+		rect = rect.Intersect(frame.Rect)
+		p := &framePainter{frame: frame, clip: rect}
+		for _, op := range ops {
+			if op.rect.Overlaps(rect) {
+				r.paint(p, op)
+			}
+		}
+		repainted += rect.Dx() * rect.Dy()
+	}
+	videoRepaintedRatio.Observe(float64(repainted) / float64(frame.Rect.Dx()*frame.Rect.Dy()))
+
+	if len(r.painted) >= sceneRendererMaxFrames {
+		r.painted = make(map[*image.YCbCr][]sceneOp)
+	}
+	r.painted[frame] = ops
+}
+
+func (r *sceneRenderer) paint(p *framePainter, op sceneOp) {
+	switch op.kind {
+	case sceneOpFill:
+		p.fill(op.rect, op.color)
+	case sceneOpText:
+		r.text.drawText(p, op.rect, op.text, op.style)
+	case sceneOpImage:
+		p.drawImage(op.rect, op.image)
+	}
+}
+
+// sceneOps is what to paint for the scene at now into a frame of bounds, from the bottom up
+func (r *sceneRenderer) sceneOps(scene *videoScene, bounds image.Rectangle, now time.Time) []sceneOp {
+	elapsed := now.Sub(scene.shownAt)
+	ops := []sceneOp{{kind: sceneOpFill, rect: bounds, color: scene.background}}
+	for _, sceneImage := range scene.images {
+		ops = r.appendImageOp(ops, sceneImage.asset, sceneImage.rect.in(bounds), elapsed)
+	}
+	for _, sceneText := range scene.texts {
+		ops = append(ops, textOp(bounds, sceneText, sceneText.text, sceneText.color))
+	}
+
+	style := scene.optionsStyle
+	lineHeight := style.size * sceneOptionLineHeight / sceneReferenceHeight
+	for i, option := range scene.options {
+		line := style
+		line.rect.Y += float64(i) * lineHeight
+		line.rect.H = lineHeight
+		lineRect := line.rect.in(bounds)
+		textColor := style.color
+		if i == scene.highlighted {
+			ops = append(ops, sceneOp{kind: sceneOpFill, rect: lineRect, color: scene.highlightColor})
+			textColor = scene.highlightTextColor
+		}
+		if option.icon != "" {
+			// a square as high as the line, the label starts a quarter of that after it
+			iconRect := image.Rect(lineRect.Min.X, lineRect.Min.Y, lineRect.Min.X+lineRect.Dy(), lineRect.Max.Y)
+			ops = r.appendImageOp(ops, option.icon, iconRect, elapsed)
+			shift := float64(iconRect.Dx()*5/4) / float64(bounds.Dx())
+			line.rect.X += shift
+			line.rect.W -= shift
+		}
+		// the text in the middle of the line
+		line.rect.Y += (lineHeight - style.size/sceneReferenceHeight) / 2
+		ops = append(ops, textOp(bounds, line, fmt.Sprintf("%s %s", option.digit, option.label), textColor))
+	}
+
+	if !scene.countdownDeadline.IsZero() {
+		ops = append(ops, textOp(bounds, scene.countdownStyle, scene.countdownStyle.text+formatCountdown(scene.countdownDeadline.Sub(now)), scene.countdownStyle.color))
+	}
+	return append(ops, textOp(bounds, scene.digitsStyle, scene.digitsStyle.text+scene.digits, scene.digitsStyle.color))
+}
+
+// textOp draws label with the style and in the place of sceneText, scaled to a frame of bounds
+func textOp(bounds image.Rectangle, sceneText sceneText, label string, col color.Color) sceneOp {
+	scale := float64(bounds.Dy()) / sceneReferenceHeight
+	return sceneOp{kind: sceneOpText, rect: sceneText.rect.in(bounds), text: label, style: textStyle{
+		font:        sceneText.font,
+		size:        sceneText.size * scale,
+		color:       col,
+		align:       sceneText.align,
+		lineSpacing: sceneText.lineSpacing,
+	}}
+}
+
+// appendImageOp draws the frame of the asset shown elapsed after it started, fit into rect. unknown assets are left out
+func (r *sceneRenderer) appendImageOp(ops []sceneOp, name string, rect image.Rectangle, elapsed time.Duration) []sceneOp {
+	asset, ok := r.vmr.images[name]
+	if !ok {
+		return ops
+	}
+	frame := asset.frameAt(elapsed)
+	target := fitInside(asset.frames[frame].Bounds().Size(), rect)
+	if target.Empty() {
+		return ops
+	}
+	scaled := r.vmr.scaledImages.scaled(asset, frame, target.Size())
+	return append(ops, sceneOp{kind: sceneOpImage, rect: target, image: scaled})
+}
+
+// changedRects are where two lists of ops paint differently
+func changedRects(previous []sceneOp, ops []sceneOp) []image.Rectangle {
+	var rects []image.Rectangle
+	for i := 0; i < len(previous) || i < len(ops); i++ {
+		switch {
+		case i >= len(ops):
+			rects = append(rects, previous[i].rect)
+		case i >= len(previous):
+			rects = append(rects, ops[i].rect)
+		case previous[i] != ops[i]:
+			rects = append(rects, previous[i].rect, ops[i].rect)
+		}
+	}
+	return mergeRects(rects)
+}
+
+// mergeRects aligns rects to chroma blocks and joins those that overlap, so nothing is painted twice.
+// too many are joined into one
+func mergeRects(rects []image.Rectangle) []image.Rectangle {
+	var merged []image.Rectangle
+	for _, rect := range rects {
+		if rect.Empty() {
+			continue
+		}
+		rect = alignToChroma(rect)
+		for i := 0; i < len(merged); {
+			if merged[i].Overlaps(rect) {
+				rect = rect.Union(merged[i])
+				merged = append(merged[:i], merged[i+1:]...)
+				i = 0
+			} else {
+				i++
+			}
+		}
+		merged = append(merged, rect)
+	}
+	if len(merged) > sceneMaxDirtyRects {
+		union := merged[0]
+		for _, rect := range merged[1:] {
+			union = union.Union(rect)
+		}
+		merged = []image.Rectangle{union}
+	}
+	return merged
+}
+
+// formatCountdown is the time left as minutes and seconds, rounded up
+func formatCountdown(left time.Duration) string {
+	if left < 0 {
+		left = 0
+	}
+	seconds := int((left + time.Second - 1) / time.Second)
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
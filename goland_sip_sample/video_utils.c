@@ -1,3 +1,5 @@
+//go:build !stubencoder
+
 #include <libavcodec/avcodec.h>
 #include "video_utils.h"
 
@@ -6,13 +8,13 @@ YUVColor yuv_color(uint8_t y, uint8_t u, uint8_t v) {
     return result;
 }
 
-static void set_pixel(AVPicture* picture, YUVColor yuv_color, int x, int y) {
-    picture->data[0][ (x) + (y)*picture->linesize[0] ] = yuv_color.y;
-    picture->data[1][ ((x/2) + (y/2)*picture->linesize[1]) ] = yuv_color.u;
-    picture->data[2][ ((x/2) + (y/2)*picture->linesize[2]) ] = yuv_color.v;
+static void set_pixel(AVFrame* frame, YUVColor yuv_color, int x, int y) {
+    frame->data[0][ (x) + (y)*frame->linesize[0] ] = yuv_color.y;
+    frame->data[1][ ((x/2) + (y/2)*frame->linesize[1]) ] = yuv_color.u;
+    frame->data[2][ ((x/2) + (y/2)*frame->linesize[2]) ] = yuv_color.v;
 }
 
-void draw_box(AVPicture *picture, uint32_t x, uint32_t y, uint32_t width, uint32_t height, YUVColor yuv_color)
+void draw_box(AVFrame *frame, uint32_t x, uint32_t y, uint32_t width, uint32_t height, YUVColor yuv_color)
 {
    int i, j, cx,cy;
 
@@ -21,7 +23,7 @@ void draw_box(AVPicture *picture, uint32_t x, uint32_t y, uint32_t width, uint32
        {
          int cx = i+x;
          int cy = y+j;
-         set_pixel(picture, yuv_color, cx, cy);
+         set_pixel(frame, yuv_color, cx, cy);
        }
 }
 
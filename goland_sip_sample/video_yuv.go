@@ -0,0 +1,184 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// frames are painted straight into the 4:2:0 planes the encoders take, so they are not converted from RGBA on every
+// frame. The planes hold limited range BT.601, which is what encoders assume for YUV420P, and not the full range
+// image.YCbCr converts colors to: use only its planes. Fills and text are blended into the planes, images are
+// composited in RGBA over the part of the frame they cover, which is converted there and back
+
+// yuvPixel is a color in limited range BT.601
+type yuvPixel struct {
+	y, cb, cr uint8
+}
+
+func rgbToYUV(r, g, b int) yuvPixel {
+	return yuvPixel{
+		y:  uint8((66*r+129*g+25*b+128)>>8 + 16),
+		cb: uint8((-38*r-74*g+112*b+128)>>8 + 128),
+		cr: uint8((112*r-94*g-18*b+128)>>8 + 128),
+	}
+}
+
+func yuvToRGB(p yuvPixel) (r, g, b uint8) {
+	c, d, e := 298*(int(p.y)-16), int(p.cb)-128, int(p.cr)-128
+	return clampUint8((c + 409*e + 128) >> 8), clampUint8((c - 100*d - 208*e + 128) >> 8), clampUint8((c + 516*d + 128) >> 8)
+}
+
+func clampUint8(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// yuvOf is c without its transparency, and that transparency as 0 to 255
+func yuvOf(c color.Color) (yuvPixel, int) {
+	r, g, b, a := c.RGBA()
+	if a == 0 {
+		return yuvPixel{}, 0
+	}
+	// RGBA is premultiplied
+	return rgbToYUV(int(r*0xff/a), int(g*0xff/a), int(b*0xff/a)), int(a >> 8)
+}
+
+func blendUint8(dst uint8, src uint8, alpha int) uint8 {
+	return uint8((int(dst)*(255-alpha) + int(src)*alpha + 127) / 255)
+}
+
+func newVideoFrame(size image.Point) *image.YCbCr {
+	return image.NewYCbCr(image.Rectangle{Max: size}, image.YCbCrSubsampleRatio420)
+}
+
+// alignToChroma grows rect to whole 2x2 blocks that share a chroma sample
+func alignToChroma(rect image.Rectangle) image.Rectangle {
+	return image.Rect(rect.Min.X&^1, rect.Min.Y&^1, (rect.Max.X+1)&^1, (rect.Max.Y+1)&^1)
+}
+
+// framePainter paints into a 4:2:0 frame with its origin at 0, 0. Chroma samples are blended with the share of their
+// block that is painted, so the clip should be aligned to whole blocks, see alignToChroma
+type framePainter struct {
+	frame *image.YCbCr
+	// nothing is painted outside
+	clip image.Rectangle
+}
+
+// clipped is the painter with its clip narrowed to rect
+func (p *framePainter) clipped(rect image.Rectangle) *framePainter {
+	return &framePainter{frame: p.frame, clip: p.clip.Intersect(rect)}
+}
+
+func (p *framePainter) blendChroma(cx, cy int, c yuvPixel, alpha int) {
+	i := cy*p.frame.CStride + cx
+	p.frame.Cb[i] = blendUint8(p.frame.Cb[i], c.cb, alpha)
+	p.frame.Cr[i] = blendUint8(p.frame.Cr[i], c.cr, alpha)
+}
+
+func (p *framePainter) fill(rect image.Rectangle, c color.Color) {
+	fill := rect.Intersect(p.clip)
+	yuv, alpha := yuvOf(c)
+	if fill.Empty() || alpha == 0 {
+		return
+	}
+	for y := fill.Min.Y; y < fill.Max.Y; y++ {
+		row := p.frame.Y[y*p.frame.YStride+fill.Min.X : y*p.frame.YStride+fill.Max.X]
+		for x := range row {
+			row[x] = blendUint8(row[x], yuv.y, alpha)
+		}
+	}
+	for cy := fill.Min.Y / 2; cy <= (fill.Max.Y-1)/2; cy++ {
+		for cx := fill.Min.X / 2; cx <= (fill.Max.X-1)/2; cx++ {
+			covered := image.Rect(2*cx, 2*cy, 2*cx+2, 2*cy+2).Intersect(fill)
+			p.blendChroma(cx, cy, yuv, alpha*covered.Dx()*covered.Dy()/4)
+		}
+	}
+}
+
+// fillMask paints c where mask covers rect, mask at maskp is drawn at the top left corner of rect. glyphs are drawn so
+func (p *framePainter) fillMask(rect image.Rectangle, c color.Color, mask image.Image, maskp image.Point) {
+	fill := rect.Intersect(p.clip)
+	yuv, alpha := yuvOf(c)
+	if fill.Empty() || alpha == 0 {
+		return
+	}
+	coverage := func(x, y int) int {
+		mx, my := maskp.X+x-rect.Min.X, maskp.Y+y-rect.Min.Y
+		if alphaMask, ok := mask.(*image.Alpha); ok {
+			return int(alphaMask.AlphaAt(mx, my).A) * alpha / 255
+		}
+		_, _, _, a := mask.At(mx, my).RGBA()
+		return int(a>>8) * alpha / 255
+	}
+
+	for cy := fill.Min.Y / 2; cy <= (fill.Max.Y-1)/2; cy++ {
+		for cx := fill.Min.X / 2; cx <= (fill.Max.X-1)/2; cx++ {
+			block := image.Rect(2*cx, 2*cy, 2*cx+2, 2*cy+2).Intersect(fill)
+			sum := 0
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					a := coverage(x, y)
+					if a == 0 {
+						continue
+					}
+					i := y*p.frame.YStride + x
+					p.frame.Y[i] = blendUint8(p.frame.Y[i], yuv.y, a)
+					sum += a
+				}
+			}
+			if sum > 0 {
+				p.blendChroma(cx, cy, yuv, sum/4)
+			}
+		}
+	}
+}
+
+// drawImage draws img scaled to the size of rect over the frame. It is composited in RGBA: the blocks it covers are
+// converted, drawn over and converted back
+func (p *framePainter) drawImage(rect image.Rectangle, img *image.RGBA) {
+	region := alignToChroma(rect.Intersect(p.clip)).Intersect(p.clip)
+	if region.Empty() {
+		return
+	}
+	scratch := image.NewRGBA(region)
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			ci := (y/2)*p.frame.CStride + x/2
+			r, g, b := yuvToRGB(yuvPixel{y: p.frame.Y[y*p.frame.YStride+x], cb: p.frame.Cb[ci], cr: p.frame.Cr[ci]})
+			i := scratch.PixOffset(x, y)
+			scratch.Pix[i], scratch.Pix[i+1], scratch.Pix[i+2], scratch.Pix[i+3] = r, g, b, 0xff
+		}
+	}
+	drawn := rect.Intersect(region)
+	draw.Draw(scratch, drawn, img, drawn.Min.Sub(rect.Min), draw.Over)
+
+	// pixels the image leaves alone keep their luma, the chroma of a block it touches is taken from all four
+	for cy := region.Min.Y / 2; cy < region.Max.Y/2; cy++ {
+		for cx := region.Min.X / 2; cx < region.Max.X/2; cx++ {
+			touched := false
+			r, g, b := 0, 0, 0
+			for y := 2 * cy; y < 2*cy+2; y++ {
+				for x := 2 * cx; x < 2*cx+2; x++ {
+					i := scratch.PixOffset(x, y)
+					pr, pg, pb := int(scratch.Pix[i]), int(scratch.Pix[i+1]), int(scratch.Pix[i+2])
+					r, g, b = r+pr, g+pg, b+pb
+					if image.Pt(x, y).In(drawn) && img.Pix[img.PixOffset(x-rect.Min.X, y-rect.Min.Y)+3] != 0 {
+						p.frame.Y[y*p.frame.YStride+x] = rgbToYUV(pr, pg, pb).y
+						touched = true
+					}
+				}
+			}
+			if touched {
+				yuv := rgbToYUV(r/4, g/4, b/4)
+				ci := cy*p.frame.CStride + cx
+				p.frame.Cb[ci], p.frame.Cr[ci] = yuv.cb, yuv.cr
+			}
+		}
+	}
+}
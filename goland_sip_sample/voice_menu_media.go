@@ -1,25 +1,30 @@
 package main
 
-import "C"
 import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/ghettovoice/gosip/log"
 	"github.com/golang/freetype/truetype"
+	"github.com/pion/ice/v3"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/sdp"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media"
 	"github.com/pion/webrtc/v4/pkg/media/oggreader"
 	"image"
 	"image/color"
-	"image/draw"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/exec"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -46,24 +51,43 @@ type OggAudioPage struct {
 }
 
 type VoiceMenuResources struct {
-	greetingAudioPages     []OggAudioPage
-	dtmfAudioPages         []OggAudioPage
-	durationWarnAudioPages []OggAudioPage
-	defaultFont            *truetype.Font
-	stunServerAddress      string
+	greetingPrompt     *audioPrompt
+	dtmfPrompt         *audioPrompt
+	durationWarnPrompt *audioPrompt
+	goodbyePrompt      *audioPrompt // nil when no goodbye prompt is configured
+	// the prompts above by their names in prompt_provider.go, and those of resources.prompts
+	recordedPrompts *filePromptProvider
+	// nil without tts.command or when audio is not mixed
+	tts *ttsPromptProvider
+	// decoded, nil for none or when audio is not mixed
+	backgroundMusic []int16
+	// audio is mixed if audio.mix is set and the encoder backend can
+	mixAudio    bool
+	audio       AudioConfig
+	tones       map[string]*tone // by name, see audio_tones.go
+	defaultFont *truetype.Font
+	fonts       map[string]*truetype.Font // by the names of resources.fonts
+	// for characters a font lacks: the default font, then the others by name
+	fallbackFonts     []*truetype.Font
+	images            map[string]*imageAsset // by the names of resources.images
+	scaledImages      *scaledImageCache
+	videoClips        map[string][]*videoClip // by the names of resources.videoClips, one per codec
+	greetingVideo     string                  // name of the clip a call starts with, empty for none
+	stunServerAddress string
 }
 
-func readOggFile(path string) []OggAudioPage {
+func readOggFile(path string) ([]OggAudioPage, error) {
 	var result []OggAudioPage
 	file, oggErr := os.Open(path)
 	if oggErr != nil {
-		panic(oggErr)
+		return nil, oggErr
 	}
+	defer file.Close()
 
 	// Open on oggfile in non-checksum mode.
 	ogg, _, oggErr := oggreader.NewWith(file)
 	if oggErr != nil {
-		panic(oggErr)
+		return nil, fmt.Errorf("failed to read ogg file %s: %w", path, oggErr)
 	}
 
 	for true {
@@ -72,10 +96,33 @@ func readOggFile(path string) []OggAudioPage {
 			break
 			//os.Exit(0)
 		}
+		if oggErr != nil {
+			return nil, fmt.Errorf("failed to read ogg file %s: %w", path, oggErr)
+		}
 
 		result = append(result, OggAudioPage{pageData, pageHeader})
 	}
-	return result
+	return result, nil
+}
+
+func readFontFile(path string) (*truetype.Font, error) {
+	fontBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := truetype.Parse(fontBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// font is the font registered as name, or the default one for an empty or unknown name
+func (vmr *VoiceMenuResources) font(name string) *truetype.Font {
+	if f, ok := vmr.fonts[name]; ok {
+		return f
+	}
+	return vmr.defaultFont
 }
 
 func (vmr *VoiceMenuResources) getStunServers() []string {
@@ -86,25 +133,86 @@ func (vmr *VoiceMenuResources) getStunServers() []string {
 	return stunServers
 }
 
-func (vmr *VoiceMenuResources) init() {
-	vmr.dtmfAudioPages = readOggFile(dtmfAudioFileName)
-	vmr.greetingAudioPages = readOggFile(greetingAudioFileName)
-	vmr.durationWarnAudioPages = readOggFile(durationWarnAudioFileName)
-
-	fontBytes, err := ioutil.ReadFile(fontFile)
-	if err != nil {
-		log.Println(err)
-		return
+// provider speaks text for the menu if tts is set, its settings are updated by the caller
+func (vmr *VoiceMenuResources) init(resources ResourcesConfig, audio AudioConfig, tts TTSConfig, provider *ttsPromptProvider, stunServerAddress string) error {
+	var err error
+	vmr.audio = audio
+	vmr.mixAudio = audio.Mix && audioMixingSupported()
+	if audio.Mix && !vmr.mixAudio {
+		logger.Warn("Audio is not mixed, the encoder backend has no Opus codec. Prompts are sent as they are, without music, tones and speech")
 	}
-	f, err := truetype.Parse(fontBytes)
+	if vmr.tones, err = loadTones(audio.Country, audio.Tones); err != nil {
+		return err
+	}
+	if vmr.dtmfPrompt, err = readAudioPrompt(resources.DTMFAudio, vmr.mixAudio); err != nil {
+		return err
+	}
+	if vmr.greetingPrompt, err = readAudioPrompt(resources.GreetingAudio, vmr.mixAudio); err != nil {
+		return err
+	}
+	if vmr.durationWarnPrompt, err = readAudioPrompt(resources.DurationWarnAudio, vmr.mixAudio); err != nil {
+		return err
+	}
+	if resources.GoodbyeAudio != "" {
+		if vmr.goodbyePrompt, err = readAudioPrompt(resources.GoodbyeAudio, vmr.mixAudio); err != nil {
+			return err
+		}
+	}
+	if resources.BackgroundMusic != "" && vmr.mixAudio {
+		music, err := readAudioPrompt(resources.BackgroundMusic, true)
+		if err != nil {
+			return err
+		}
+		vmr.backgroundMusic = music.pcm
+	}
+	vmr.recordedPrompts, err = readPromptFiles(resources.Prompts, map[string]*audioPrompt{
+		greetingPromptName:     vmr.greetingPrompt,
+		dtmfPromptName:         vmr.dtmfPrompt,
+		durationWarnPromptName: vmr.durationWarnPrompt,
+		goodbyePromptName:      vmr.goodbyePrompt,
+	}, vmr.mixAudio)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+	if tts.Command != "" && vmr.mixAudio {
+		vmr.tts = provider
+		if _, err := exec.LookPath(strings.Fields(tts.Command)[0]); err != nil {
+			logger.Warnf("Text can not be spoken: %s", err)
+		}
 	}
 
-	vmr.defaultFont = f
+	if vmr.defaultFont, err = readFontFile(resources.Font); err != nil {
+		return err
+	}
+	vmr.fonts = make(map[string]*truetype.Font)
+	vmr.fallbackFonts = []*truetype.Font{vmr.defaultFont}
+	names := make([]string, 0, len(resources.Fonts))
+	for name := range resources.Fonts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := readFontFile(resources.Fonts[name])
+		if err != nil {
+			return err
+		}
+		vmr.fonts[name] = f
+		vmr.fallbackFonts = append(vmr.fallbackFonts, f)
+	}
+	vmr.images = make(map[string]*imageAsset)
+	for name, path := range resources.Images {
+		if vmr.images[name], err = readImageFile(path); err != nil {
+			return err
+		}
+	}
+	vmr.scaledImages = newScaledImageCache()
+	if vmr.videoClips, err = readVideoClips(resources.VideoClips); err != nil {
+		return err
+	}
+	vmr.greetingVideo = resources.GreetingVideo
 
-	vmr.stunServerAddress = os.Getenv("SAMPLE_STUN_SERVER")
+	vmr.stunServerAddress = stunServerAddress
+	return nil
 }
 
 type VoiceMenuInstance struct {
@@ -113,15 +221,55 @@ type VoiceMenuInstance struct {
 	_iceConnectedCtxCancel    context.CancelFunc
 	_voiceMenuInstanceContext context.Context
 	_voiceMenuInstanceCancel  context.CancelFunc
-	_videoTrack               *webrtc.TrackLocalStaticSample
+	_videoTrack               *clockedTrack
 	_videoTrackSender         *webrtc.RTPSender
-	_videoTrackFPS            int
-	_audioTrack               *webrtc.TrackLocalStaticSample
+	_videoConfig              VideoConfig // as configured, then fitted to the offer by negotiateVideo
+	_videoOffer               *videoOffer // nil until negotiated, or if the offer has no video codec we know
+	_audioTrack               *clockedTrack
 	_audioTrackSender         *webrtc.RTPSender
-	_encoder                  *Encoder
+	_mediaClock               *mediaClock
+	_audioStats               *rtpStreamStats
+	_videoStats               *rtpStreamStats
+	_bitrateController        *bitrateController
+	_encoder                  VideoEncoder
 	_vmr                      *VoiceMenuResources
+	_api                      *webrtc.API
+	_bandwidthEstimators      *bandwidthEstimators
+	_videoBroadcasts          *videoBroadcasts
+	_broadcastSubscriber      *broadcastSubscriber
+	_audioPlaybackContext     context.Context
+	_audioPlaybackCancel      context.CancelFunc
+	_audioPlaybackDone        chan struct{}
+	_audioMixer               *audioMixer // nil unless audio is mixed
 	_closed                   bool
+	_closeHooks               []func()
 	_connectionReInitMutex    sync.RWMutex
+	// index into videoQualityLevels the bitrate controller asks for, the encoder is recreated by the video goroutine
+	_videoQuality atomic.Int32
+	// set when the bitrate changed for an encoder that can not take it on the fly
+	_bitrateOutdated atomic.Bool
+	// what the video shows, see SetVideoScene
+	_videoScene atomic.Pointer[videoScene]
+	// shown in place of the scene, see PlayVideoClips. nil for none
+	_videoClipPlayback atomic.Pointer[videoClipPlayback]
+	// wakes up the sending goroutine when _videoClipPlayback changed
+	_videoClipsChanged chan struct{}
+	// the encoder rests while set
+	_videoClipPlaying atomic.Bool
+	// carries the call fields, use it for everything logged about this call
+	_log log.Logger
+}
+
+// OnClose registers f to be called once the instance is closed. f is called right away if it already is
+func (vmi *VoiceMenuInstance) OnClose(f func()) {
+	vmi._connectionReInitMutex.Lock()
+	if vmi._closed {
+		vmi._connectionReInitMutex.Unlock()
+		f()
+		return
+	}
+	vmi._closeHooks = append(vmi._closeHooks, f)
+	vmi._connectionReInitMutex.Unlock()
 }
 
 func (vmi *VoiceMenuInstance) checkTimeout() bool {
@@ -131,38 +279,45 @@ func (vmi *VoiceMenuInstance) checkTimeout() bool {
 	return true
 }
 
+// Close ends the call. The close hooks run once the instance is unlocked, so that they may use it
 func (vmi *VoiceMenuInstance) Close() {
-	if vmi._closed {
-		return
+	for _, hook := range vmi.closeLocked() {
+		hook()
 	}
+}
+
+// closeLocked closes what the call holds and returns the close hooks to run
+func (vmi *VoiceMenuInstance) closeLocked() []func() {
 	vmi._connectionReInitMutex.Lock()
 	defer vmi._connectionReInitMutex.Unlock()
+	if vmi._closed {
+		return nil
+	}
 
 	vmi._closed = true
 	vmi._voiceMenuInstanceCancel()
-	vmi._encoder.Close()
-	if err := vmi._peerConnection.Close(); err != nil {
-		logger.Errorf("Failed to close peer connection")
+	// frames are only encoded under the read lock and after checking _closed, so nobody uses the encoder anymore
+	if vmi._encoder != nil {
+		vmi._encoder.Close()
+	}
+	// nil if the offer was rejected before
+	if vmi._peerConnection != nil {
+		if err := vmi._peerConnection.Close(); err != nil {
+			vmi._log.Errorf("Failed to close peer connection: %s", err)
+		}
 	}
+	hooks := vmi._closeHooks
+	vmi._closeHooks = nil
+	return hooks
 }
 
-func prepareSettingsEngine() webrtc.SettingEngine {
+func prepareSettingsEngine(loggerFactory logging.LoggerFactory, iceSettings ICETransportSettings, udpMux ice.UDPMux) webrtc.SettingEngine {
 	settingEngine := webrtc.SettingEngine{}
 	settingEngine.DisableCertificateFingerprintVerification(true)
 
-	settingEngine.LoggerFactory = &logging.DefaultLoggerFactory{
-		Writer: os.Stdout,
-		//DefaultLogLevel: logging.LogLevelTrace,
-		DefaultLogLevel: logging.LogLevelWarn,
-		ScopeLevels: map[string]logging.LogLevel{
-			"ice": logging.LogLevelWarn,
-			//"ice": logging.LogLevelDebug,
-		},
-	}
+	settingEngine.LoggerFactory = loggerFactory
 
-	if err := settingEngine.SetEphemeralUDPPortRange(10000, 10000); err != nil {
-		panic(err)
-	}
+	iceSettings.applyTo(&settingEngine, udpMux)
 
 	return settingEngine
 }
@@ -172,41 +327,62 @@ func prepareMediaEngine() *webrtc.MediaEngine {
 	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
 		panic(err)
 	}
+	if err := registerTelephoneEventCodec(mediaEngine); err != nil {
+		panic(err)
+	}
 	return mediaEngine
 }
 
-func prepareWebRTCInterceptors(mediaEngine *webrtc.MediaEngine) *interceptor.Registry {
+func prepareWebRTCInterceptors(mediaEngine *webrtc.MediaEngine) (*interceptor.Registry, *bandwidthEstimators) {
 	interceptors := &interceptor.Registry{}
 	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptors); err != nil {
 		panic(err)
 	}
-	return interceptors
+	// the bandwidth to callers is estimated from their TWCC feedback. interceptors added later see packets first,
+	// so this has to come before the transport wide sequence numbers are added
+	estimators, err := registerBandwidthEstimation(interceptors)
+	if err != nil {
+		panic(err)
+	}
+	// transport wide sequence numbers on what we send, so that callers answer with TWCC feedback
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptors); err != nil {
+		panic(err)
+	}
+	return interceptors, estimators
 }
 
 func preparePeerConnection(
 	vmr *VoiceMenuResources,
 	api *webrtc.API,
+	estimators *bandwidthEstimators,
+	estimatorSettings bandwidthEstimatorSettings,
 	iceConnectedCtxCancel context.CancelFunc,
 	voiceMenuContextCancel context.CancelFunc,
-	candidatesChannel chan string) *webrtc.PeerConnection {
+	candidatesChannel chan string,
+	callLogger log.Logger) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
 
 	stunServers := vmr.getStunServers()
-	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
+	peerConnection, estimator, err := estimators.newPeerConnection(api, webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{
 				URLs: stunServers,
 			},
 		},
-	})
+	}, estimatorSettings)
 	if err != nil {
-		panic(err)
+		return nil, nil, fmt.Errorf("failed to create the peer connection: %w", err)
 	}
 
 	// Set the handler for ICE connection state
 	// This will notify you when the peer has connected/disconnected
+	createdAt := time.Now()
+	var observeConnected sync.Once
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		callLogger.Infof("Connection State has changed %s", connectionState.String())
 		if connectionState == webrtc.ICEConnectionStateConnected {
+			observeConnected.Do(func() {
+				iceConnectedSeconds.Observe(time.Since(createdAt).Seconds())
+			})
 			//sleep for 1 sec to wait for the connection to be established
 			//time.Sleep(time.Second * time.Duration(2))
 			iceConnectedCtxCancel()
@@ -216,20 +392,20 @@ func preparePeerConnection(
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		fmt.Printf("Peer Connection State has changed: %s\n", s.String())
+		callLogger.Infof("Peer Connection State has changed: %s", s.String())
 
 		if s == webrtc.PeerConnectionStateFailed {
 			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
 			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
 			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
 			voiceMenuContextCancel()
-			fmt.Println("Peer Connection has gone to failed exiting")
+			callLogger.Warn("Peer Connection has gone to failed exiting")
 		}
 
 		if s == webrtc.PeerConnectionStateClosed {
 			voiceMenuContextCancel()
 			// PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
-			fmt.Println("Peer Connection has gone to closed")
+			callLogger.Info("Peer Connection has gone to closed")
 		}
 	})
 
@@ -248,80 +424,224 @@ func preparePeerConnection(
 			candidate.Typ)
 	})
 
-	return peerConnection
+	return peerConnection, estimator, nil
 }
 
-func (vmi *VoiceMenuInstance) prepareEncoder() {
-	e, err := NewEncoder(CODEC_ID_H264, image.NewRGBA(image.Rect(0, 0, 1280, 720)), vmi._videoTrackFPS)
+// encoderSettings is the bitrate and the quality the bitrate controller asks for
+func (vmi *VoiceMenuInstance) encoderSettings() EncoderSettings {
+	return vmi.encoderSettingsAt(vmi._bitrateController.encoderSettings())
+}
+
+func (vmi *VoiceMenuInstance) encoderSettingsAt(bitrate int, quality int) EncoderSettings {
+	level := videoQualityLevels[quality]
+	width, height := level.size(vmi._videoConfig)
+	fps := level.fps(vmi._videoConfig)
+	settings := EncoderSettings{
+		Width:   width,
+		Height:  height,
+		FPS:     fps,
+		Bitrate: bitrate,
+		GOPSize: keyframeIntervalFrames(vmi._videoConfig.KeyframeInterval, fps),
+	}
+	if vmi._videoOffer != nil {
+		settings.Profile = vmi._videoOffer.profile()
+		settings.Level = vmi._videoOffer.levelIDC
+	}
+	return settings
+}
+
+// videoCodec is the codec picked from the offer, H.264 if there is none we know
+func (vmi *VoiceMenuInstance) videoCodec() *videoCodec {
+	if vmi._videoOffer == nil {
+		return videoCodecH264
+	}
+	return vmi._videoOffer.codec
+}
+
+// negotiateVideo picks the codec and fits _videoConfig into what the offer of the caller allows for it
+func (vmi *VoiceMenuInstance) negotiateVideo(tracks []MediaTrackInfo) {
+	for _, track := range tracks {
+		if track.mediaType != sdpMediaTypeVideo || !track.sent() {
+			continue
+		}
+		if track.video == nil {
+			vmi._log.Warn("Offer has no H.264 with packetization mode 1 and a known profile, VP8 or VP9 profile 0, sending the configured H.264 video")
+			return
+		}
+		vmi._videoOffer = track.video
+		vmi._videoConfig = negotiateVideo(vmi._videoConfig, track.video)
+		vmi._log.Infof("Video negotiated to %dx%d at %d fps and at most %d bit/s, %s payload type %d",
+			vmi._videoConfig.Width, vmi._videoConfig.Height, vmi._videoConfig.FPS, vmi._videoConfig.Bitrate,
+			track.video.codec.mimeType, track.video.payloadType)
+		if track.video.codec == videoCodecH264 {
+			vmi._log.Infof("H.264 %s profile, level %d", track.video.profile(), track.video.levelIDC)
+		}
+		return
+	}
+}
+
+// frames are always drawn at the configured size, the encoder scales them down to the size of the quality
+func (vmi *VoiceMenuInstance) prepareEncoder() error {
+	e, err := NewVideoEncoder(
+		vmi.videoCodec().codecID,
+		image.NewRGBA(image.Rect(0, 0, vmi._videoConfig.Width, vmi._videoConfig.Height)),
+		vmi.encoderSettings(),
+		vmi._log,
+	)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to create the video encoder: %w", err)
+	}
+	vmi._encoder = e
+	return nil
+}
+
+// recreateEncoder switches to a new encoder for the quality the bitrate controller asks for now.
+// must be called from the video goroutine
+func (vmi *VoiceMenuInstance) recreateEncoder() error {
+	vmi._bitrateOutdated.Store(false)
+	settings := vmi.encoderSettings()
+	e, err := NewVideoEncoder(vmi.videoCodec().codecID, vmi._encoder.InputImage(), settings, vmi._log)
+	if err != nil {
+		return err
+	}
+
+	vmi._connectionReInitMutex.Lock()
+	if vmi._closed {
+		vmi._connectionReInitMutex.Unlock()
+		e.Close()
+		return nil
 	}
+	previous := vmi._encoder
 	vmi._encoder = e
+	vmi._connectionReInitMutex.Unlock()
+	previous.Close()
+
+	// a bitrate change between reading the settings and the switch went to the previous encoder
+	if bitrate, _ := vmi._bitrateController.encoderSettings(); bitrate != settings.Bitrate {
+		vmi.setVideoBitrate(bitrate)
+	}
+	return nil
+}
+
+// setVideoBitrate hands bitrate to the encoder, or has it recreated if it can not change its bitrate on the fly
+func (vmi *VoiceMenuInstance) setVideoBitrate(bitrate int) {
+	vmi._connectionReInitMutex.RLock()
+	defer vmi._connectionReInitMutex.RUnlock()
+	if vmi._broadcastSubscriber != nil {
+		vmi._broadcastSubscriber.setBitrate(bitrate)
+		return
+	}
+	if vmi._encoder == nil {
+		return
+	}
+	if vmi._encoder.ReconfiguresBitrate() {
+		vmi._encoder.SetBitrate(bitrate)
+	} else {
+		vmi._bitrateOutdated.Store(true)
+	}
+}
+
+func (vmi *VoiceMenuInstance) setVideoQuality(quality int) {
+	// a broadcast keeps its quality
+	if vmi._videoBroadcasts != nil {
+		return
+	}
+	level := videoQualityLevels[quality]
+	width, height := level.size(vmi._videoConfig)
+	vmi._log.Infof("Video quality changed to %dx%d at %d fps", width, height, level.fps(vmi._videoConfig))
+	vmi._videoQuality.Store(int32(quality))
 }
 
 func initMediaTrack(
 	pc *webrtc.PeerConnection,
 	codecCapability webrtc.RTPCodecCapability,
 	id string,
-	streamId string) (*webrtc.TrackLocalStaticSample, *webrtc.RTPSender) {
-	track, trackErr := webrtc.NewTrackLocalStaticSample(
+	streamId string,
+	payloader rtp.Payloader,
+	clock *mediaClock) (*clockedTrack, *webrtc.RTPSender, error) {
+	track, trackErr := newClockedTrack(
 		codecCapability,
 		id,
 		streamId,
+		payloader,
+		clock,
 	)
 	if trackErr != nil {
-		panic(trackErr)
+		return nil, nil, fmt.Errorf("failed to create the %s track: %w", id, trackErr)
 	}
 
-	rtpSender, trackErr := pc.AddTrack(track)
+	rtpSender, trackErr := pc.AddTrack(track.track)
 	if trackErr != nil {
-		panic(trackErr)
+		return nil, nil, fmt.Errorf("failed to add the %s track: %w", id, trackErr)
 	}
 
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
-
-	return track, rtpSender
+	return track, rtpSender, nil
 }
 
-func initVideoTrack(peerConnection *webrtc.PeerConnection) (*webrtc.TrackLocalStaticSample, *webrtc.RTPSender) {
+// the fmtp of offer makes pion send with its payload type, nil leaves the choice of the H.264 payload type to pion
+func initVideoTrack(peerConnection *webrtc.PeerConnection, offer *videoOffer, clock *mediaClock) (*clockedTrack, *webrtc.RTPSender, error) {
+	codec := videoCodecH264
+	var fmtpLine string
+	if offer != nil {
+		codec = offer.codec
+		fmtpLine = offer.fmtpLine
+	}
 	return initMediaTrack(
 		peerConnection,
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 60},
+		webrtc.RTPCodecCapability{MimeType: codec.mimeType, ClockRate: videoClockRate, SDPFmtpLine: fmtpLine},
 		"video",
 		"pion",
+		codec.newPayloader(),
+		clock,
 	)
 }
 
-func initAudioTrack(peerConnection *webrtc.PeerConnection) (*webrtc.TrackLocalStaticSample, *webrtc.RTPSender) {
+func initAudioTrack(peerConnection *webrtc.PeerConnection, clock *mediaClock) (*clockedTrack, *webrtc.RTPSender, error) {
 	return initMediaTrack(
 		peerConnection,
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: audioClockRate, Channels: 2},
 		"audio",
 		"pion",
+		&codecs.OpusPayloader{},
+		clock,
 	)
 }
 
-func NewVoiceMenuInstance(vmr *VoiceMenuResources, videoFPS int) *VoiceMenuInstance {
+// vmr, api, estimators and broadcasts are shared between calls and must not be modified by the instance.
+// broadcasts is nil unless the video of the call is to be broadcast
+func NewVoiceMenuInstance(
+	vmr *VoiceMenuResources,
+	api *webrtc.API,
+	estimators *bandwidthEstimators,
+	broadcasts *videoBroadcasts,
+	videoConfig VideoConfig,
+	sessionTimeout time.Duration,
+	callLogger log.Logger) *VoiceMenuInstance {
 	var vmi = &VoiceMenuInstance{}
+	vmi._log = callLogger
 	vmi._vmr = vmr
-	vmi._videoTrackFPS = videoFPS
+	vmi._api = api
+	vmi._bandwidthEstimators = estimators
+	vmi._videoBroadcasts = broadcasts
+	vmi._videoConfig = videoConfig
 	vmi._closed = false
 
 	vmi._voiceMenuInstanceContext, vmi._voiceMenuInstanceCancel = context.WithTimeout(
 		context.Background(),
-		time.Minute*2,
+		sessionTimeout,
 	)
+	vmi._audioPlaybackContext, vmi._audioPlaybackCancel = context.WithCancel(vmi._voiceMenuInstanceContext)
+	vmi._audioPlaybackDone = make(chan struct{})
+	deadline, _ := vmi._voiceMenuInstanceContext.Deadline()
+	vmi._videoScene.Store(menuVideoScene(deadline))
+	vmi._videoClipsChanged = make(chan struct{}, 1)
+	if vmr.mixAudio {
+		vmi._audioMixer = newAudioMixer(vmr.audio, vmr.backgroundMusic)
+	}
 
 	go func() {
 		<-vmi._voiceMenuInstanceContext.Done()
-		logger.Info("Signal to close connection received. Closing session")
+		vmi._log.Info("Signal to close connection received. Closing session")
 		vmi.Close()
 	}()
 
@@ -341,20 +661,73 @@ const (
 type MediaTrackInfo struct {
 	mediaType 		string
 	mid				string
-	bandwidth 		*uint64
+	bandwidth 		*uint64 // bits per second
 	direction		string
+	// video only, nil if the offer has no codec we can send
+	video			*videoOffer
+}
+
+// sdpBandwidth is the b= line in bits per second, TIAS if present and AS otherwise. nil if there is neither
+func sdpBandwidth(bandwidths []sdp.Bandwidth) *uint64 {
+	var result *uint64
+	for _, b := range bandwidths {
+		switch b.Type {
+		case "TIAS":
+			bandwidth := b.Bandwidth
+			return &bandwidth
+		case "AS":
+			bandwidth := b.Bandwidth * 1000
+			result = &bandwidth
+		}
+	}
+	return result
 }
 
-func (vmi *VoiceMenuInstance) collectTracks(offerStr string) []MediaTrackInfo {
+// sent reports whether the caller wants us to send the track
+func (t MediaTrackInfo) sent() bool {
+	return t.direction == rtpTransceiverDirectionSendrecvStr || t.direction == rtpTransceiverDirectionRecvonlyStr
+}
+
+// bandwidthEstimatorSettings starts from the configured initial bitrate, neither that nor the maximum may exceed
+// what the offer allows for the video
+func (vmi *VoiceMenuInstance) bandwidthEstimatorSettings(tracks []MediaTrackInfo) (settings bandwidthEstimatorSettings, audioReserve int) {
+	initialBitrate := vmi._videoConfig.InitialBitrate
+	maxBitrate := vmi._videoConfig.Bitrate
+	for _, track := range tracks {
+		if !track.sent() {
+			continue
+		}
+		switch track.mediaType {
+		case sdpMediaTypeAudio:
+			audioReserve = audioBitrateReserve
+		case sdpMediaTypeVideo:
+			if track.bandwidth != nil && int(*track.bandwidth) < maxBitrate {
+				maxBitrate = int(*track.bandwidth)
+			}
+		}
+	}
+	if maxBitrate < minVideoBitrate {
+		maxBitrate = minVideoBitrate
+	}
+	if initialBitrate > maxBitrate {
+		initialBitrate = maxBitrate
+	}
+	return bandwidthEstimatorSettings{
+		initialBitrate: initialBitrate + audioReserve,
+		minBitrate:     minVideoBitrate + audioReserve,
+		maxBitrate:     maxBitrate + audioReserve,
+	}, audioReserve
+}
+
+func (vmi *VoiceMenuInstance) collectTracks(offerStr string) ([]MediaTrackInfo, error) {
 	var parsedSDP sdp.SessionDescription
-	if err := parsedSDP.Unmarshal(offerStr); err != nil {panic(err)}
+	if err := parsedSDP.Unmarshal(offerStr); err != nil {
+		return nil, fmt.Errorf("failed to parse the offer: %w", err)
+	}
 
 	var result []MediaTrackInfo
 	for _, mediaDescription:= range parsedSDP.MediaDescriptions {
-		var bandwidth *uint64 = nil
-		if len(mediaDescription.Bandwidth) > 0 {
-			bandwidth = &mediaDescription.Bandwidth[0].Bandwidth
-		}
+		bandwidth := sdpBandwidth(mediaDescription.Bandwidth)
 
 		mediaType := mediaDescription.MediaName.Media
 		var mid string
@@ -367,41 +740,52 @@ func (vmi *VoiceMenuInstance) collectTracks(offerStr string) []MediaTrackInfo {
 				mid = attr.Value
 			}
 		}
+		var video *videoOffer
+		if mediaType == sdpMediaTypeVideo {
+			video, _ = parseVideoOffer(mediaDescription)
+		}
 		result = append(result, MediaTrackInfo{
 			mediaType: 	mediaType,
 			mid:		mid,
 			bandwidth:  bandwidth,
 			direction:  direction,
+			video:		video,
 		})
-		logger.Infof("Observed media with media type %s, mid %s, bandwidth %s and direction %s", mediaType, mid, bandwidth, direction)
+		vmi._log.Infof("Observed media with media type %s, mid %s, bandwidth %s and direction %s", mediaType, mid, bandwidth, direction)
 	}
 
-	return result
+	return result, nil
 }
 
-func (vmi *VoiceMenuInstance) connect(offerStr string, candidates []webrtc.ICECandidateInit, audio bool, video bool) string {
+// connect answers the offer. An error means the offer cannot be answered, the instance has to be closed then
+func (vmi *VoiceMenuInstance) connect(offerStr string, candidates []webrtc.ICECandidateInit, audio bool, video bool) (string, error) {
 	iceConnectedCtx, iceConnectedCtxCancel := context.WithCancel(context.Background())
 
 	vmi._iceConnectedCtx = iceConnectedCtx
 	vmi._iceConnectedCtxCancel = iceConnectedCtxCancel
 	candidatesChannel := make(chan string)
+	vmi._mediaClock = newMediaClock()
 
-	settingEngine := prepareSettingsEngine()
-	mediaEngine := prepareMediaEngine()
-	interceptors := prepareWebRTCInterceptors(mediaEngine)
-
-	apiWithSettings := webrtc.NewAPI(
-		webrtc.WithSettingEngine(settingEngine),
-		webrtc.WithMediaEngine(mediaEngine),
-		webrtc.WithInterceptorRegistry(interceptors),
-	)
+	tracks, err := vmi.collectTracks(offerStr)
+	if err != nil {
+		return "", err
+	}
+	vmi.negotiateVideo(tracks)
+	estimatorSettings, audioReserve := vmi.bandwidthEstimatorSettings(tracks)
 
-	vmi._peerConnection = preparePeerConnection(
+	var estimator cc.BandwidthEstimator
+	vmi._peerConnection, estimator, err = preparePeerConnection(
 		vmi._vmr,
-		apiWithSettings,
+		vmi._api,
+		vmi._bandwidthEstimators,
+		estimatorSettings,
 		iceConnectedCtxCancel,
 		vmi._voiceMenuInstanceCancel,
-		candidatesChannel)
+		candidatesChannel,
+		vmi._log)
+	if err != nil {
+		return "", err
+	}
 
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
@@ -413,37 +797,41 @@ func (vmi *VoiceMenuInstance) connect(offerStr string, candidates []webrtc.ICECa
 	// Create channel that is blocked until ICE Gathering is complete
 	gatherComplete := webrtc.GatheringCompletePromise(vmi._peerConnection)
 
+	vmi._peerConnection.OnTrack(vmi.readRemoteTrack)
+
 	// Set the remote SessionDescription
 	if err := vmi._peerConnection.SetRemoteDescription(offer); err != nil {
-		panic(err)
+		return "", fmt.Errorf("failed to set the offer: %w", err)
 	}
 
 	//just fill tracks with senders. API won't allow to carefuly map senders to mids here
-	for _, trackInfo := range vmi.collectTracks(offerStr) {
-		if trackInfo.direction == rtpTransceiverDirectionSendrecvStr ||
-			trackInfo.direction == rtpTransceiverDirectionRecvonlyStr {
+	for _, trackInfo := range tracks {
+		if trackInfo.sent() {
 			switch trackInfo.mediaType {
 			case sdpMediaTypeAudio:
-				logger.Info("requested to play audio")
-				vmi._audioTrack, vmi._audioTrackSender = initAudioTrack(vmi._peerConnection)
+				vmi._log.Info("requested to play audio")
+				vmi._audioTrack, vmi._audioTrackSender, err = initAudioTrack(vmi._peerConnection, vmi._mediaClock)
 			case sdpMediaTypeVideo:
-				logger.Info("requested to play video")
-				vmi._videoTrack, vmi._videoTrackSender = initVideoTrack(vmi._peerConnection)
+				vmi._log.Info("requested to play video")
+				vmi._videoTrack, vmi._videoTrackSender, err = initVideoTrack(vmi._peerConnection, vmi._videoOffer, vmi._mediaClock)
+			}
+			if err != nil {
+				return "", err
 			}
 		}
 	}
 
 	answer, err := vmi._peerConnection.CreateAnswer(&webrtc.AnswerOptions{})
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("failed to create the answer: %w", err)
 	}
-	if err = vmi._peerConnection.SetLocalDescription(answer); err != nil {
-		panic(err)
-	}
-
+	// parsed before gathering starts, the candidates have to be taken from the channel once it did
 	answerSD := sdp.SessionDescription{}
 	if err = answerSD.Unmarshal(answer.SDP); err != nil {
-		panic(err)
+		return "", fmt.Errorf("failed to parse the answer: %w", err)
+	}
+	if err = vmi._peerConnection.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set the answer: %w", err)
 	}
 
 	for cand := range candidatesChannel {
@@ -459,40 +847,95 @@ func (vmi *VoiceMenuInstance) connect(offerStr string, candidates []webrtc.ICECa
 
 	for _, candidate := range candidates {
 		if err = vmi._peerConnection.AddICECandidate(candidate); err != nil {
-			panic(err)
+			return "", fmt.Errorf("failed to add the candidate %s: %w", candidate.Candidate, err)
 		}
 	}
 
-	vmi.prepareEncoder()
+	vmi._bitrateController = newBitrateController(
+		vmi._videoConfig,
+		estimatorSettings.initialBitrate-audioReserve,
+		estimatorSettings.maxBitrate-audioReserve,
+		audioReserve,
+		vmi.setVideoBitrate,
+		vmi.setVideoQuality,
+	)
+	_, quality := vmi._bitrateController.encoderSettings()
+	vmi._videoQuality.Store(int32(quality))
+	// a broadcast is joined once the video can be sent
+	if vmi._videoBroadcasts == nil {
+		if err = vmi.prepareEncoder(); err != nil {
+			return "", err
+		}
+	}
+	if estimator != nil {
+		estimator.OnTargetBitrateChange(vmi._bitrateController.onCongestionTarget)
+	}
+	// RTCP has to be read for the interceptors to work even if we did not care about it
+	if vmi._audioTrackSender != nil {
+		vmi._audioStats = &rtpStreamStats{}
+		go vmi.consumeRTCP(vmi._audioTrackSender, vmi._audioStats)
+	}
+	if vmi._videoTrackSender != nil {
+		vmi._videoStats = &rtpStreamStats{}
+		go vmi.consumeRTCP(vmi._videoTrackSender, vmi._videoStats)
+	}
 
 	<-gatherComplete
 	answerSDP := answerSD.Marshal()
-	logger.Info("Gathering complete. Answer set as local description\n" + answerSDP)
+	vmi._log.Info("Gathering complete. Answer set as local description\n" + answerSDP)
 
-	return answerSDP
+	return answerSDP, nil
 }
 
-func playbackTrack(vmi *VoiceMenuInstance, track []OggAudioPage) {
+// playbackTrack returns once the track is played or ctx is done
+func playbackTrack(ctx context.Context, vmi *VoiceMenuInstance, track []OggAudioPage) {
 	ticker := time.NewTicker(audioOggPageDuration)
+	defer ticker.Stop()
 	var lastGranule uint64
+	// timestamps within a track follow the samples, so that the receiver plays it without gaps
+	var start uint32
 	totalPages := len(track)
 
-	logger.Info("Start track playback. Num samples: ", len(track))
+	vmi._log.Info("Start track playback. Num samples: ", len(track))
 
 	for frameIdx := 0; frameIdx < totalPages; frameIdx++ {
-		<-ticker.C
-		if !vmi.checkTimeout() {
+		tick := <-ticker.C
+		if ctx.Err() != nil {
 			return
 		}
+		if frameIdx == 0 {
+			start = vmi._audioTrack.timestampAt(tick)
+		}
 
-		vmi.presentAudioFrame(track, frameIdx, &lastGranule)
+		vmi.presentAudioFrame(track, frameIdx, start, &lastGranule)
+	}
+}
+
+// sleepOrDone returns false if ctx is done before d elapses
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
 
 func (vmi *VoiceMenuInstance) StartAudioPlayback() {
-	<-vmi._iceConnectedCtx.Done()
+	defer close(vmi._audioPlaybackDone)
+	ctx := vmi._audioPlaybackContext
 
-	time.Sleep(time.Second)
+	select {
+	case <-vmi._iceConnectedCtx.Done():
+	case <-ctx.Done():
+		return
+	}
+
+	if !sleepOrDone(ctx, time.Second) {
+		return
+	}
 
 	// Keep track of last granule, the difference is the amount of samples in the buffer
 
@@ -502,30 +945,47 @@ func (vmi *VoiceMenuInstance) StartAudioPlayback() {
 
 	//time.Sleep(time.Duration(10) * time.Second)
 
-	playbackTrack(vmi, vmi._vmr.greetingAudioPages)
+	vmi.playPrompt(ctx, vmi._vmr.greetingPrompt)
 
-	if !vmi.checkTimeout() {
+	if !sleepOrDone(ctx, time.Second*2) {
 		return
 	}
 
-	time.Sleep(time.Second * 2)
-
-	playbackTrack(vmi, vmi._vmr.durationWarnAudioPages)
+	vmi.playPrompt(ctx, vmi._vmr.durationWarnPrompt)
 
 	//playbackTrack(vmi, vmi._vmr.dtmfAudioPages)
 	for true {
-		time.Sleep(time.Second * 5)
-		if !vmi.checkTimeout() {
+		if !sleepOrDone(ctx, time.Second*5) {
 			return
 		}
-		playbackTrack(vmi, vmi._vmr.dtmfAudioPages)
+		vmi.playPrompt(ctx, vmi._vmr.dtmfPrompt)
+	}
+
+}
+
+// PlayGoodbye interrupts the menu prompts and plays goodbye instead. It returns once goodbye is played or ctx is done.
+// Nothing is played if the call has no audio or is not connected yet
+func (vmi *VoiceMenuInstance) PlayGoodbye(ctx context.Context, goodbye *audioPrompt) {
+	if vmi._audioTrack == nil || goodbye == nil || vmi._iceConnectedCtx.Err() == nil {
+		return
 	}
 
+	vmi._audioPlaybackCancel()
+	select {
+	case <-vmi._audioPlaybackDone:
+	case <-ctx.Done():
+		return
+	}
+
+	vmi.playPrompt(ctx, goodbye)
 }
 
 func (vmi *VoiceMenuInstance) StartPlayback() {
 	if vmi._audioTrack != nil {
 		go vmi.StartAudioPlayback()
+		if vmi._audioMixer != nil {
+			go vmi.mixAudio()
+		}
 	}
 	if vmi._videoTrack != nil {
 		go vmi.StartVideoPlayback()
@@ -534,87 +994,112 @@ func (vmi *VoiceMenuInstance) StartPlayback() {
 
 func (vmi *VoiceMenuInstance) StartVideoPlayback() {
 	<-vmi._iceConnectedCtx.Done()
-
-	numerator := 1
-	denominator := vmi._videoTrackFPS
-	videoDurationBetweenFrames := (float32(numerator) / float32(denominator)) * 1000
-	logger.Info("Peer connection established. sending video. Between frames: ",
-		videoDurationBetweenFrames,
-		" milliseconds",
-	)
-
-	avPacket, freePacket := vmi._encoder.allocPacket()
-	defer freePacket()
-
-	ticker := time.NewTicker(time.Millisecond * time.Duration(videoDurationBetweenFrames))
-	for i := 0; true; i++ {
-		if !vmi.checkTimeout() {
-			return
+	if vmi._vmr.greetingVideo != "" {
+		if err := vmi.PlayVideoClips(false, vmi._vmr.greetingVideo); err != nil {
+			vmi._log.Warnf("Not playing the greeting video: %s", err)
 		}
-		vmi.presentVideoFrame(i, avPacket, ticker, videoDurationBetweenFrames)
 	}
-}
-
-// separate function to defer mutex unlock
-func (vmi *VoiceMenuInstance) presentVideoFrame(i int, avPacket H264Packet, ticker *time.Ticker, videoDurationBetweenFrames float32) {
-	vmi._connectionReInitMutex.RLock()
-	defer vmi._connectionReInitMutex.RUnlock()
-
-	inputImage := vmi._encoder.inputImage
-
-	xShift := 2*i%(inputImage.Bounds().Dx()-200) + 100
-
-	draw.Draw(inputImage, inputImage.Bounds(), &image.Uniform{RGBA_COLOR_GRAD_LIGHT}, image.Point{}, draw.Src)
-	draw.Draw(inputImage, image.Rect(xShift, 110, 100+xShift, 150), &image.Uniform{RGBA_COLOR_ORANGE}, image.Point{}, draw.Src)
-	addLabel(vmi._vmr, inputImage, xShift, 100, "heyhey!!! DTMF coming soon!!!", RGBA_COLOR_ORANGE)
-	addLabel(vmi._vmr, inputImage, 200, 200, fmt.Sprintf("Frame number %d", i), RGBA_COLOR_ORANGE)
-	addLabel(vmi._vmr, inputImage, 200, 300, "public void JetBrainsMonoSpace(int here) { print(\"Hello World!\"); }", RGBA_COLOR_BLACK)
+	if vmi._videoBroadcasts != nil {
+		vmi.playVideoBroadcast()
+		return
+	}
 
-	//sometimes ffmpeg skips frames
+	vmi._log.Info("Peer connection established. sending video at ", vmi._encoder.FPS(), " fps")
 
-	vmi._encoder.initPacket(avPacket, i)
+	free := make(chan *image.YCbCr, videoRenderBuffers)
+	for i := 0; i < videoRenderBuffers; i++ {
+		free <- newVideoFrame(vmi.videoFrameSize())
+	}
+	rendered := make(chan renderedFrame, videoRenderBuffers)
+	encoded := make(chan encodedFrame, videoSendQueueLength)
+	go vmi.encodeVideoFrames(rendered, free, encoded)
+	go vmi.sendVideoFrames(encoded)
+	renderer := newSceneRenderer(vmi._vmr)
+	renderVideoFrames(
+		vmi._voiceMenuInstanceContext,
+		vmi.videoFrameInterval,
+		vmi.videoFrameSize,
+		func(frame *image.YCbCr, i int) { renderer.draw(vmi._videoScene.Load(), frame, time.Now()) },
+		rendered,
+		free,
+	)
+}
 
-	err, outSize := vmi._encoder.WriteFrame(avPacket)
+// playVideoBroadcast sends the broadcast for the negotiated video at its best quality until the call ends
+func (vmi *VoiceMenuInstance) playVideoBroadcast() {
+	bitrate, _ := vmi._bitrateController.encoderSettings()
+	subscriber, err := vmi._videoBroadcasts.subscribe(vmi.videoCodec(), vmi.encoderSettingsAt(bitrate, 0))
 	if err != nil {
-		panic(err)
-	}
-	//keep feeding frames to ffmpeg, but don't display blanks
-	if outSize < 0 {
+		vmi._log.Errorf("Failed to join the video broadcast, ending the call: %s", err)
+		vmi.Close()
 		return
 	}
+	vmi._log.Info("Peer connection established. sending broadcast video")
 
-	//release lock while waiting for ticker
-	vmi._connectionReInitMutex.RUnlock()
-
-	<-ticker.C
+	vmi._connectionReInitMutex.Lock()
+	vmi._broadcastSubscriber = subscriber
+	vmi._connectionReInitMutex.Unlock()
+	// right away if the call already ended, which closes the frames
+	vmi.OnClose(func() {
+		vmi._videoBroadcasts.unsubscribe(subscriber)
+	})
+	vmi.sendVideoFrames(subscriber.frames)
+}
 
-	vmi._connectionReInitMutex.RLock()
+// SetVideoScene shows scene from the next frame on. Broadcast video is the same for every call and
+// shows no scene of its own
+func (vmi *VoiceMenuInstance) SetVideoScene(scene *videoScene) {
+	vmi._videoScene.Store(scene.shown(time.Now()))
+}
 
-	packetSlice := avPacketToSlice(avPacket)
-	mediaSample := media.Sample{
-		Data:     packetSlice,
-		Duration: time.Duration(float64(time.Millisecond) * float64(videoDurationBetweenFrames)),
-		//Timestamp: time.Now(),
-		PacketTimestamp: uint32(i),
+// enterDigit beeps, shows digit among the entered ones and highlights the option it chooses. # says back the
+// digits entered since the previous one, if text can be spoken
+func (vmi *VoiceMenuInstance) enterDigit(digit string) {
+	vmi.beep()
+	for {
+		scene := vmi._videoScene.Load()
+		entered := scene.withDigit(digit)
+		if !vmi._videoScene.CompareAndSwap(scene, entered) {
+			continue
+		}
+		if digit != "#" || vmi._vmr.tts == nil {
+			return
+		}
+		digits := strings.TrimSuffix(entered.digits, "#")
+		digits = digits[strings.LastIndex(digits, "#")+1:]
+		if digits != "" {
+			go vmi.sayDigits(digits)
+		}
+		return
 	}
-	if ivfErr := vmi._videoTrack.WriteSample(mediaSample); ivfErr != nil {
-		panic(ivfErr)
+}
+
+// start is the timestamp of the first sample of track
+func (vmi *VoiceMenuInstance) presentAudioFrame(track []OggAudioPage, frameIdx int, start uint32, lastGranule *uint64) {
+	if err := vmi.writeAudioPage(track, frameIdx, start, lastGranule); err != nil {
+		vmi._log.Errorf("Failed to send audio, ending the call: %s", err)
+		vmi.Close()
 	}
 }
 
-func (vmi *VoiceMenuInstance) presentAudioFrame(track []OggAudioPage, frameIdx int, lastGranule *uint64) {
+// separate function to defer mutex unlock
+func (vmi *VoiceMenuInstance) writeAudioPage(track []OggAudioPage, frameIdx int, start uint32, lastGranule *uint64) error {
 	vmi._connectionReInitMutex.RLock()
 	defer vmi._connectionReInitMutex.RUnlock()
+	if vmi._closed {
+		return nil
+	}
 
 	page := track[frameIdx]
 
-	// The amount of samples is the difference between the last and current timestamp
-	sampleCount := float64(page.pageHeader.GranulePosition - *lastGranule)
+	// the page starts where the previous one ended, granule positions of Opus count samples at 48 kHz
+	timestamp := start + uint32(*lastGranule)
 	*lastGranule = page.pageHeader.GranulePosition
-	sampleDuration := time.Duration(sampleCount/48) * time.Millisecond
-	logger.Trace("Sample duration ", sampleDuration, " Granule Position: ", page.pageHeader.GranulePosition)
+	vmi._log.Trace("Timestamp ", timestamp, " Granule Position: ", page.pageHeader.GranulePosition)
 
-	if err := vmi._audioTrack.WriteSample(media.Sample{Data: page.pageData, Duration: sampleDuration}); err != nil {
-		panic(err)
+	if err := vmi._audioTrack.writeFrame(page.pageData, timestamp); err != nil {
+		return err
 	}
+	audioPagesSentTotal.Inc()
+	return nil
 }